@@ -0,0 +1,109 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const anyPrincipal = "*"
+
+// AccessPolicy represents the principals allowed to read and write a page.
+// Principals are usernames, OIDC subjects, or API key IDs; "*" matches anyone.
+type AccessPolicy struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"` // writers can also read
+}
+
+// AccessControl represents access policies for pages, keyed by route.
+// A route ending in "*" applies to all routes having that prefix; the longest match wins.
+// Pages without a matching policy are accessible to anyone. A nil *AccessControl allows everything.
+type AccessControl struct {
+	policies map[string]AccessPolicy
+}
+
+func loadAccessControl(filename string) (*AccessControl, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading access policy file: %v", err)
+	}
+	var policies map[string]AccessPolicy
+	if err := json.Unmarshal(b, &policies); err != nil {
+		return nil, fmt.Errorf("failed parsing access policy file: %v", err)
+	}
+	return &AccessControl{policies}, nil
+}
+
+func (ac *AccessControl) policy(route string) (AccessPolicy, bool) {
+	if p, ok := ac.policies[route]; ok {
+		return p, true
+	}
+	var (
+		best  AccessPolicy
+		found bool
+		n     int
+	)
+	for k, p := range ac.policies {
+		if strings.HasSuffix(k, "*") {
+			prefix := strings.TrimSuffix(k, "*")
+			if strings.HasPrefix(route, prefix) && (!found || len(prefix) > n) {
+				best, found, n = p, true, len(prefix)
+			}
+		}
+	}
+	return best, found
+}
+
+func (ac *AccessControl) canRead(route string, principals ...string) bool {
+	if ac == nil {
+		return true
+	}
+	p, ok := ac.policy(route)
+	return !ok || allows(p.Read, principals) || allows(p.Write, principals)
+}
+
+// canReadExplicitly reports whether a policy, rather than the absence of one, allows principals to read a route.
+func (ac *AccessControl) canReadExplicitly(route string, principals ...string) bool {
+	if ac == nil {
+		return false
+	}
+	p, ok := ac.policy(route)
+	return ok && (allows(p.Read, principals) || allows(p.Write, principals))
+}
+
+func (ac *AccessControl) canWrite(route string, principals ...string) bool {
+	if ac == nil {
+		return true
+	}
+	p, ok := ac.policy(route)
+	return !ok || allows(p.Write, principals)
+}
+
+func allows(allowed, principals []string) bool {
+	for _, a := range allowed {
+		if a == anyPrincipal {
+			return true
+		}
+		for _, p := range principals {
+			if a == p && len(p) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// principalsOf returns the principals identified by a request's API key or session, if any.
+func principalsOf(r *http.Request, sessions *OIDCSessions, apiKeys []APIKey) []string {
+	if id, ok := authenticateAPIKey(apiKeys, r); ok {
+		return []string{id}
+	}
+	username, subject := getIdentity(r, sessions)
+	return []string{username, subject}
+}
+
+func errForbidden(principal, action, route string) error {
+	return fmt.Errorf("forbidden: %s cannot %s %s", principal, action, route)
+}
@@ -0,0 +1,124 @@
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+var testPolicies = map[string]AccessPolicy{
+	"/team/*":        {Read: []string{"alice", "bob"}, Write: []string{"alice"}},
+	"/team/secret*":  {Read: []string{"carol"}},
+	"/team/open":     {Write: []string{anyPrincipal}},
+	"/public/*":      {Read: []string{anyPrincipal}},
+	"/svc":           {Write: []string{"svc"}},
+	"/nobody/*":      {},
+	"/empty-subject": {Read: []string{""}},
+}
+
+func TestAccessControl(t *testing.T) {
+	ac := &AccessControl{testPolicies}
+	for _, tc := range []struct {
+		name       string
+		ac         *AccessControl
+		route      string
+		principals []string
+		read       bool
+		write      bool
+	}{
+		{"nil", nil, "/team/a", []string{"x"}, true, true},
+		{"no policy", ac, "/other", []string{"x"}, true, true},
+		{"writer", ac, "/team/a", []string{"alice"}, true, true},
+		{"reader", ac, "/team/a", []string{"bob"}, true, false},
+		{"stranger", ac, "/team/a", []string{"x"}, false, false},
+		{"any of principals", ac, "/team/a", []string{"default-user", "alice"}, true, true},
+		{"longest prefix wins", ac, "/team/secrets", []string{"alice"}, false, false},
+		{"longest prefix, reader", ac, "/team/secrets", []string{"carol"}, true, false},
+		{"exact match wins", ac, "/team/open", []string{"x"}, true, true},
+		{"wildcard reader", ac, "/public/a", []string{"x"}, true, false},
+		{"api key", ac, "/svc", []string{"svc"}, true, true},
+		{"empty policy", ac, "/nobody/a", []string{"alice"}, false, false},
+		{"empty principal", ac, "/empty-subject", []string{""}, false, false},
+	} {
+		if got := tc.ac.canRead(tc.route, tc.principals...); got != tc.read {
+			t.Errorf("%s: want read=%v, got %v", tc.name, tc.read, got)
+		}
+		if got := tc.ac.canWrite(tc.route, tc.principals...); got != tc.write {
+			t.Errorf("%s: want write=%v, got %v", tc.name, tc.write, got)
+		}
+	}
+}
+
+func TestLoadAccessControl(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"valid", `{"/team/*":{"read":["bob"],"write":["alice"]}}`, true},
+		{"invalid", `{"/team/*":["bob"]}`, false},
+		{"missing", ``, false},
+	} {
+		filename := filepath.Join(dir, tc.name+".json")
+		if tc.data != "" {
+			if err := ioutil.WriteFile(filename, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ac, err := loadAccessControl(filename)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, err)
+			continue
+		}
+		if tc.ok && (!ac.canRead("/team/a", "bob") || ac.canWrite("/team/a", "bob") || !ac.canWrite("/team/a", "alice")) {
+			t.Errorf("%s: want policy loaded, got %v", tc.name, ac.policies)
+		}
+	}
+}
+
+func TestClientWatchForbidden(t *testing.T) {
+	b := newTestBroker(&AccessControl{testPolicies})
+	for _, tc := range []struct {
+		user  string
+		route string
+		ok    bool
+	}{
+		{"alice", "/team/a", true},
+		{"x", "/team/a", false},
+	} {
+		mustPatch(t, b, tc.route, `{"d":[{"k":"x","d":{"v":1}}]}`)
+		c := newTestClient(b, tc.user)
+		c.handle([]byte("+ " + tc.route + " "))
+		m := recv(t, c)
+		if tc.ok && m["p"] == nil {
+			t.Errorf("%s %s: want page, got %v", tc.user, tc.route, m)
+		} else if !tc.ok && m["e"] != "forbidden" {
+			t.Errorf("%s %s: want forbidden, got %v", tc.user, tc.route, m)
+		}
+	}
+}
+
+func TestWebServerAccessControl(t *testing.T) {
+	s := newTestWebServer(t, "svc:s3cret,other:x", &AccessControl{testPolicies})
+	mustPatch(t, s.broker, "/svc", `{"d":[{"k":"x","d":{"v":1}}]}`)
+	for _, tc := range []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{"allowed", "s3cret", http.StatusOK},
+		{"denied", "x", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/svc", nil)
+		r.Header.Set("Content-Type", contentTypeJSON)
+		r.Header.Set("Authorization", "Bearer "+tc.key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
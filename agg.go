@@ -0,0 +1,110 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// aggregate computes summary statistics over the values at offset i in tups, skipping nil and non-numeric values.
+func aggregate(tups [][]interface{}, i int) AggD {
+	var a AggD
+	for _, tup := range tups {
+		if i >= len(tup) {
+			continue
+		}
+		x, ok := tup[i].(float64)
+		if !ok {
+			continue
+		}
+		if a.Count == 0 || x < a.Min {
+			a.Min = x
+		}
+		if a.Count == 0 || x > a.Max {
+			a.Max = x
+		}
+		a.Sum += x
+		a.Count++
+	}
+	if a.Count > 0 {
+		a.Mean = a.Sum / float64(a.Count)
+	}
+	return a
+}
+
+// Group key for records having no value for the grouping field.
+const nullGroup = "null"
+
+// group groups tuples by the values of a field, and returns each group's aggregate, or nil if a group has no numeric
+// values to aggregate. Nil tuples are skipped.
+func group(t Typ, tups [][]interface{}, q GroupD) (map[string]interface{}, error) {
+	g, ok := t.offset(q.G)
+	if !ok {
+		return nil, fmt.Errorf("field not found: %s", q.G)
+	}
+	f := g
+	switch q.A {
+	case "count":
+	case "sum", "mean", "min", "max":
+		if f, ok = t.offset(q.F); !ok {
+			return nil, fmt.Errorf("field not found: %s", q.F)
+		}
+	default:
+		return nil, fmt.Errorf("unknown aggregate: %s", q.A)
+	}
+
+	groups := make(map[string][][]interface{})
+	for _, tup := range tups {
+		if tup == nil {
+			continue
+		}
+		var v interface{}
+		if g < len(tup) {
+			v = tup[g]
+		}
+		k := groupKey(v)
+		groups[k] = append(groups[k], tup)
+	}
+
+	r := make(map[string]interface{}, len(groups))
+	for k, tups := range groups {
+		if q.A == "count" {
+			r[k] = len(tups)
+			continue
+		}
+		a := aggregate(tups, f)
+		if a.Count == 0 {
+			r[k] = nil
+			continue
+		}
+		switch q.A {
+		case "sum":
+			r[k] = a.Sum
+		case "mean":
+			r[k] = a.Mean
+		case "min":
+			r[k] = a.Min
+		case "max":
+			r[k] = a.Max
+		}
+	}
+	return r, nil
+}
+
+// groupKey returns the group name for a value.
+func groupKey(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return nullGroup
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
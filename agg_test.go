@@ -0,0 +1,39 @@
+package wave
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGroup(t *testing.T) {
+	typ := newType([]string{"g", "v"})
+	var tups [][]interface{}
+	if err := json.Unmarshal([]byte(`[["a",1],["b",2],["a",3],[null,4],["c","x"],null,[true,5],[1.5,6],[[1],7]]`), &tups); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		q    GroupD
+		want string // groups, or error
+	}{
+		{"count", GroupD{G: "g", A: "count"}, `{"1.5":1,"[1]":1,"a":2,"b":1,"c":1,"null":1,"true":1}`},
+		{"sum", GroupD{G: "g", F: "v", A: "sum"}, `{"1.5":6,"[1]":7,"a":4,"b":2,"c":null,"null":4,"true":5}`},
+		{"mean", GroupD{G: "g", F: "v", A: "mean"}, `{"1.5":6,"[1]":7,"a":2,"b":2,"c":null,"null":4,"true":5}`},
+		{"min", GroupD{G: "g", F: "v", A: "min"}, `{"1.5":6,"[1]":7,"a":1,"b":2,"c":null,"null":4,"true":5}`},
+		{"max", GroupD{G: "g", F: "v", A: "max"}, `{"1.5":6,"[1]":7,"a":3,"b":2,"c":null,"null":4,"true":5}`},
+		{"by index", GroupD{G: "0", F: "1", A: "max"}, `{"1.5":6,"[1]":7,"a":3,"b":2,"c":null,"null":4,"true":5}`},
+		{"no group field", GroupD{G: "z", A: "count"}, `field not found: z`},
+		{"no aggregate field", GroupD{G: "g", F: "z", A: "sum"}, `field not found: z`},
+		{"unknown aggregate", GroupD{G: "g", F: "v", A: "median"}, `unknown aggregate: median`},
+	} {
+		got := ""
+		if r, err := group(typ, tups, tc.q); err != nil {
+			got = err.Error()
+		} else {
+			got = toJSON(t, r)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
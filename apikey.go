@@ -0,0 +1,49 @@
+package wave
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIKey represents a static key for authenticating service-to-service requests.
+type APIKey struct {
+	id     string // identifier, for logging
+	secret []byte // secret, presented by clients
+}
+
+// parseAPIKeys parses a comma-separated list of "id:secret" pairs.
+func parseAPIKeys(s string) ([]APIKey, error) {
+	var keys []APIKey
+	for i, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		tokens := strings.SplitN(pair, ":", 2)
+		if len(tokens) != 2 || len(tokens[0]) == 0 || len(tokens[1]) == 0 {
+			return nil, fmt.Errorf("want API key as id:secret, got entry #%d", i+1)
+		}
+		keys = append(keys, APIKey{tokens[0], []byte(tokens[1])})
+	}
+	return keys, nil
+}
+
+const bearerPrefix = "Bearer "
+
+// authenticateAPIKey returns the ID of the API key presented in the request's Authorization header, if valid.
+func authenticateAPIKey(keys []APIKey, r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, bearerPrefix) {
+		return "", false
+	}
+	secret := []byte(strings.TrimPrefix(h, bearerPrefix))
+	id, found := "", false
+	for _, key := range keys { // check all keys, to avoid leaking which key matched through timing.
+		if subtle.ConstantTimeCompare(key.secret, secret) == 1 && !found {
+			id, found = key.id, true
+		}
+	}
+	return id, found
+}
@@ -0,0 +1,117 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string // ids; nil if rejected
+	}{
+		{"", []string{}},
+		{"a:x", []string{"a"}},
+		{" a:x , b:y:z ,", []string{"a", "b"}},
+		{"a", nil},
+		{"a:", nil},
+		{":x", nil},
+	} {
+		keys, err := parseAPIKeys(tc.s)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: want error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+			continue
+		}
+		ids := []string{}
+		for _, k := range keys {
+			ids = append(ids, k.id)
+		}
+		if toJSON(t, ids) != toJSON(t, tc.want) {
+			t.Errorf("%q: want %v, got %v", tc.s, tc.want, ids)
+		}
+	}
+	if keys, _ := parseAPIKeys("b:y:z"); string(keys[0].secret) != "y:z" {
+		t.Errorf("want secret y:z, got %s", keys[0].secret)
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	keys, _ := parseAPIKeys("a:x,b:y")
+	for _, tc := range []struct {
+		header string
+		id     string
+	}{
+		{"Bearer x", "a"},
+		{"Bearer y", "b"},
+		{"Bearer z", ""},
+		{"Bearer ", ""},
+		{"x", ""},
+		{"Basic eDp5", ""},
+		{"", ""},
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/p", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		id, ok := authenticateAPIKey(keys, r)
+		if id != tc.id || ok != (tc.id != "") {
+			t.Errorf("%q: want %q, got %q, %v", tc.header, tc.id, id, ok)
+		}
+	}
+}
+
+// newTestWebServer returns a web server over a new site, accepting the given API keys, and user "alice" with password "pw".
+func newTestWebServer(t *testing.T, apiKeys string, ac *AccessControl) *WebServer {
+	t.Helper()
+	keys, err := parseAPIKeys(apiKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBroker(newSite(), ac, nil, ServerConf{})
+	go b.run()
+	return newWebServer(b.site, b, map[string][]byte{"alice": hash}, keys, false, nil, t.TempDir(), 1<<20)
+}
+
+func TestWebServerAPIKeyWrites(t *testing.T) {
+	ac := &AccessControl{map[string]AccessPolicy{"/locked": {Write: []string{"svc"}}}}
+	for _, tc := range []struct {
+		name   string
+		route  string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"api key", "/p", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"api key, allowed by policy", "/locked", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"bad api key", "/p", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"password", "/p", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, http.StatusOK},
+		{"password, denied by policy", "/locked", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, http.StatusForbidden},
+		{"bad password", "/p", func(r *http.Request) { r.SetBasicAuth("alice", "x") }, http.StatusUnauthorized},
+		{"none", "/p", func(r *http.Request) {}, http.StatusUnauthorized},
+	} {
+		s := newTestWebServer(t, "svc:s3cret", ac)
+		r := httptest.NewRequest(http.MethodPatch, tc.route, strings.NewReader(`{"d":[{"k":"x","d":{"v":1}}]}`))
+		tc.auth(r)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body)
+		}
+		if applied := s.site.at(tc.route) != nil; applied != (tc.status == http.StatusOK) {
+			t.Errorf("%s: want applied=%v, got %v", tc.name, tc.status == http.StatusOK, applied)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord represents an entry in the audit log.
+type AuditRecord struct {
+	Time    string `json:"time"`           // RFC3339, UTC
+	Subject string `json:"subject"`        // authenticated principal: username, OIDC subject or API key ID
+	Page    string `json:"page"`           // page url
+	Op      string `json:"op"`             // operation kind
+	Card    string `json:"card,omitempty"` // affected card
+	Key     string `json:"key,omitempty"`  // affected key: card, attribute or buffer
+	Sample  int    `json:"sample"`         // 1 in how many patches to the page are logged
+}
+
+// AuditLog writes a record of changes made to pages, as JSON lines.
+// To keep volume in check, only one in every sample patches to each page is logged.
+type AuditLog struct {
+	sync.Mutex
+	w      io.Writer
+	sample int
+	counts map[string]int // page url => patches seen
+}
+
+func newAuditLog(w io.Writer, sample int) *AuditLog {
+	if sample < 1 {
+		sample = 1
+	}
+	return &AuditLog{w: w, sample: sample, counts: make(map[string]int)}
+}
+
+// openAuditLog opens an audit log at the given path, or on stdout if the path is "-".
+func openAuditLog(filename string, sample int) (*AuditLog, error) {
+	if filename == "-" {
+		return newAuditLog(os.Stdout, sample), nil
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening audit log: %v", err)
+	}
+	return newAuditLog(f, sample), nil
+}
+
+// log records the changes made to a page by a principal, subject to sampling.
+func (a *AuditLog) log(principal, url string, ops OpsD) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	n := a.counts[url]
+	a.counts[url] = n + 1
+	if n%a.sample != 0 {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	enc := json.NewEncoder(a.w)
+	for _, op := range ops.D {
+		r := AuditRecord{now, principal, url, opKind(op), "", op.K, a.sample}
+		if len(op.K) > 0 {
+			r.Card = strings.SplitN(op.K, keySeparator, 2)[0]
+		}
+		if err := enc.Encode(r); err != nil {
+			echo(Log{"t": "audit", "error": err.Error()})
+			return
+		}
+	}
+}
+
+// forget discards sampling state for a page.
+func (a *AuditLog) forget(url string) {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	delete(a.counts, url)
+	a.Unlock()
+}
+
+// opKind returns the kind of an operation, as interpreted by site.exec().
+func opKind(op OpD) string {
+	switch {
+	case len(op.K) == 0:
+		return "drop"
+	case op.C != nil, op.F != nil, op.M != nil:
+		return "set_buffer"
+	case op.D != nil:
+		return "put"
+	case op.U != nil:
+		return "update"
+	case op.W != nil:
+		return "swap"
+	case op.N != nil:
+		return "rename"
+	case op.L != nil:
+		return "fill"
+	case op.A != nil:
+		return "append"
+	case op.J != nil:
+		return "insert"
+	case op.Z:
+		return "compact"
+	case op.X != nil:
+		return "delete_keys"
+	case op.S != 0:
+		return "resize"
+	case op.V == nil:
+		return "delete"
+	}
+	return "set"
+}
@@ -0,0 +1,161 @@
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditRecords decodes the records written to an audit log.
+func auditRecords(t *testing.T, data string) []AuditRecord {
+	t.Helper()
+	var rs []AuditRecord
+	dec := json.NewDecoder(strings.NewReader(data))
+	for dec.More() {
+		var r AuditRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := newAuditLog(&buf, 1)
+	a.log("alice", "/p", OpsD{D: []OpD{{K: "c", D: map[string]interface{}{}}, {K: "c items x", V: []interface{}{1.0}}, {}}})
+	rs := auditRecords(t, buf.String())
+	for i, want := range []AuditRecord{
+		{Subject: "alice", Page: "/p", Op: "put", Card: "c", Key: "c", Sample: 1},
+		{Subject: "alice", Page: "/p", Op: "set", Card: "c", Key: "c items x", Sample: 1},
+		{Subject: "alice", Page: "/p", Op: "drop", Sample: 1},
+	} {
+		if i >= len(rs) {
+			t.Fatalf("want %d records, got %d", i+1, len(rs))
+		}
+		r := rs[i]
+		if _, err := time.Parse(time.RFC3339Nano, r.Time); err != nil {
+			t.Errorf("%d: want RFC3339 time, got %q", i, r.Time)
+		}
+		r.Time = ""
+		if r != want {
+			t.Errorf("%d: want %+v, got %+v", i, want, r)
+		}
+	}
+}
+
+func TestAuditLogSample(t *testing.T) {
+	var buf bytes.Buffer
+	a := newAuditLog(&buf, 3)
+	ops := OpsD{D: []OpD{{K: "c", V: 1.0}}}
+	for _, tc := range []struct {
+		url    string
+		logged bool
+	}{
+		{"/p", true},
+		{"/p", false},
+		{"/q", true}, // counted per page
+		{"/p", false},
+		{"/p", true},
+	} {
+		buf.Reset()
+		a.log("alice", tc.url, ops)
+		if logged := buf.Len() > 0; logged != tc.logged {
+			t.Errorf("%s: want logged=%v, got %q", tc.url, tc.logged, buf.String())
+		}
+	}
+	a.forget("/p")
+	buf.Reset()
+	if a.log("alice", "/p", ops); buf.Len() == 0 {
+		t.Error("want first patch logged once page forgotten")
+	}
+	var disabled *AuditLog
+	disabled.log("alice", "/p", ops)
+	disabled.forget("/p")
+}
+
+func TestOpKind(t *testing.T) {
+	for _, tc := range []struct {
+		op   string
+		kind string
+	}{
+		{`{}`, "drop"},
+		{`{"k":"c","v":1}`, "set"},
+		{`{"k":"c"}`, "delete"},
+		{`{"k":"c","d":{}}`, "put"},
+		{`{"k":"c items","c":{"f":["a"],"n":1}}`, "set_buffer"},
+		{`{"k":"c items","f":{"f":["a"],"n":1}}`, "set_buffer"},
+		{`{"k":"c items","m":{"f":["a"]}}`, "set_buffer"},
+		{`{"k":"c items","u":{"x":[1]}}`, "update"},
+		{`{"k":"c items x","w":{"v":[1]}}`, "swap"},
+		{`{"k":"c items","n":{"f":"a","t":"b"}}`, "rename"},
+		{`{"k":"c items","l":{}}`, "fill"},
+		{`{"k":"c items","a":{"d":[[1]]}}`, "append"},
+		{`{"k":"c items","j":{"i":0,"v":[1]}}`, "insert"},
+		{`{"k":"c items","z":true}`, "compact"},
+		{`{"k":"c items","x":{"p":"a"}}`, "delete_keys"},
+		{`{"k":"c items","s":5}`, "resize"},
+	} {
+		var op OpD
+		if err := json.Unmarshal([]byte(tc.op), &op); err != nil {
+			t.Fatal(err)
+		}
+		if got := opKind(op); got != tc.kind {
+			t.Errorf("%s: want %s, got %s", tc.op, tc.kind, got)
+		}
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ { // appends across restarts
+		a, err := openAuditLog(filename, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.log("alice", "/p", OpsD{D: []OpD{{K: "c", V: 1.0}}})
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(auditRecords(t, string(data))); n != 2 {
+		t.Errorf("want 2 records, got %d", n)
+	}
+	if _, err := openAuditLog(filepath.Join(t.TempDir(), "missing", "audit.log"), 1); err == nil {
+		t.Error("want error opening audit log in missing directory")
+	}
+}
+
+func TestBrokerAudit(t *testing.T) {
+	var buf bytes.Buffer
+	b := newBroker(newSite(), nil, newAuditLog(&buf, 1), ServerConf{})
+	go b.run()
+	for _, tc := range []struct {
+		name   string
+		data   string
+		logged int
+	}{
+		{"applied", `{"d":[{"k":"c","d":{"v":1}}]}`, 1},
+		{"not applied", `{"d":[{"k":"c missing items","l":{}}]}`, 0},
+		{"bad json", `{`, 0},
+	} {
+		buf.Reset()
+		b.patch("bob", "", "/p", []byte(tc.data), false)
+		rs := auditRecords(t, buf.String())
+		if len(rs) != tc.logged {
+			t.Errorf("%s: want %d records, got %d", tc.name, tc.logged, len(rs))
+			continue
+		}
+		for _, r := range rs {
+			if r.Subject != "bob" || r.Page != "/p" {
+				t.Errorf("%s: want change by bob to /p, got %+v", tc.name, r)
+			}
+		}
+	}
+}
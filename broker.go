@@ -2,10 +2,20 @@ package wave
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"path"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 // MsgT represents message types.
@@ -17,6 +27,11 @@ const (
 	patchMsgT
 	queryMsgT
 	watchMsgT
+	beginMsgT
+	commitMsgT
+	resumeMsgT
+	unwatchMsgT
+	filterMsgT
 )
 
 // Msg represents a message.
@@ -30,6 +45,7 @@ var (
 	msgSep     = []byte{' '}
 	emptyJSON  = []byte("{}")
 	invalidMsg = Msg{t: badMsgT}
+	resetMsg   = []byte(`{"r":1}`)
 )
 
 // Pub represents a published message
@@ -42,6 +58,8 @@ type Pub struct {
 type Sub struct {
 	route  string
 	client *Client
+	seq    int64 // last sequence number seen by the client, if resuming; else 0
+	app    bool  // client- or user-level route of an app?
 }
 
 // Broker represents a message broker.
@@ -51,11 +69,37 @@ type Broker struct {
 	publish     chan Pub
 	subscribe   chan Sub
 	unsubscribe chan *Client
-	apps        map[string]*App // route => app
-	appsMux     sync.RWMutex    // mutex for tracking apps
+	apps        map[string]*App                    // route => app
+	appsMux     sync.RWMutex                       // mutex for tracking apps
+	queueSize   int                                // per-client send queue size
+	sendTimeout time.Duration                      // max time a client's send queue can remain full
+	halt        chan struct{}                      // disconnect all clients
+	logout      chan string                        // disconnect clients of session
+	conns       sync.WaitGroup                     // active client connections
+	replaySize  int                                // max messages held per route for replaying; 0=disabled
+	histories   map[string]*History                // route => recent messages
+	access      *AccessControl                     // page access policies
+	maxMsgSize  int64                              // max size of messages from clients, in bytes
+	pingPeriod  time.Duration                      // interval between pings to clients
+	maxMissed   int32                              // max consecutive pings a client can fail to respond to
+	idleTimeout time.Duration                      // max time a client can remain idle; 0=forever
+	patterns    map[string]map[*Client]interface{} // route pattern => clients
+	unwatch     chan Sub
+	audit       *AuditLog // nil if disabled
+	filter      chan Filter
+	limiter     *RateLimiter    // per-client limits on the rate of changes; nil if disabled
+	compression Compression     // compression of messages sent to clients
+	dedup       *Deduper        // recently applied op ids, per client; nil if disabled
+	private     map[string]bool // subscribed client- and user-level routes of apps, never matched by patterns
+	join        chan *Client
+	all         map[*Client]interface{} // live clients, whether subscribed to any route or pattern or not
 }
 
-func newBroker(site *Site) *Broker {
+func newBroker(site *Site, access *AccessControl, audit *AuditLog, conf ServerConf) *Broker {
+	queueSize := conf.SendQueueSize
+	if queueSize <= 0 {
+		queueSize = 256
+	}
 	return &Broker{
 		site,
 		make(map[string]map[*Client]interface{}),
@@ -64,6 +108,28 @@ func newBroker(site *Site) *Broker {
 		make(chan *Client),
 		make(map[string]*App),
 		sync.RWMutex{},
+		queueSize,
+		conf.SendTimeout,
+		make(chan struct{}),
+		make(chan string),
+		sync.WaitGroup{},
+		conf.ReplaySize,
+		make(map[string]*History),
+		access,
+		conf.maxMessageSize(),
+		conf.pingInterval(),
+		conf.maxMissedPongs(),
+		conf.IdleTimeout,
+		make(map[string]map[*Client]interface{}),
+		make(chan Sub),
+		audit,
+		make(chan Filter),
+		newRateLimiter(conf.RateLimit, conf.RateBurst, conf.RateLimitExempt),
+		newCompression(conf.Compress, conf.CompressLevel, conf.CompressMin),
+		newDeduper(conf.DedupWindow, conf.DedupClients),
+		make(map[string]bool),
+		make(chan *Client),
+		make(map[*Client]interface{}),
 	}
 }
 
@@ -109,6 +175,16 @@ func parseMsgT(s []byte) MsgT {
 			return watchMsgT
 		case '#':
 			return noopMsgT
+		case '[':
+			return beginMsgT
+		case ']':
+			return commitMsgT
+		case '^':
+			return resumeMsgT
+		case '-':
+			return unwatchMsgT
+		case '~':
+			return filterMsgT
 		}
 	}
 	return badMsgT
@@ -128,16 +204,44 @@ func parseMsg(s []byte) Msg {
 	return invalidMsg
 }
 
-// patch broadcasts changes to clients and patches site data.
-func (b *Broker) patch(route string, data []byte) {
-	b.publish <- Pub{route, data}
-	// Write AOF entry with patch marker "*" as-is to log file.
+// patch patches site data on behalf of principal, and broadcasts changes to clients.
+// Changes are broadcast and logged as applied: changes that cannot be applied are not broadcast,
+// and values are sent as stored. If strict, changes are validated in their entirety before
+// any is applied. Ops carrying ids already applied by the client identified by key are skipped.
+// Changes skipped, if not rejected in their entirety, are returned, to be reported to the caller.
+func (b *Broker) patch(principal, key, route string, data []byte, strict bool) ([]OpErrorD, error) {
+	atomic.AddInt64(&metrics.msgs, 1)
+	startTime := time.Now()
+	var ops OpsD
+	var applied Applied
+	var ids []string
+	err := json.Unmarshal(data, &ops) // TODO speed up
+	if err != nil {
+		err = fmt.Errorf("failed unmarshaling data: %v", err)
+	} else {
+		n := len(ops.D)
+		ops.D, ids = b.dedup.claim(key, ops.D)
+		if skipped := n - len(ops.D); skipped > 0 {
+			echo(Log{"t": "broker_dedup", "route": route, "skipped": strconv.Itoa(skipped)})
+		}
+		applied, err = b.site.exec(route, ops, strict)
+	}
+	metrics.latency.observe(time.Since(startTime))
+	if err != nil {
+		b.dedup.release(key, ids)
+		echo(Log{"t": "broker_patch", "route": route, "error": err.Error()})
+		return nil, err
+	}
+	if applied.changes == nil {
+		return applied.errors, nil
+	}
+	b.audit.log(principal, route, ops)
+	b.publish <- Pub{route, applied.deltas}
+	// Write AOF entry with patch marker "*" to log file.
 	// FIXME bufio.Scanner.Scan() is not reliable if line length > 65536 chars,
 	// so reading back in is unreliable.
-	log.Println("*", route, string(data))
-	if err := b.site.patch(route, data); err != nil {
-		echo(Log{"t": "broker_patch", "error": err.Error()})
-	}
+	log.Println("*", route, string(applied.changes))
+	return applied.errors, nil
 }
 
 // TODO allow only in debug mode?
@@ -151,27 +255,261 @@ func (b *Broker) reset(route string) {
 func (b *Broker) run() {
 	for {
 		select {
+		case client := <-b.join:
+			b.all[client] = nil
 		case sub := <-b.subscribe:
+			if sub.app {
+				b.private[sub.route] = true
+			}
 			b.addClient(sub.route, sub.client)
+			if sub.seq > 0 {
+				b.replay(sub.route, sub.client, sub.seq)
+			} else if isPattern(sub.route) {
+				b.sendMatching(sub.route, sub.client)
+			}
+		case sub := <-b.unwatch:
+			b.removeClient(sub.route, sub.client)
+			delete(sub.client.filters, sub.route)
+		case f := <-b.filter:
+			b.setFilter(f)
 		case client := <-b.unsubscribe:
 			b.dropClient(client)
+		case <-b.halt:
+			b.dropClients(websocket.CloseServiceRestart, func(*Client) bool { return true })
+		case session := <-b.logout:
+			b.dropClients(websocket.ClosePolicyViolation, func(c *Client) bool { return c.session == session })
 		case pub := <-b.publish:
+			raw, seq := pub.data, int64(0)
+			if b.replaySize > 0 {
+				h, ok := b.histories[pub.route]
+				if !ok {
+					h = newHistory(b.replaySize)
+					b.histories[pub.route] = h
+				}
+				pub.data = h.add(pub.data)
+				seq = h.seq
+			}
 			if clients, ok := b.clients[pub.route]; ok {
+				var filtered *Filtered // decoded on first use, then shared by filtered clients
 				for client := range clients {
-					if !client.send(pub.data) {
+					data := pub.data
+					if f, ok := client.filters[pub.route]; ok {
+						if filtered == nil {
+							filtered = newFiltered(raw, seq)
+						}
+						if data = filtered.apply(f); data == nil {
+							continue
+						}
+					}
+					if !b.send(client, data) {
 						b.dropClient(client)
 					}
 				}
 			}
+			b.publishMatching(pub)
+		}
+	}
+}
+
+// setFilter sets or removes a client's filter on the records of a map buffer.
+func (b *Broker) setFilter(f Filter) {
+	if f.client.dropped {
+		return
+	}
+	fs, ok := f.client.filters[f.route]
+	if !ok {
+		if len(f.keys) == 0 {
+			return
+		}
+		if f.client.filters == nil {
+			f.client.filters = make(map[string]KeyFilter)
+		}
+		fs = make(KeyFilter)
+		f.client.filters[f.route] = fs
+	}
+	fs.set(f.key, f.keys)
+	if len(fs) == 0 {
+		delete(f.client.filters, f.route)
+	}
+}
+
+// isPattern reports whether a route is a wildcard pattern, using the syntax of path.Match.
+func isPattern(route string) bool {
+	return strings.ContainsAny(route, "*?[")
+}
+
+// matchable reports whether a page can be sent to a client because it matches a pattern the client is subscribed to.
+// The pages apps write for individual clients and users are private, and never match: client-level routes are
+// recognized by their form, user-level routes while any client has the app open. If access control is configured,
+// other pages match only if covered by a read policy allowing the client, since pages without a policy are only
+// protected by their urls being hard to guess; else, all other pages match, as all pages are readable by anyone.
+func (b *Broker) matchable(route string, client *Client) bool {
+	if b.private[route] || isClientRoute(route) {
+		return false
+	}
+	if b.access == nil {
+		return true
+	}
+	return b.access.canReadExplicitly(route, client.username, client.subject)
+}
+
+// isClientRoute reports whether a route is of the form "/"+client id, the client-level route of a unicast app.
+func isClientRoute(route string) bool {
+	if len(route) < 2 || route[0] != '/' || strings.Contains(route[1:], "/") {
+		return false
+	}
+	_, err := uuid.Parse(route[1:])
+	return err == nil
+}
+
+// publishMatching sends a message to clients subscribed to patterns matching the message's route,
+// annotated with the route.
+func (b *Broker) publishMatching(pub Pub) {
+	var data []byte
+	for pattern, clients := range b.patterns {
+		if ok, _ := path.Match(pattern, pub.route); !ok {
+			continue
+		}
+		if data == nil {
+			data = withURL(pub.data, pub.route)
+		}
+		for client := range clients {
+			if !b.matchable(pub.route, client) {
+				continue
+			}
+			if !b.send(client, data) {
+				b.dropClient(client)
+			}
+		}
+	}
+}
+
+// sendMatching sends a client the pages matching a pattern, each annotated with its route.
+func (b *Broker) sendMatching(pattern string, client *Client) {
+	for _, route := range b.site.urls() {
+		if ok, _ := path.Match(pattern, route); !ok || !b.matchable(route, client) {
+			continue
+		}
+		if page := b.site.at(route); page != nil {
+			if data := page.marshal(); data != nil {
+				if !b.send(client, withURL(data, route)) {
+					b.dropClient(client)
+					return
+				}
+			}
+		}
+	}
+}
+
+// withURL annotates a JSON object with the url ("u") of the page it pertains to.
+func withURL(data []byte, url string) []byte {
+	u, err := json.Marshal(url)
+	if len(data) < 2 || data[0] != '{' || err != nil {
+		return data
+	}
+	buf := make([]byte, 0, len(data)+len(u)+6)
+	buf = append(buf, `{"u":`...)
+	buf = append(buf, u...)
+	if len(data) > 2 {
+		buf = append(buf, ',')
+	}
+	return append(buf, data[1:]...)
+}
+
+// replay sends a client the messages published to a route after seq, or, if those are no longer available,
+// the entire page.
+func (b *Broker) replay(route string, client *Client, seq int64) {
+	var last int64
+	if h, ok := b.histories[route]; ok {
+		if msgs, ok := h.since(seq); ok {
+			for _, msg := range msgs {
+				if !b.send(client, msg) {
+					b.dropClient(client)
+					return
+				}
+			}
+			return
+		}
+		last = h.seq
+	}
+	data := notFound
+	if page := b.site.at(route); page != nil {
+		if d := page.marshal(); d != nil {
+			data = d
+		}
+	}
+	if last > 0 {
+		data = withSeq(data, last)
+	}
+	if !b.send(client, data) {
+		b.dropClient(client)
+	}
+}
+
+// drain asks all clients to reconnect later, and waits until they disconnect, or until ctx is done.
+func (b *Broker) drain(ctx context.Context) {
+	b.halt <- struct{}{}
+
+	done := make(chan struct{})
+	go func() {
+		b.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		echo(Log{"t": "drain"})
+	case <-ctx.Done():
+		echo(Log{"t": "drain", "error": "timed out waiting for clients to disconnect"})
+	}
+}
+
+// dropClients drops matching clients, closing their connections with the given close code.
+// All live clients are considered, including those only watching patterns, or only sending changes.
+func (b *Broker) dropClients(code int, match func(*Client) bool) {
+	for client := range b.all {
+		if match(client) {
+			client.closeCode = code
+			b.dropClient(client) // deleting during iteration is safe
 		}
 	}
 }
 
+// send queues data for a client, without blocking. If the client's queue is full, the data is discarded,
+// and send reports false once the queue has remained full for longer than the send timeout.
+// A client that recovers after discarding data is sent a reset, forcing it to reload.
+func (b *Broker) send(client *Client, data []byte) bool {
+	if !client.stalled.IsZero() {
+		if !client.send(resetMsg) {
+			return !client.isStalled(b.sendTimeout)
+		}
+		echo(Log{"t": "ui_recover", "addr": client.addr, "stalled": time.Since(client.stalled).String()})
+		client.stalled = time.Time{}
+	}
+	if client.send(data) {
+		return true
+	}
+	client.stalled = time.Now()
+	return b.sendTimeout > 0
+}
+
+// subscribers returns the clients subscribed to a route or pattern.
+func (b *Broker) subscribers(route string) map[string]map[*Client]interface{} {
+	if isPattern(route) {
+		return b.patterns
+	}
+	return b.clients
+}
+
 func (b *Broker) addClient(route string, client *Client) {
-	clients, ok := b.clients[route]
+	if client.dropped {
+		return
+	}
+	subs := b.subscribers(route)
+	clients, ok := subs[route]
 	if !ok {
 		clients = make(map[*Client]interface{})
-		b.clients[route] = clients
+		subs[route] = clients
 	}
 	clients[client] = nil
 
@@ -179,29 +517,44 @@ func (b *Broker) addClient(route string, client *Client) {
 }
 
 func (b *Broker) dropClient(client *Client) {
-	var gc []string
+	if client.dropped {
+		return
+	}
+	client.dropped = true
+	delete(b.all, client)
+
+	if !client.stalled.IsZero() {
+		echo(Log{"t": "ui_backpressure", "addr": client.addr, "stalled": time.Since(client.stalled).String()})
+	}
 
 	for _, route := range client.routes {
-		if clients, ok := b.clients[route]; ok {
-			delete(clients, client)
-			if len(clients) == 0 {
-				gc = append(gc, route)
-			}
-		}
+		b.removeClient(route, client)
 	}
 
 	client.quit()
 
-	for _, route := range gc {
-		delete(b.clients, route)
-	}
-
 	// FIXME leak: this is not captured in the AOF logging; page will be recreated on hydration
 	b.site.del(client.id) // delete transient page, if any.
+	delete(b.histories, "/"+client.id)
+	b.audit.forget("/" + client.id)
+	b.dedup.forget(client.id)
 
 	echo(Log{"t": "ui_drop", "addr": client.addr})
 }
 
+// removeClient unsubscribes a client from a route or pattern.
+// Private routes are forgotten once their last subscriber leaves.
+func (b *Broker) removeClient(route string, client *Client) {
+	subs := b.subscribers(route)
+	if clients, ok := subs[route]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(subs, route)
+			delete(b.private, route)
+		}
+	}
+}
+
 // routes returns a sorted slice of routes managed by this broker.
 func (b *Broker) routes() []string {
 	b.appsMux.RLock()
@@ -0,0 +1,259 @@
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestBroker(ac *AccessControl) *Broker {
+	b := newBroker(newSite(), ac, nil, ServerConf{})
+	go b.run()
+	return b
+}
+
+func newTestClient(b *Broker, username string) *Client {
+	c := newClient("test", username, username, "", b, nil)
+	b.join <- c
+	return c
+}
+
+// sync returns once the broker has handled all messages sent to it before.
+func (b *Broker) sync() {
+	b.join <- newClient("sync", "", "", "", b, nil)
+}
+
+func recv(t *testing.T, c *Client) map[string]interface{} {
+	t.Helper()
+	select {
+	case data := <-c.data:
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("bad message %s: %v", data, err)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+func mustPatch(t *testing.T, b *Broker, route, data string) {
+	t.Helper()
+	if _, err := b.patch("", "", route, []byte(data), false); err != nil {
+		t.Fatalf("patch %s: %v", route, err)
+	}
+}
+
+func TestBrokerPatternMatchesLaterPages(t *testing.T) {
+	b := newTestBroker(nil)
+	c := newTestClient(b, "alice")
+	c.subscribe("/dash/*")
+	c.subscribe("/sentinel")
+
+	mustPatch(t, b, "/other", `{"d":[{"k":"x","d":{"v":1}}]}`)
+	mustPatch(t, b, "/dash/a", `{"d":[{"k":"x","d":{"v":1}}]}`)
+	if m := recv(t, c); m["u"] != "/dash/a" {
+		t.Fatalf("want change to /dash/a, got %v", m)
+	}
+
+	c.unwatch("/dash/*")
+	mustPatch(t, b, "/dash/b", `{"d":[{"k":"x","d":{"v":2}}]}`)
+	mustPatch(t, b, "/sentinel", `{"d":[{"k":"x","d":{"v":3}}]}`)
+	if m := recv(t, c); m["u"] != nil {
+		t.Fatalf("want change to /sentinel after unwatching, got %v", m)
+	}
+}
+
+func TestBrokerPatternSendsExistingPages(t *testing.T) {
+	b := newTestBroker(nil)
+	mustPatch(t, b, "/dash/a", `{"d":[{"k":"x","d":{"v":1}}]}`)
+	c := newTestClient(b, "alice")
+	c.subscribe("/dash/*")
+	if m := recv(t, c); m["u"] != "/dash/a" || m["p"] == nil {
+		t.Fatalf("want page /dash/a, got %v", m)
+	}
+}
+
+func TestBrokerMatchable(t *testing.T) {
+	ac := &AccessControl{map[string]AccessPolicy{
+		"/team/*":   {Read: []string{"alice"}},
+		"/public/*": {Read: []string{anyPrincipal}},
+	}}
+	clientRoute := "/" + newClient("", "", "", "", &Broker{}, nil).id
+	for _, tc := range []struct {
+		name    string
+		ac      *AccessControl
+		route   string
+		user    string
+		private bool
+		want    bool
+	}{
+		{"no access control", nil, "/dash/a", "alice", false, true},
+		{"no access control, private", nil, "/alice", "alice", true, false},
+		{"no access control, client route", nil, clientRoute, "alice", false, false},
+		{"allowed by policy", ac, "/team/a", "alice", false, true},
+		{"denied by policy", ac, "/team/a", "bob", false, false},
+		{"allowed by wildcard", ac, "/public/a", "bob", false, true},
+		{"no policy", ac, "/dash/a", "alice", false, false},
+	} {
+		b := &Broker{access: tc.ac, private: map[string]bool{}}
+		if tc.private {
+			b.private[tc.route] = true
+		}
+		c := &Client{username: tc.user}
+		if got := b.matchable(tc.route, c); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestBrokerForgetsPrivateRoutes(t *testing.T) {
+	b := newTestBroker(nil)
+	c1 := newTestClient(b, "alice")
+	c2 := newTestClient(b, "alice")
+	c1.subscribeApp("/alice")
+	c2.subscribeApp("/alice")
+	b.sync()
+	if !b.private["/alice"] {
+		t.Fatal("want /alice private while subscribed")
+	}
+
+	b.unsubscribe <- c1
+	b.sync()
+	if !b.private["/alice"] {
+		t.Fatal("want /alice private while any client is subscribed")
+	}
+
+	b.unsubscribe <- c2
+	b.sync()
+	if b.private["/alice"] {
+		t.Fatal("want /alice forgotten once its last subscriber left")
+	}
+}
+
+func TestBrokerSendBackpressure(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		stalled time.Duration // how long ago the queue filled up; 0 if not full
+		drain   bool          // drain queue before sending?
+		ok      bool          // want client kept?
+		msgs    []string      // want queued, once sent
+	}{
+		{"room", time.Hour, 0, true, true, []string{`{"m":1}`}},
+		{"full, no timeout", 0, 0, false, false, []string{`{"q":1}`, `{"q":2}`}},
+		{"full, within timeout", time.Hour, 0, false, true, []string{`{"q":1}`, `{"q":2}`}},
+		{"stalled, within timeout", time.Hour, time.Minute, false, true, []string{`{"q":1}`, `{"q":2}`}},
+		{"stalled past timeout", time.Minute, time.Hour, false, false, []string{`{"q":1}`, `{"q":2}`}},
+		{"recovered", time.Minute, time.Hour, true, true, []string{string(resetMsg), `{"m":1}`}},
+	} {
+		b := &Broker{queueSize: 2, sendTimeout: tc.timeout}
+		c := newClient("test", "", "", "", b, nil)
+		c.data <- []byte(`{"q":1}`)
+		c.data <- []byte(`{"q":2}`)
+		if tc.stalled > 0 {
+			c.stalled = time.Now().Add(-tc.stalled)
+		}
+		if tc.drain {
+			<-c.data
+			<-c.data
+		}
+		if ok := b.send(c, []byte(`{"m":1}`)); ok != tc.ok {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, ok)
+		}
+		var msgs []string
+		for len(c.data) > 0 {
+			msgs = append(msgs, string(<-c.data))
+		}
+		if toJSON(t, msgs) != toJSON(t, tc.msgs) {
+			t.Errorf("%s: want queued %v, got %v", tc.name, tc.msgs, msgs)
+		}
+		if tc.ok && tc.drain && !c.stalled.IsZero() {
+			t.Errorf("%s: want client no longer stalled", tc.name)
+		}
+	}
+}
+
+func TestBrokerDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		hang    bool // a client never disconnects?
+		timeout time.Duration
+	}{
+		{"all disconnect", false, time.Minute},
+		{"client hangs", true, 50 * time.Millisecond},
+	} {
+		b := newTestBroker(nil)
+		clients := []*Client{newTestClient(b, "alice"), newTestClient(b, "bob"), newTestClient(b, "carol")}
+		clients[0].subscribe("/a")
+		clients[1].subscribe("/dash/*")
+		for i, c := range clients {
+			b.conns.Add(1)
+			go func(c *Client, hang bool) {
+				for range c.data { // until dropped
+				}
+				if !hang {
+					b.conns.Done()
+				}
+			}(c, tc.hang && i == 0)
+		}
+		b.sync()
+
+		ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+		start := time.Now()
+		b.drain(ctx)
+		cancel()
+		if elapsed := time.Since(start); tc.hang != (elapsed >= tc.timeout) {
+			t.Errorf("%s: want drain to time out=%v, took %v", tc.name, tc.hang, elapsed)
+		}
+		b.sync()
+		for _, c := range clients {
+			if !c.dropped || c.closeCode != websocket.CloseServiceRestart {
+				t.Errorf("%s: want client dropped with code %d, got dropped=%v, code %d", tc.name, websocket.CloseServiceRestart, c.dropped, c.closeCode)
+			}
+		}
+	}
+}
+
+func TestBrokerReplay(t *testing.T) {
+	b := newBroker(newSite(), nil, nil, ServerConf{ReplaySize: 2})
+	go b.run()
+	watcher := newTestClient(b, "alice")
+	watcher.subscribe("/p")
+	b.sync()
+	var seqs []int64
+	for _, v := range []string{"1", "2", "3"} {
+		mustPatch(t, b, "/p", `{"d":[{"k":"x","d":{"v":`+v+`}}]}`)
+		seqs = append(seqs, int64(recv(t, watcher)["q"].(float64)))
+	}
+	for _, tc := range []struct {
+		name string
+		seq  int64
+		want []string // "q" of messages replayed, or "page"
+	}{
+		{"missed one", seqs[1], []string{"3"}},
+		{"missed all held", seqs[0], []string{"2", "3"}},
+		{"missed too many", seqs[0] - 1, []string{"page"}},
+	} {
+		c := newTestClient(b, "bob")
+		c.resume("/p", tc.seq)
+		for _, w := range tc.want {
+			m := recv(t, c)
+			if w == "page" {
+				if m["p"] == nil || int64(m["q"].(float64)) != seqs[2] {
+					t.Errorf("%s: want page at latest sequence number, got %v", tc.name, m)
+				}
+				continue
+			}
+			i, _ := strconv.Atoi(w)
+			if int64(m["q"].(float64)) != seqs[i-1] {
+				t.Errorf("%s: want message %d, got %v", tc.name, i, m)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package wave
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -15,11 +16,18 @@ type Buf interface {
 	set(k string, v interface{})
 	// dump contents
 	dump() BufD
+	// approximate memory used, in bytes
+	size() int64
 }
 
 func loadBuf(ns *Namespace, b BufD) Buf {
 	if b.C != nil {
-		return loadCycBuf(ns, b.C)
+		buf, err := loadCycBuf(ns, b.C)
+		if err != nil {
+			echo(Log{"t": "load_buf", "error": err.Error()})
+			return nil
+		}
+		return buf
 	}
 	if b.F != nil {
 		return loadFixBuf(ns, b.F)
@@ -27,9 +35,102 @@ func loadBuf(ns *Namespace, b BufD) Buf {
 	if b.M != nil {
 		return loadMapBuf(ns, b.M)
 	}
+	if b.X != nil {
+		buf, err := loadDataBuf(ns, b.X)
+		if err != nil {
+			echo(Log{"t": "load_buf", "error": err.Error()})
+			return nil
+		}
+		return buf
+	}
 	return nil
 }
 
+// loadDataBuf creates a buffer of the declared kind, holding the initial records, if any.
+// Cyclic buffers retain the most recent records that fit; fixed buffers, the first.
+func loadDataBuf(ns *Namespace, b *DataD) (Buf, error) {
+	if b.B == "m" {
+		tups := make(map[string][]interface{})
+		if b.D != nil {
+			xs, ok := b.D.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("want records as object for map buffer, got %T", b.D)
+			}
+			for k, x := range xs {
+				tup, ok := x.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("want tuple for record %q, got %T", k, x)
+				}
+				tups[k] = tup
+			}
+		}
+		return loadMapBuf(ns, &MapBufD{F: b.F, D: tups, S: b.S}), nil
+	}
+
+	var rows [][]interface{}
+	if b.D != nil {
+		xs, ok := b.D.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("want records as list for buffer, got %T", b.D)
+		}
+		rows = make([][]interface{}, len(xs))
+		for i, x := range xs {
+			if x == nil {
+				continue
+			}
+			tup, ok := x.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("want tuple for record %d, got %T", i, x)
+			}
+			rows[i] = tup
+		}
+	}
+	n := b.N
+	if n <= 0 {
+		n = len(rows)
+	}
+	if n <= 0 {
+		n = 10
+	}
+	tups := make([][]interface{}, n)
+
+	switch b.B {
+	case "c":
+		var xs [][]interface{} // in order, without empty records, so that writes resume past the newest record
+		for _, row := range rows {
+			if row != nil {
+				xs = append(xs, row)
+			}
+		}
+		if len(xs) > n {
+			xs = xs[len(xs)-n:]
+		}
+		copy(tups, xs)
+		buf, err := loadCycBuf(ns, &CycBufD{F: b.F, D: tups, N: n, I: len(xs) % n, L: len(xs), S: b.S})
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	case "f":
+		copy(tups, rows)
+		return loadFixBuf(ns, &FixBufD{F: b.F, D: tups, N: n, S: b.S}), nil
+	}
+	return nil, fmt.Errorf("unknown buffer kind: %q", b.B)
+}
+
+// typeOf returns the buffer's data type.
+func typeOf(b Buf) Typ {
+	switch x := b.(type) {
+	case *FixBuf:
+		return x.t
+	case *CycBuf:
+		return x.b.t
+	case *MapBuf:
+		return x.t
+	}
+	return Typ{}
+}
+
 // Card represents an item on a Page, and holds attributes and data for rendering views.
 type Card struct {
 	data map[string]interface{}
@@ -55,6 +156,35 @@ func loadCard(ns *Namespace, c CardD) *Card {
 	return card
 }
 
+// types returns the types of the buffers held by a card, keyed by type key.
+func (c *Card) types() map[string]Typ {
+	var ts map[string]Typ
+	var mark func(interface{})
+	mark = func(ix interface{}) {
+		switch x := ix.(type) {
+		case Buf:
+			t := typeOf(x)
+			if len(t.f) == 0 {
+				return
+			}
+			if ts == nil {
+				ts = make(map[string]Typ)
+			}
+			ts[t.key()] = t
+		case map[string]interface{}:
+			for _, v := range x {
+				mark(v)
+			}
+		case []interface{}:
+			for _, v := range x {
+				mark(v)
+			}
+		}
+	}
+	mark(c.data)
+	return ts
+}
+
 func (c *Card) set(ks []string, v interface{}) {
 	switch len(ks) {
 	case 0: // should not get here; outer interpreter loop will clobber this card.
@@ -62,9 +192,11 @@ func (c *Card) set(ks []string, v interface{}) {
 	case 1: // .foo = bar
 		p := ks[0]
 		if ib, ok := c.data[p]; ok { // TODO can optimize by duplicating all bufs in a card.bufs map
-			if b, ok := ib.(Buf); ok { // avoid clobbering buffers; overwrite instead.
-				b.put(v)
-				return
+			if b, ok := ib.(Buf); ok { // avoid clobbering buffers; overwrite instead, unless replacing with a buffer.
+				if _, ok := v.(Buf); !ok {
+					b.put(v)
+					return
+				}
 			}
 		}
 		if v == nil {
@@ -0,0 +1,70 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestLoadDataBuf(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want string // dump, or error
+	}{
+		{"map", `{"b":"m","f":["a"],"d":{"x":[1]}}`, `{"m":{"f":["a"],"d":{"x":[1]},"k":["x"]}}`},
+		{"map, empty", `{"b":"m","f":["a"]}`, `{"m":{"f":["a"],"d":{}}}`},
+		{"fixed", `{"b":"f","f":["a"],"n":3,"d":[[1],null]}`, `{"f":{"f":["a"],"d":[[1],null,null],"n":3}}`},
+		{"fixed, sized by records", `{"b":"f","f":["a"],"d":[[1],[2]]}`, `{"f":{"f":["a"],"d":[[1],[2]],"n":2}}`},
+		{"fixed, first records kept", `{"b":"f","f":["a"],"n":1,"d":[[1],[2]]}`, `{"f":{"f":["a"],"d":[[1]],"n":1}}`},
+		{"fixed, default size", `{"b":"f","f":["a"]}`, `{"f":{"f":["a"],"d":[null,null,null,null,null,null,null,null,null,null],"n":10}}`},
+		{"cyclic", `{"b":"c","f":["a"],"n":3,"d":[[1],[2]]}`, `{"c":{"f":["a"],"d":[[1],[2],null],"n":3,"i":2,"l":2}}`},
+		{"cyclic, latest records kept", `{"b":"c","f":["a"],"n":2,"d":[[1],null,[2],[3]]}`, `{"c":{"f":["a"],"d":[[2],[3]],"n":2,"i":0,"l":2}}`},
+		{"typed", `{"b":"f","f":["a"],"s":["a:int"],"n":1}`, `{"f":{"f":["a"],"d":[null],"n":1,"s":["a:int"]}}`},
+		{"unknown kind", `{"b":"x","f":["a"]}`, `unknown buffer kind: "x"`},
+		{"map, records as list", `{"b":"m","f":["a"],"d":[[1]]}`, `want records as object for map buffer, got []interface {}`},
+		{"map, bad record", `{"b":"m","f":["a"],"d":{"x":1}}`, `want tuple for record "x", got float64`},
+		{"fixed, records as object", `{"b":"f","f":["a"],"d":{"x":[1]}}`, `want records as list for buffer, got map[string]interface {}`},
+		{"fixed, bad record", `{"b":"f","f":["a"],"d":[1]}`, `want tuple for record 0, got float64`},
+	} {
+		var d DataD
+		if err := json.Unmarshal([]byte(tc.data), &d); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if b, err := loadDataBuf(newNamespace(), &d); err != nil {
+			got = err.Error()
+		} else {
+			got = toJSON(t, b.dump())
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestExecDataBuf(t *testing.T) {
+	site := newSite()
+	applied := mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~a":0,"~b":1,"~c":2},"b":[
+		{"x":{"b":"c","f":["v"],"n":2}},
+		{"x":{"b":"f","f":["v"],"n":2}},
+		{"x":{"b":"m","f":["v"]}}
+	]}]}`)
+	if len(applied.errors) != 0 {
+		t.Fatalf("want no errors, got %v", applied.errors)
+	}
+	p := site.at("/p")
+	for _, tc := range []struct {
+		k    string
+		kind string
+	}{
+		{"c a", "*wave.CycBuf"},
+		{"c b", "*wave.FixBuf"},
+		{"c c", "*wave.MapBuf"},
+	} {
+		if got := fmt.Sprintf("%T", p.at(tc.k)); got != tc.kind {
+			t.Errorf("%s: want %s, got %s", tc.k, tc.kind, got)
+		}
+	}
+	checkSize(t, site, "/p")
+}
@@ -0,0 +1,111 @@
+package wave
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Interval between checks for changes to certificate files.
+const certPollInterval = 10 * time.Second
+
+// CertReloader serves a TLS certificate, reloading it when its files change or on SIGHUP,
+// so that certificates can be rotated without dropping connections.
+// If the new certificate cannot be loaded, the previous one stays in use.
+type CertReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time // latest modification time of the files the certificate was loaded from
+}
+
+func newCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the latest modification time of the certificate and key files.
+func (r *CertReloader) modified() (time.Time, error) {
+	var t time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// reload loads the certificate from its files.
+func (r *CertReloader) reload() error {
+	t, err := r.modified()
+	if err != nil {
+		return fmt.Errorf("failed reading certificate files: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed loading certificate: %v", err)
+	}
+	r.Lock()
+	r.cert, r.modTime = &cert, t
+	r.Unlock()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate when its files change, or when the process receives SIGHUP.
+func (r *CertReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			t, err := r.modified()
+			if err != nil {
+				continue // files being replaced; try again later.
+			}
+			r.RLock()
+			changed := !t.Equal(r.modTime)
+			r.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+		if err := r.reload(); err != nil {
+			echo(Log{"t": "cert_reload", "cert": r.certFile, "error": err.Error()})
+			r.skip()
+			continue
+		}
+		echo(Log{"t": "cert_reload", "cert": r.certFile})
+	}
+}
+
+// skip marks the current versions of the certificate files as seen, so that a bad certificate
+// is not reloaded again until the files change.
+func (r *CertReloader) skip() {
+	if t, err := r.modified(); err == nil {
+		r.Lock()
+		r.modTime = t
+		r.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package wave
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with the given serial number, and its key, to files.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+}
+
+func writeTestFile(t *testing.T, filename, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedSerial returns the serial number of the certificate served.
+func servedSerial(t *testing.T, r *CertReloader) int64 {
+	t.Helper()
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		change func()
+		ok     bool
+		serial int64 // served once reloaded
+	}{
+		{"unchanged", func() {}, true, 1},
+		{"rotated", func() { writeTestCert(t, certFile, keyFile, 2) }, true, 2},
+		{"malformed", func() { writeTestFile(t, certFile, "not a certificate") }, false, 2},
+		{"mismatched key", func() { writeTestCert(t, certFile, filepath.Join(dir, "other.pem"), 3) }, false, 2},
+		{"missing", func() { os.Remove(keyFile) }, false, 2},
+		{"rotated again", func() { writeTestCert(t, certFile, keyFile, 4) }, true, 4},
+	} {
+		tc.change()
+		if err := r.reload(); tc.ok != (err == nil) {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, err)
+		}
+		if serial := servedSerial(t, r); serial != tc.serial {
+			t.Errorf("%s: want certificate %d served, got %d", tc.name, tc.serial, serial)
+		}
+	}
+}
+
+func TestCertReloaderSkip(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	writeTestFile(t, certFile, "not a certificate")
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("want malformed certificate rejected")
+	}
+	r.skip()
+	if t2, _ := r.modified(); !r.modTime.Equal(t2) {
+		t.Errorf("want bad files marked as seen, got %v, want %v", r.modTime, t2)
+	}
+	if serial := servedSerial(t, r); serial != 1 {
+		t.Errorf("want previous certificate kept, got %d", serial)
+	}
+}
+
+func TestNewCertReloaderRejectsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("missing: want error")
+	}
+	writeTestFile(t, certFile, "x")
+	writeTestFile(t, keyFile, "x")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("malformed: want error")
+	}
+}
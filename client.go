@@ -3,6 +3,9 @@ package wave
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,110 +15,333 @@ import (
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 1 * 1024 * 1024 // bytes
+	// Max number of ops that can be queued in a transaction.
+	maxTxOps = 10000
+	// Max number of transactions a client can hold open at a time.
+	maxTxs = 16
 )
 
 var (
-	newline  = []byte{'\n'}
-	notFound = []byte(`{"e":"not_found"}`)
-	upgrader = websocket.Upgrader{
+	newline   = []byte{'\n'}
+	notFound  = []byte(`{"e":"not_found"}`)
+	forbidden = []byte(`{"e":"forbidden"}`)
+	upgrader  = websocket.Upgrader{
 		ReadBufferSize:  1024, // TODO review
 		WriteBufferSize: 1024, // TODO review
+		Subprotocols:    []string{msgpackSubprotocol},
 	}
+	errTxPage     = errors.New("transaction aborted: pages cannot be replaced in a transaction")
+	errTxTooLarge = errors.New("transaction aborted: too many changes")
+	errTxTooMany  = errors.New("too many open transactions")
 )
 
 // Client represent a websocket (UI) client.
 type Client struct {
-	id       string          // unique id
-	addr     string          // remote address
-	username string          // username, or "default-user"
-	subject  string          // oidc subject identifier
-	broker   *Broker         // broker
-	conn     *websocket.Conn // connection
-	routes   []string        // watched routes
-	data     chan []byte     // send data
+	id        string               // unique id
+	addr      string               // remote address
+	username  string               // username, or "default-user"
+	subject   string               // oidc subject identifier
+	session   string               // oidc session id, if any
+	broker    *Broker              // broker
+	conn      *websocket.Conn      // connection; nil if using server-sent events
+	routes    []string             // watched routes
+	data      chan []byte          // send data
+	txs       map[string]*Tx       // route => open transaction
+	stalled   time.Time            // when the send queue became full; owned by broker
+	dropped   bool                 // dropped by broker?; owned by broker
+	closeCode int                  // websocket close code to send when dropped, if any; owned by broker
+	missed    int32                // consecutive pings not responded to; atomic
+	active    int64                // when a message was last sent or received, in unix nanoseconds; atomic
+	msgpack   bool                 // exchange MessagePack instead of JSON?
+	filters   map[string]KeyFilter // route => records of interest in map buffers, if filtered; owned by broker
+	strict    bool                 // validate changes in their entirety before applying any?
+	token     string               // token supplied by the client, stable across reconnects, if any
 }
 
-func newClient(addr, username, subject string, broker *Broker, conn *websocket.Conn) *Client {
-	return &Client{uuid.New().String(), addr, username, subject, broker, conn, nil, make(chan []byte, 256)}
+func newClient(addr, username, subject, session string, broker *Broker, conn *websocket.Conn) *Client {
+	return &Client{uuid.New().String(), addr, username, subject, session, broker, conn, nil, make(chan []byte, broker.queueSize), make(map[string]*Tx), time.Time{}, false, 0, 0, time.Now().UnixNano(), false, nil, false, ""}
 }
 
 func (c *Client) listen() {
+	atomic.AddInt64(&metrics.clients, 1)
 	defer func() {
+		atomic.AddInt64(&metrics.clients, -1)
+		c.broker.conns.Done()
 		c.broker.unsubscribe <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(c.broker.maxMsgSize) // larger messages close the connection
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		atomic.StoreInt32(&c.missed, 0)
 		return nil
 	})
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		t, msg, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if err == websocket.ErrReadLimit {
+				echo(Log{"t": "socket_read", "client": c.addr, "error": "message too large", "limit": strconv.FormatInt(c.broker.maxMsgSize, 10)})
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				echo(Log{"t": "socket_read", "client": c.addr, "err": err.Error()})
 			}
 			break
 		}
-
-		m := parseMsg(msg)
-		switch m.t {
-		case patchMsgT:
-			c.broker.patch(m.addr, m.data)
-		case queryMsgT:
-			app := c.broker.getApp(m.addr)
-			if app == nil {
-				echo(Log{"t": "query", "client": c.addr, "route": m.addr, "error": "service unavailable"})
+		if c.msgpack && t == websocket.BinaryMessage {
+			if msg, err = fromMsgpackMsg(msg); err != nil {
+				echo(Log{"t": "socket_read", "client": c.addr, "error": err.Error()})
+				c.reject(err)
 				continue
 			}
-			app.forward(c.format(m.data))
-		case watchMsgT:
-			c.subscribe(m.addr) // subscribe even if page is currently NA
-
-			if app := c.broker.getApp(m.addr); app != nil { // do we have an app handling this route?
-				switch app.mode {
-				case unicastMode:
-					c.subscribe("/" + c.id) // client-level
-				case multicastMode:
-					c.subscribe("/" + c.username) // user-level
-				}
+		}
+		c.handle(msg)
+	}
+}
 
-				boot := emptyJSON
-				if len(m.data) > 0 { // location hash
-					if j, err := json.Marshal(Boot{Hash: string(m.data)}); err == nil {
-						boot = j
-					}
-				}
-				// echo(Log{"t": "boot", "client": c.addr, "route": m.addr, "addr": app.addr, "location": string(boot)})
-				app.forward(c.format(boot))
-				continue
+// handle processes a message received from the client, regardless of transport.
+func (c *Client) handle(msg []byte) {
+	atomic.AddInt64(&metrics.bytesIn, int64(len(msg)))
+
+	m := parseMsg(msg)
+	if m.t != noopMsgT {
+		c.touch()
+	}
+	switch m.t {
+	case patchMsgT:
+		if !c.authorize(m.addr) {
+			return
+		}
+		if _, ok := c.txs[m.addr]; ok { // transaction open?
+			c.queue(m.addr, m.data)
+			return
+		}
+		c.patch(m.addr, m.data)
+	case beginMsgT:
+		if _, ok := c.txs[m.addr]; !ok {
+			if len(c.txs) >= maxTxs {
+				c.reject(errTxTooMany)
+				return
 			}
+			c.txs[m.addr] = &Tx{}
+		}
+	case commitMsgT:
+		c.commit(m.addr)
+	case queryMsgT:
+		app := c.broker.getApp(m.addr)
+		if app == nil {
+			echo(Log{"t": "query", "client": c.addr, "route": m.addr, "error": "service unavailable"})
+			return
+		}
+		app.forward(c.format(m.data))
+	case resumeMsgT:
+		seq, err := strconv.ParseInt(string(m.data), 10, 64)
+		if err != nil {
+			seq = 0
+		}
+		c.resume(m.addr, seq)
+	case watchMsgT:
+		c.watch(m.addr, m.data)
+	case unwatchMsgT:
+		c.unwatch(m.addr)
+	case filterMsgT:
+		c.filter(m.addr, m.data)
+	}
+}
 
-			if page := c.broker.site.at(m.addr); page != nil { // is page?
-				if data := page.marshal(); data != nil {
-					c.send(data)
-					continue
-				}
+// unwatch unsubscribes from a route or pattern.
+func (c *Client) unwatch(route string) {
+	for i, r := range c.routes {
+		if r == route {
+			c.routes = append(c.routes[:i], c.routes[i+1:]...)
+			c.broker.unwatch <- Sub{route, c, 0, false}
+			return
+		}
+	}
+}
+
+// filter limits the changes to a map buffer on a route that are sent to the client to those affecting
+// the records of interest; the page itself, when watched, is sent in full.
+func (c *Client) filter(route string, data []byte) {
+	var f FilterD
+	if err := json.Unmarshal(data, &f); err != nil {
+		echo(Log{"t": "filter", "client": c.addr, "route": route, "error": err.Error()})
+		return
+	}
+	c.broker.filter <- Filter{route, c, f.K, f.S}
+}
+
+// resume subscribes to a route, and sends the client the messages published to the route after seq.
+// If those messages cannot be replayed, the client is sent the page at the route instead.
+func (c *Client) resume(route string, seq int64) {
+	if !c.broker.access.canRead(route, c.username, c.subject) {
+		c.send(forbidden)
+		return
+	}
+	if seq <= 0 || c.broker.getApp(route) != nil {
+		// can't resume; re-watch.
+		c.watch(route, nil)
+		return
+	}
+	c.routes = append(c.routes, route)
+	c.broker.subscribe <- Sub{route, c, seq, false}
+}
+
+// watch subscribes to a route, and sends the client the page at the route, or boots the app handling the route.
+// If the route is a pattern, the client is sent all pages matching the pattern, and changes to those pages,
+// including pages created later; each message is annotated with the url of the page it pertains to.
+// If access control is configured, patterns only match pages covered by a read policy allowing the client.
+// Patterns never match the private pages apps write for individual clients and users.
+func (c *Client) watch(route string, hash []byte) {
+	if isPattern(route) { // access is checked per page, by the broker; see Broker.matchable.
+		c.subscribe(route)
+		return
+	}
+	if !c.broker.access.canRead(route, c.username, c.subject) {
+		echo(Log{"t": "watch", "client": c.addr, "route": route, "error": errForbidden(c.username, "read", route).Error()})
+		c.send(forbidden)
+		return
+	}
+	c.subscribe(route) // subscribe even if page is currently NA
+
+	if app := c.broker.getApp(route); app != nil { // do we have an app handling this route?
+		switch app.mode {
+		case unicastMode:
+			c.subscribeApp("/" + c.id) // client-level
+		case multicastMode:
+			c.subscribeApp("/" + c.username) // user-level
+		}
+
+		boot := emptyJSON
+		if len(hash) > 0 { // location hash
+			if j, err := json.Marshal(Boot{Hash: string(hash)}); err == nil {
+				boot = j
 			}
+		}
+		// echo(Log{"t": "boot", "client": c.addr, "route": route, "addr": app.addr, "location": string(boot)})
+		app.forward(c.format(boot))
+		return
+	}
+
+	if page := c.broker.site.at(route); page != nil { // is page?
+		if data := page.marshal(); data != nil {
+			c.send(data)
+			return
+		}
+	}
+
+	c.send(notFound)
+}
+
+// authorize reports whether the client can write to a route, else replies with an error.
+func (c *Client) authorize(route string) bool {
+	if c.broker.access.canWrite(route, c.username, c.subject) {
+		return true
+	}
+	err := errForbidden(c.username, "write", route)
+	echo(Log{"t": "patch", "client": c.addr, "route": route, "error": err.Error()})
+	c.reject(err)
+	return false
+}
+
+// Tx represents an open transaction: the ops queued on a route, to be applied together when committed.
+type Tx struct {
+	ops     []OpD
+	size    int64 // bytes of patches queued
+	aborted bool  // if aborted, patches are discarded until committed
+}
+
+// queue holds a patch back until the open transaction on the route is committed.
+// The transaction is aborted, replying with an error, if the patch replaces the page, or if the transaction
+// would exceed the max number of ops, or the max message size; subsequent patches are discarded until committed,
+// so that none of the transaction's changes are applied.
+func (c *Client) queue(route string, data []byte) {
+	tx := c.txs[route]
+	if tx.aborted {
+		return
+	}
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil {
+		echo(Log{"t": "tx_patch", "client": c.addr, "route": route, "error": err.Error()})
+		return
+	}
+	var err error
+	if ops.P != nil {
+		err = errTxPage
+	} else if len(tx.ops)+len(ops.D) > maxTxOps || tx.size+int64(len(data)) > c.broker.maxMsgSize {
+		err = errTxTooLarge
+	}
+	if err != nil {
+		echo(Log{"t": "tx_patch", "client": c.addr, "route": route, "error": err.Error()})
+		tx.ops, tx.aborted = nil, true
+		c.reject(err)
+		return
+	}
+	tx.ops = append(tx.ops, ops.D...)
+	tx.size += int64(len(data))
+}
+
+// commit applies and broadcasts all patches queued in the open transaction on the route as a single patch.
+// Transactions that are not committed (e.g. if the client disconnects), or aborted, are discarded.
+func (c *Client) commit(route string) {
+	tx, ok := c.txs[route]
+	if !ok {
+		return
+	}
+	delete(c.txs, route)
+	if tx.aborted || len(tx.ops) == 0 {
+		return
+	}
+	data, err := json.Marshal(OpsD{D: tx.ops})
+	if err != nil {
+		echo(Log{"t": "tx_commit", "client": c.addr, "route": route, "error": err.Error()})
+		return
+	}
+	c.patch(route, data)
+}
 
-			c.send(notFound)
+// patch applies changes to a route, replying with an error if the changes were rejected, or with the
+// changes skipped, if any.
+func (c *Client) patch(route string, data []byte) {
+	principal, key := c.subject, c.subject
+	if principal == "" || principal == "no-subject" { // unauthenticated; limit per connection
+		principal, key = c.username, c.id
+	}
+	if !c.broker.limiter.allow(key, principal) {
+		echo(Log{"t": "rate_limit", "client": c.addr, "principal": principal, "route": route})
+		c.reject(errRateLimited)
+		return
+	}
+	errs, err := c.broker.patch(principal, dedupKey(principal, c.token, c.id), route, data, c.strict)
+	if err != nil {
+		c.reject(err)
+		return
+	}
+	if len(errs) > 0 { // partially applied
+		if data, err := json.Marshal(OpsD{X: errs}); err == nil {
+			c.send(data)
 		}
 	}
 }
 
+// reject replies to the client with an error.
+func (c *Client) reject(err error) {
+	var errs []OpErrorD
+	if ve, ok := err.(*ValidationError); ok {
+		errs = ve.errors
+	}
+	if data, err := json.Marshal(OpsD{E: err.Error(), X: errs}); err == nil {
+		c.send(data)
+	}
+}
+
 func (c *Client) subscribe(route string) {
 	c.routes = append(c.routes, route) // TODO review
-	c.broker.subscribe <- Sub{route, c}
+	c.broker.subscribe <- Sub{route, c, 0, false}
+}
+
+// subscribeApp subscribes to the client-level or user-level route an app writes the client's pages to.
+// Such routes are private, and are never matched by patterns.
+func (c *Client) subscribeApp(route string) {
+	c.routes = append(c.routes, route)
+	c.broker.subscribe <- Sub{route, c, 0, true}
 }
 
 func (c *Client) send(data []byte) bool {
@@ -127,8 +353,25 @@ func (c *Client) send(data []byte) bool {
 	}
 }
 
+func (c *Client) isStalled(timeout time.Duration) bool {
+	return !c.stalled.IsZero() && time.Since(c.stalled) > timeout
+}
+
+// touch marks the client as active.
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+// isIdle reports whether the client has neither sent nor been sent any messages for longer than the timeout.
+func (c *Client) isIdle(timeout time.Duration) bool {
+	return timeout > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&c.active))) > timeout
+}
+
+// flush writes queued messages to the connection, and pings the peer periodically.
+// The connection is closed if the peer misses too many pongs, or remains idle for too long;
+// this unblocks listen(), which then unsubscribes the client.
 func (c *Client) flush() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.broker.pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -139,35 +382,113 @@ func (c *Client) flush() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// broker closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				msg := []byte{}
+				if c.closeCode != 0 {
+					msg = websocket.FormatCloseMessage(c.closeCode, "")
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, msg)
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+			if c.msgpack {
+				if !c.flushMsgpack(data) {
+					return
+				}
+				continue
 			}
-			w.Write(data)
 
 			// push queued messages, if any
+			msgs := [][]byte{data}
+			sent := len(data)
 			n := len(c.data)
 			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.data)
+				data := <-c.data
+				msgs = append(msgs, data)
+				sent += len(newline) + len(data)
+			}
+
+			c.conn.EnableWriteCompression(c.broker.compression.compress(sent))
+			w, err := c.conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return
 			}
+			for i, data := range msgs {
+				if i > 0 {
+					w.Write(newline)
+				}
+				w.Write(data)
+			}
+			atomic.AddInt64(&metrics.bytesOut, int64(sent))
+			c.touch()
 
 			if err := w.Close(); err != nil {
 				return
 			}
 		case <-ticker.C:
+			if missed := atomic.LoadInt32(&c.missed); missed >= c.broker.maxMissed {
+				echo(Log{"t": "ui_timeout", "addr": c.addr, "missed_pongs": strconv.Itoa(int(missed))})
+				return
+			}
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if c.isIdle(c.broker.idleTimeout) {
+				echo(Log{"t": "ui_idle", "addr": c.addr, "timeout": c.broker.idleTimeout.String()})
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle"))
+				return
+			}
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+			atomic.AddInt32(&c.missed, 1)
 		}
 	}
 }
 
+// flushMsgpack writes data and any queued messages, converted to MessagePack, as a single binary message.
+// MessagePack values are self-delimiting, so messages are concatenated without separators.
+// Messages that cannot be converted are dropped; nothing is written if none can be.
+func (c *Client) flushMsgpack(data []byte) bool {
+	msgs, sent := c.toMsgpack(data)
+	if len(msgs) == 0 {
+		return true
+	}
+	c.conn.EnableWriteCompression(c.broker.compression.compress(sent))
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return false
+	}
+	for _, b := range msgs {
+		w.Write(b)
+	}
+	atomic.AddInt64(&metrics.bytesOut, int64(sent))
+	c.touch()
+	return w.Close() == nil
+}
+
+// toMsgpack converts data and any queued messages to MessagePack, and returns the converted messages and their
+// total size. Messages that cannot be converted are logged and dropped.
+func (c *Client) toMsgpack(data []byte) ([][]byte, int) {
+	var msgs [][]byte
+	sent, dropped := 0, 0
+	n := len(c.data)
+	for i := 0; i <= n; i++ {
+		if i > 0 {
+			data = <-c.data
+		}
+		b, err := jsonToMsgpack(data)
+		if err != nil {
+			echo(Log{"t": "socket_write", "client": c.addr, "error": err.Error(), "size": strconv.Itoa(len(data))})
+			dropped++
+			continue
+		}
+		msgs = append(msgs, b)
+		sent += len(b)
+	}
+	if dropped > 0 {
+		echo(Log{"t": "socket_write", "client": c.addr, "dropped": strconv.Itoa(dropped), "sent": strconv.Itoa(len(msgs))})
+	}
+	return msgs, sent
+}
+
 func (c *Client) quit() {
 	close(c.data)
 }
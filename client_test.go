@@ -0,0 +1,108 @@
+package wave
+
+import "testing"
+
+func TestClientToMsgpack(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		msgs   []string
+		sent   int
+		queued int
+	}{
+		{"all converted", []string{`{"a":1}`, `{"b":2}`}, 2, 0},
+		{"some dropped", []string{`{"a":1}`, `{bad`, `{"b":2}`}, 2, 0},
+		{"all dropped", []string{`{bad`, `]`}, 0, 0},
+	} {
+		b := &Broker{queueSize: 8}
+		c := newClient("test", "", "", "", b, nil)
+		for _, msg := range tc.msgs[1:] {
+			c.data <- []byte(msg)
+		}
+		msgs, size := c.toMsgpack([]byte(tc.msgs[0]))
+		if len(msgs) != tc.sent {
+			t.Errorf("%s: want %d messages, got %d", tc.name, tc.sent, len(msgs))
+		}
+		n := 0
+		for _, m := range msgs {
+			n += len(m)
+		}
+		if size != n {
+			t.Errorf("%s: want size %d, got %d", tc.name, n, size)
+		}
+		if len(c.data) != tc.queued {
+			t.Errorf("%s: want %d messages left queued, got %d", tc.name, tc.queued, len(c.data))
+		}
+	}
+}
+
+func TestClientFlushMsgpackSkipsEmpty(t *testing.T) {
+	b := &Broker{queueSize: 8}
+	c := newClient("test", "", "", "", b, nil) // no connection: writing would panic
+	c.data <- []byte(`{bad`)
+	if !c.flushMsgpack([]byte(`]`)) {
+		t.Error("want flush to succeed without writing")
+	}
+}
+
+func TestClientTransaction(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		msgs  []string
+		want  string // page dump once all messages are handled; empty if no changes
+		ops   int    // ops broadcast in a single message
+		error bool   // want writer rejected?
+	}{
+		{"committed", []string{
+			`[ /p `,
+			`* /p {"d":[{"k":"a","d":{"v":1}}]}`,
+			`* /p {"d":[{"k":"b","d":{"v":2}}]}`,
+			`] /p `,
+		}, `{"a":{"d":{"v":1}},"b":{"d":{"v":2}}}`, 2, false},
+		{"not committed", []string{
+			`[ /p `,
+			`* /p {"d":[{"k":"a","d":{"v":1}}]}`,
+		}, ``, 0, false},
+		{"other route", []string{
+			`[ /q `,
+			`* /p {"d":[{"k":"a","d":{"v":1}}]}`,
+		}, `{"a":{"d":{"v":1}}}`, 1, false},
+		{"page replaced", []string{
+			`[ /p `,
+			`* /p {"d":[{"k":"a","d":{"v":1}}]}`,
+			`* /p {"p":{"c":{}}}`,
+			`* /p {"d":[{"k":"b","d":{"v":2}}]}`,
+			`] /p `,
+		}, ``, 0, true},
+	} {
+		b := newTestBroker(nil)
+		watcher, writer := newTestClient(b, "alice"), newTestClient(b, "bob")
+		watcher.subscribe("/p")
+		b.sync()
+		for _, msg := range tc.msgs {
+			writer.handle([]byte(msg))
+		}
+		page := b.site.at("/p")
+		if tc.want == "" {
+			if page != nil {
+				t.Errorf("%s: want no changes, got %s", tc.name, toJSON(t, page.dump().C))
+			}
+		} else if page == nil {
+			t.Errorf("%s: want changes applied", tc.name)
+		} else if got := toJSON(t, page.dump().C); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+		if tc.ops > 0 {
+			if m := recv(t, watcher); len(m["d"].([]interface{})) != tc.ops {
+				t.Errorf("%s: want %d ops broadcast together, got %v", tc.name, tc.ops, m)
+			}
+		}
+		if tc.error {
+			if m := recv(t, writer); m["e"] == nil {
+				t.Errorf("%s: want error, got %v", tc.name, m)
+			}
+		}
+		if len(writer.data) != 0 {
+			t.Errorf("%s: want no more replies, got %d", tc.name, len(writer.data))
+		}
+	}
+}
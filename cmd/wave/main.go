@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/h2oai/wave"
 )
@@ -41,6 +43,34 @@ func main() {
 	flag.StringVar(&conf.OIDCProviderURL, "oidc-provider-url", "", "OIDC provider URL")
 	flag.StringVar(&conf.OIDCRedirectURL, "oidc-redirect-url", "", "OIDC redirect URL")
 	flag.StringVar(&conf.OIDCEndSessionURL, "oidc-end-session-url", "", "OIDC end session URL")
+	flag.StringVar(&conf.SnapshotFile, "snapshot-file", "", "restore site content from, and save snapshots to, this file")
+	flag.DurationVar(&conf.SnapshotInterval, "snapshot-interval", time.Minute, "interval between snapshots (if -snapshot-file is set)")
+	flag.IntVar(&conf.SendQueueSize, "send-queue-size", 256, "max messages queued for sending to each client")
+	flag.DurationVar(&conf.SendTimeout, "send-timeout", 10*time.Second, "drop clients whose send queue remains full for longer than this")
+	flag.DurationVar(&conf.ReadinessDelay, "readiness-delay", 5*time.Second, "on shutdown, time to keep serving while reporting not ready, so that load balancers stop routing to this server before it stops accepting connections")
+	flag.DurationVar(&conf.DrainTimeout, "drain-timeout", 10*time.Second, "on shutdown, max time to wait for in-flight requests to complete and clients to disconnect")
+	flag.IntVar(&conf.ReplaySize, "replay-size", 64, "max recent messages held per page for replaying to reconnecting clients (0 to disable)")
+	flag.StringVar(&conf.APIKeys, "api-keys", "", "comma-separated id:secret API keys, accepted as bearer tokens for writes (default $WAVE_API_KEYS)")
+	flag.StringVar(&conf.AccessFile, "access-file", "", "path to JSON file containing page access policies (all pages are accessible to anyone if not set)")
+	flag.Int64Var(&conf.MaxMessageSize, "max-message-size", 1024*1024, "max size of messages (websocket messages or HTTP request bodies) from clients, in bytes")
+	flag.DurationVar(&conf.PingInterval, "ping-interval", 30*time.Second, "interval between websocket pings sent to clients")
+	flag.IntVar(&conf.MaxMissedPongs, "max-missed-pongs", 2, "drop clients that fail to respond to this many consecutive pings")
+	flag.DurationVar(&conf.IdleTimeout, "idle-timeout", 0, "drop clients that have neither sent nor been sent any messages for longer than this (0 to disable)")
+	flag.Int64Var(&conf.MaxMemory, "max-memory", 0, "max approximate memory used by pages, in bytes; writes that would exceed this are rejected (0 for unlimited)")
+	flag.DurationVar(&conf.SweepInterval, "sweep-interval", 5*time.Minute, "interval between sweeps for buffer types not referenced by any card (0 to disable)")
+	flag.StringVar(&conf.AuditLog, "audit-log", "", "write a JSON lines audit log of changes to pages to this file, or to stdout if \"-\" (disabled if empty)")
+	flag.IntVar(&conf.AuditSample, "audit-sample", 1, "log only 1 in this many changes to each page in the audit log")
+	flag.DurationVar(&conf.UploadTimeout, "upload-timeout", time.Hour, "discard incomplete resumable uploads that have received no data for longer than this (0 to keep forever)")
+	flag.Float64Var(&conf.RateLimit, "rate-limit", 0, "max changes per second each client can make, on average; excess changes are rejected (0 for unlimited)")
+	flag.IntVar(&conf.RateBurst, "rate-burst", 10, "max changes each client can make in a burst, if rate-limited")
+	flag.StringVar(&conf.RateLimitExempt, "rate-limit-exempt", "", "comma-separated list of principals (usernames, OIDC subjects or API key IDs) not subject to rate limits")
+	flag.BoolVar(&conf.Compress, "compress", false, "compress messages sent to clients: per-message-deflate for websockets, gzip for server-sent events")
+	flag.IntVar(&conf.CompressLevel, "compress-level", 1, "compression level, from -2 (Huffman only) and 1 (fastest) to 9 (smallest)")
+	flag.IntVar(&conf.CompressMin, "compress-min", 1024, "min size of websocket messages to compress, in bytes")
+	flag.IntVar(&conf.DedupWindow, "dedup-window", 1000, "number of recent op ids remembered per client, to skip ops resent by clients (0 = disable)")
+	flag.IntVar(&conf.DedupClients, "dedup-clients", 10000, "max number of clients whose op ids are remembered; least recently active clients are forgotten first")
+	flag.BoolVar(&conf.Coerce, "coerce", false, "convert values sent for typed fields of buffers to the fields' kinds, where sensible, e.g. \"42\" to 42 for int fields; per field, use \"~kind\" in field specs")
+	flag.StringVar(&conf.MetricsPath, "metrics-path", "", "serve Prometheus metrics at this path, e.g. /metrics (disabled if empty)")
 
 	flag.Parse()
 
@@ -49,6 +79,10 @@ func main() {
 		return
 	}
 
+	if conf.APIKeys == "" {
+		conf.APIKeys = os.Getenv("WAVE_API_KEYS")
+	}
+
 	conf.WebDir, _ = filepath.Abs(conf.WebDir)
 	conf.DataDir, _ = filepath.Abs(conf.DataDir)
 
@@ -0,0 +1,59 @@
+package wave
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Compression represents the compression of messages sent to clients: per-message-deflate for websockets,
+// if negotiated during the handshake, and gzip for server-sent events, if accepted by the client.
+type Compression struct {
+	enabled bool
+	level   int // flate compression level
+	min     int // min size of websocket messages to compress, in bytes; smaller messages are sent as-is
+}
+
+func newCompression(enabled bool, level, min int) Compression {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = flate.BestSpeed
+	}
+	return Compression{enabled, level, min}
+}
+
+// compress reports whether a websocket message of size n bytes is worth compressing.
+func (c Compression) compress(n int) bool {
+	return c.enabled && n >= c.min
+}
+
+// gzip returns a gzip writer compressing the response, if enabled and accepted by the client, else nil.
+func (c Compression) gzip(w http.ResponseWriter, r *http.Request) *gzip.Writer {
+	if !c.enabled || !acceptsGzip(r) {
+		return nil
+	}
+	gz, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil
+	}
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	return gz
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		e = strings.TrimSpace(e)
+		if i := strings.IndexByte(e, ';'); i >= 0 {
+			if strings.TrimSpace(e[i+1:]) == "q=0" {
+				continue
+			}
+			e = strings.TrimSpace(e[:i])
+		}
+		if e == "gzip" {
+			return true
+		}
+	}
+	return false
+}
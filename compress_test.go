@@ -0,0 +1,157 @@
+package wave
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		c        Compression
+		level    int
+		n        int
+		compress bool
+	}{
+		{"disabled", newCompression(false, 5, 0), 5, 1000, false},
+		{"large", newCompression(true, 5, 100), 5, 100, true},
+		{"small", newCompression(true, 5, 100), 5, 99, false},
+		{"huffman only", newCompression(true, flate.HuffmanOnly, 0), flate.HuffmanOnly, 1, true},
+		{"bad level", newCompression(true, 10, 0), flate.BestSpeed, 1, true},
+		{"bad level, negative", newCompression(true, -3, 0), flate.BestSpeed, 1, true},
+	} {
+		if tc.c.level != tc.level {
+			t.Errorf("%s: want level %d, got %d", tc.name, tc.level, tc.c.level)
+		}
+		if got := tc.c.compress(tc.n); got != tc.compress {
+			t.Errorf("%s: want compress=%v for %d bytes, got %v", tc.name, tc.compress, tc.n, got)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8, br", true},
+		{" gzip ; q=1", true},
+		{"gzip;q=0", false},
+		{"br", false},
+		{"x-gzip", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tc.header)
+		if got := acceptsGzip(r); got != tc.want {
+			t.Errorf("%q: want %v, got %v", tc.header, tc.want, got)
+		}
+	}
+}
+
+func TestCompressionGzip(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		accept   string
+		encoding string
+	}{
+		{"accepted", true, "gzip", "gzip"},
+		{"not accepted", true, "br", ""},
+		{"disabled", false, "gzip", ""},
+	} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		gz := newCompression(tc.enabled, flate.BestSpeed, 0).gzip(w, r)
+		if (gz != nil) != (tc.encoding != "") || w.Header().Get("Content-Encoding") != tc.encoding {
+			t.Errorf("%s: want encoding %q, got %q", tc.name, tc.encoding, w.Header().Get("Content-Encoding"))
+			continue
+		}
+		if gz == nil {
+			continue
+		}
+		gz.Write([]byte("hello"))
+		gz.Close()
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadAll(zr); err != nil || string(data) != "hello" {
+			t.Errorf("%s: want hello, got %q, %v", tc.name, data, err)
+		}
+	}
+}
+
+func TestSocketCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		offered  bool
+		deflated bool
+	}{
+		{"negotiated", true, true, true},
+		{"not offered", true, false, false},
+		{"disabled", false, true, false},
+	} {
+		b := newBroker(newSite(), nil, nil, ServerConf{Compress: tc.enabled, CompressLevel: flate.BestSpeed})
+		go b.run()
+		big := strings.Repeat("x", 4096)
+		mustPatch(t, b, "/p", `{"d":[{"k":"x","d":{"v":"`+big+`"}}]}`)
+		server := httptest.NewServer(newSocketServer(b, newOIDCSessions(), false))
+		dialer := websocket.Dialer{EnableCompression: tc.offered}
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deflated := strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"); deflated != tc.deflated {
+			t.Errorf("%s: want deflate=%v, got %q", tc.name, tc.deflated, resp.Header.Get("Sec-Websocket-Extensions"))
+		}
+		// Messages arrive intact, compressed or not.
+		conn.WriteMessage(websocket.TextMessage, []byte("+ /p "))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || !strings.Contains(string(data), big) {
+			t.Errorf("%s: want page, got %d bytes, %v", tc.name, len(data), err)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestEventServerGzip(t *testing.T) {
+	b := newBroker(newSite(), nil, nil, ServerConf{Compress: true, CompressLevel: flate.BestSpeed})
+	go b.run()
+	server := httptest.NewServer(newEventServer(b, newOIDCSessions(), false, 1<<20))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip") // set explicitly, so that the transport does not decompress
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	timeout := time.AfterFunc(5*time.Second, func() { resp.Body.Close() })
+	defer timeout.Stop()
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("want gzip, got %q", ce)
+	}
+	zr, err := gzip.NewReader(resp.Body) // events are flushed, so the header arrives with the first event
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, _, id := readEvent(t, bufio.NewReader(zr)); event != "client" || id == "" {
+		t.Errorf("want client id, got %s %s", event, id)
+	}
+}
@@ -1,5 +1,7 @@
 package wave
 
+import "time"
+
 // ServerConf represents Server configuration options.
 type ServerConf struct {
 	Version           string
@@ -19,6 +21,62 @@ type ServerConf struct {
 	OIDCProviderURL   string
 	OIDCRedirectURL   string
 	OIDCEndSessionURL string
+	MetricsPath       string
+	SnapshotFile      string
+	SnapshotInterval  time.Duration
+	SendQueueSize     int
+	SendTimeout       time.Duration
+	DrainTimeout      time.Duration
+	ReadinessDelay    time.Duration
+	ReplaySize        int
+	APIKeys           string
+	AccessFile        string
+	MaxMessageSize    int64
+	PingInterval      time.Duration
+	MaxMissedPongs    int
+	IdleTimeout       time.Duration
+	MaxMemory         int64
+	SweepInterval     time.Duration
+	AuditLog          string
+	AuditSample       int
+	UploadTimeout     time.Duration
+	RateLimit         float64
+	RateBurst         int
+	RateLimitExempt   string
+	Namespace         *Namespace // buffer type namespace, if provided by an embedding program, e.g. to observe changes
+	Compress          bool
+	CompressLevel     int
+	CompressMin       int
+	DedupWindow       int
+	DedupClients      int
+	Coerce            bool
+}
+
+// Default max size of messages (websocket messages or HTTP request bodies) from clients.
+const defaultMaxMessageSize = 1 * 1024 * 1024 // bytes
+
+func (c *ServerConf) maxMessageSize() int64 {
+	if c.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+// Default interval between websocket pings.
+const defaultPingInterval = 30 * time.Second
+
+func (c *ServerConf) pingInterval() time.Duration {
+	if c.PingInterval <= 0 {
+		return defaultPingInterval
+	}
+	return c.PingInterval
+}
+
+func (c *ServerConf) maxMissedPongs() int32 {
+	if c.MaxMissedPongs <= 0 {
+		return 1
+	}
+	return int32(c.MaxMissedPongs)
 }
 
 func (c *ServerConf) oidcEnabled() bool {
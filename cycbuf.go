@@ -1,13 +1,19 @@
 package wave
 
+import (
+	"fmt"
+	"reflect"
+)
+
 // CycBuf represents a cyclic buffer.
 type CycBuf struct {
-	b *FixBuf
-	i int
+	b   *FixBuf
+	i   int
+	seq int64 // number of tuples ever appended
 }
 
 func newCycBuf(t Typ, n, i int) *CycBuf {
-	return &CycBuf{newFixBuf(t, n), i}
+	return &CycBuf{newFixBuf(t, n), i, 0}
 }
 
 func (b *CycBuf) put(ixs interface{}) {
@@ -20,29 +26,243 @@ func (b *CycBuf) put(ixs interface{}) {
 
 func (b *CycBuf) set(_ string, v interface{}) { // append-only; ignore key
 	fb := b.b
-	fb.seti(b.i, v)
+	if len(fb.tups) == 0 {
+		return
+	}
+	var tup []interface{}
+	if v != nil {
+		var ok bool
+		if tup, ok = fb.t.match(v); !ok { // skip, rather than leave a stale tuple at the cursor
+			return
+		}
+	}
+	fb.write(b.i, tup)
 	b.i++
+	b.seq++
 	if b.i >= len(fb.tups) {
 		b.i = 0
 	}
 }
 
+func (b *CycBuf) size() int64 {
+	return b.b.size()
+}
+
 func (b *CycBuf) get(_ string) (Cur, bool) { // no random access; ignore key
 	return b.b.geti(b.i)
 }
 
+// latest returns a cursor over the most recently appended tuple.
+func (b *CycBuf) latest() (Cur, bool) {
+	n := len(b.b.tups)
+	if n == 0 {
+		return Cur{}, false
+	}
+	return b.b.geti((b.i + n - 1) % n)
+}
+
+// chrono returns the buffered tuples in chronological order, oldest first.
+func (b *CycBuf) chrono() [][]interface{} {
+	tups := b.b.tups
+	xs := make([][]interface{}, 0, len(tups))
+	for _, tup := range tups[b.i:] {
+		if tup != nil {
+			xs = append(xs, tup)
+		}
+	}
+	for _, tup := range tups[:b.i] {
+		if tup != nil {
+			xs = append(xs, tup)
+		}
+	}
+	return xs
+}
+
+// aggregate computes summary statistics over the numeric values of field f.
+func (b *CycBuf) aggregate(f string) (AggD, error) {
+	i, ok := b.b.t.offset(f)
+	if !ok {
+		return AggD{}, fmt.Errorf("field not found: %s", f)
+	}
+	return aggregate(b.b.tups, i), nil
+}
+
+// resize changes the size of the buffer to n, retaining the most recent tuples.
+func (b *CycBuf) resize(n int) {
+	if n <= 0 || n == len(b.b.tups) {
+		return
+	}
+	xs := b.chrono()
+	if len(xs) > n { // shrinking; discard oldest
+		xs = xs[len(xs)-n:]
+	}
+	tups := make([][]interface{}, n)
+	copy(tups, xs)
+	b.b.tups, b.b.bytes = tups, tupsSize(tups)
+	b.i = len(xs) % n
+}
+
+// sample returns at most n tuples, in chronological order, chosen using the given method.
+func (b *CycBuf) sample(d SampleD) ([][]interface{}, error) {
+	t := b.b.t
+	x, y := -1, -1
+	if d.X != "" {
+		i, ok := t.offset(d.X)
+		if !ok {
+			return nil, fmt.Errorf("field not found: %s", d.X)
+		}
+		x = i
+	}
+	if d.Y != "" {
+		i, ok := t.offset(d.Y)
+		if !ok {
+			return nil, fmt.Errorf("field not found: %s", d.Y)
+		}
+		y = i
+	}
+	return downsample(b.chrono(), d.N, d.M, x, y)
+}
+
+// Max fraction of a cyclic buffer that can change for the change to be sent as a delta; else the buffer is sent in full.
+const maxCycBufDelta = 0.5
+
+// delta returns the tuples that must be appended to b, and the number of tuples evicted as a result, for b's contents
+// to match n's, or false if n is not a continuation of b (e.g. of a different type or size, or diverged too far).
+func (b *CycBuf) delta(n *CycBuf) (*AppendD, bool) {
+	if b.b.t.key() != n.b.t.key() || len(b.b.tups) != len(n.b.tups) {
+		return nil, false
+	}
+	size := len(b.b.tups)
+	xs, ys := b.chrono(), n.chrono()
+	if len(ys) == 0 {
+		return nil, false
+	}
+	for e := range xs { // ys = xs[e:] + appended
+		if len(xs)-e > len(ys) || !reflect.DeepEqual(xs[e], ys[0]) {
+			continue
+		}
+		appended := ys[len(xs)-e:]
+		evicted := len(xs) + len(appended) - size
+		if evicted < 0 {
+			evicted = 0
+		}
+		if e != evicted { // appending would not result in ys
+			continue
+		}
+		if float64(len(appended)) > maxCycBufDelta*float64(size) {
+			return nil, false
+		}
+		match := true
+		for i, x := range xs[e:] {
+			if !reflect.DeepEqual(x, ys[i]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return &AppendD{appended, evicted}, true
+		}
+	}
+	return nil, false
+}
+
+// dump marshals the buffer with its tuples in chronological order, oldest first, followed by empty slots, if any.
+// The result is an equivalent ring, with the write index pointing past the newest tuple,
+// so that it can still be loaded as-is.
 func (b *CycBuf) dump() BufD {
-	return BufD{C: &CycBufD{b.b.t.f, b.b.tups, len(b.b.tups), b.i}}
+	fb := b.b
+	xs := b.chrono()
+	n := len(fb.tups)
+	tups := make([][]interface{}, n)
+	copy(tups, xs)
+	i := 0
+	if n > 0 {
+		i = len(xs) % n
+	}
+	d := &CycBufD{F: fb.t.f, N: n, I: i, L: len(xs), S: fb.t.s, Q: b.seq - int64(len(xs))}
+	if fb.cols {
+		d.O, d.X = colsFormat, toCols(len(fb.t.f), tups)
+	} else {
+		d.D = tups
+	}
+	return BufD{C: d}
+}
+
+func (b *CycBufD) tups() [][]interface{} {
+	if b.X != nil {
+		return fromCols(b.X)
+	}
+	return b.D
 }
 
-func loadCycBuf(ns *Namespace, b *CycBufD) *CycBuf {
-	t := ns.make(b.F)
-	if len(b.D) == 0 {
-		n := b.N
-		if n <= 0 {
-			n = 10
+// capacity returns the size of the buffer to be loaded: the declared size, unless more tuples were provided.
+func (b *CycBufD) capacity(tups [][]interface{}) int {
+	n := b.N
+	if len(tups) > n {
+		n = len(tups)
+	}
+	if n <= 0 {
+		n = 10
+	}
+	return n
+}
+
+// check verifies that the write index and fill count are consistent with the buffer's size and tuples:
+// unless the buffer is empty or full, the slot preceding the index must hold the newest tuple, and the slot
+// at the index must be empty, as tuples are written in order.
+func (b *CycBufD) check() error {
+	tups := b.tups()
+	if b.N < 0 {
+		return fmt.Errorf("want non-negative size, got %d", b.N)
+	}
+	n := b.capacity(tups)
+	if b.I < 0 || b.I >= n {
+		return fmt.Errorf("want index in [0, %d), got %d", n, b.I)
+	}
+	if b.L < 0 || b.L > n {
+		return fmt.Errorf("want fill count in [0, %d], got %d", n, b.L)
+	}
+	filled := countTups(tups)
+	if b.L > 0 && filled != b.L {
+		return fmt.Errorf("want %d tuples, got %d", b.L, filled)
+	}
+	if filled > 0 && filled < n {
+		slot := func(i int) bool { return i < len(tups) && tups[i] != nil }
+		if !slot((b.I+n-1)%n) || slot(b.I) {
+			return fmt.Errorf("index %d inconsistent with %d tuples in %d slots", b.I, filled, n)
 		}
-		return &CycBuf{newFixBuf(t, n), 0}
 	}
-	return &CycBuf{&FixBuf{t, b.D}, b.I}
+	return nil
+}
+
+// countTups returns the number of non-empty tuples.
+func countTups(tups [][]interface{}) int {
+	n := 0
+	for _, tup := range tups {
+		if tup != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// loadCycBuf restores a buffer, resuming writes at the marshaled index.
+// Buffers are padded to their declared size. Buffers whose index or fill count are inconsistent
+// with their tuples are rejected, rather than resuming at the wrong position.
+func loadCycBuf(ns *Namespace, b *CycBufD) (*CycBuf, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	t := ns.make(fieldsOf(b.F, b.S))
+	cols := b.O == colsFormat
+	tups := b.tups()
+	n := b.capacity(tups)
+	if len(tups) < n {
+		tups = append(tups, make([][]interface{}, n-len(tups))...)
+	}
+	filled := b.L
+	if filled == 0 {
+		filled = countTups(tups)
+	}
+	return &CycBuf{&FixBuf{t, tups, cols, tupsSize(tups)}, b.I, b.Q + int64(filled)}, nil
 }
@@ -0,0 +1,188 @@
+package wave
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func newTestCycBuf(n int, xs ...float64) *CycBuf {
+	b := newCycBuf(newNamespace().make([]string{"a"}), n, 0)
+	for _, x := range xs {
+		b.set("", []interface{}{x})
+	}
+	return b
+}
+
+func chronoOf(xs ...float64) [][]interface{} {
+	tups := make([][]interface{}, len(xs))
+	for i, x := range xs {
+		tups[i] = []interface{}{x}
+	}
+	return tups
+}
+
+// roundTrip dumps a buffer, marshals and unmarshals the dump, and loads it back.
+func roundTrip(t *testing.T, b *CycBuf) *CycBuf {
+	t.Helper()
+	data, err := json.Marshal(b.dump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d BufD
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadCycBuf(newNamespace(), d.C)
+	if err != nil {
+		t.Fatalf("load %s: %v", data, err)
+	}
+	return loaded
+}
+
+func TestCycBufDumpLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		xs   []float64
+	}{
+		{"empty", 3, nil},
+		{"partial", 3, []float64{1, 2}},
+		{"full", 3, []float64{1, 2, 3}},
+		{"wrapped", 3, []float64{1, 2, 3, 4, 5}},
+		{"wrapped twice", 3, []float64{1, 2, 3, 4, 5, 6, 7}},
+	} {
+		b := newTestCycBuf(tc.n, tc.xs...)
+		loaded := roundTrip(t, b)
+		if !reflect.DeepEqual(loaded.chrono(), b.chrono()) {
+			t.Errorf("%s: want %v, got %v", tc.name, b.chrono(), loaded.chrono())
+		}
+		if loaded.seq != b.seq {
+			t.Errorf("%s: want seq %d, got %d", tc.name, b.seq, loaded.seq)
+		}
+		// Writes resume past the newest tuple.
+		b.set("", []interface{}{float64(100)})
+		loaded.set("", []interface{}{float64(100)})
+		if !reflect.DeepEqual(loaded.chrono(), b.chrono()) {
+			t.Errorf("%s: after append, want %v, got %v", tc.name, b.chrono(), loaded.chrono())
+		}
+	}
+}
+
+func TestCycBufLoadRejectsBadCursor(t *testing.T) {
+	tups := chronoOf(1, 2)
+	for _, tc := range []struct {
+		name string
+		d    CycBufD
+		ok   bool
+	}{
+		{"consistent", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 2, L: 2}, true},
+		{"fill count omitted", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 2}, true},
+		{"full", CycBufD{F: []string{"a"}, D: chronoOf(1, 2, 3), N: 3, I: 1, L: 3}, true},
+		{"negative index", CycBufD{F: []string{"a"}, D: tups, N: 4, I: -1, L: 2}, false},
+		{"index past end", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 4, L: 2}, false},
+		{"index behind newest", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 1, L: 2}, false},
+		{"index past gap", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 3, L: 2}, false},
+		{"fill count mismatch", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 2, L: 3}, false},
+		{"fill count too large", CycBufD{F: []string{"a"}, D: tups, N: 4, I: 2, L: 5}, false},
+	} {
+		_, err := loadCycBuf(newNamespace(), &tc.d)
+		if tc.ok && err != nil {
+			t.Errorf("%s: want no error, got %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%s: want error", tc.name)
+		}
+	}
+}
+
+func TestCycBufChrono(t *testing.T) {
+	b := newTestCycBuf(3, 1, 2, 3, 4)
+	if want := chronoOf(2, 3, 4); !reflect.DeepEqual(b.chrono(), want) {
+		t.Errorf("want %v, got %v", want, b.chrono())
+	}
+	if cur, ok := b.latest(); !ok || !reflect.DeepEqual(cur.tup, []interface{}{float64(4)}) {
+		t.Errorf("want latest 4, got %v", cur.tup)
+	}
+}
+
+func TestCycBufResize(t *testing.T) {
+	b := newTestCycBuf(3, 1, 2, 3, 4, 5) // wrapped: 3, 4, 5
+	for _, tc := range []struct {
+		name   string
+		n      int
+		append []float64
+		want   [][]interface{}
+	}{
+		{"shrink", 2, nil, chronoOf(4, 5)},
+		{"shrink, then append", 2, []float64{6}, chronoOf(5, 6)},
+		{"grow", 4, nil, chronoOf(5, 6)},
+		{"grow, then append", 4, []float64{7, 8}, chronoOf(5, 6, 7, 8)},
+		{"grow, then wrap", 4, []float64{9}, chronoOf(6, 7, 8, 9)},
+		{"same size", 4, nil, chronoOf(6, 7, 8, 9)},
+		{"shrink wrapped", 3, []float64{10}, chronoOf(8, 9, 10)},
+	} {
+		b.resize(tc.n)
+		for _, x := range tc.append {
+			b.set("", []interface{}{x})
+		}
+		if len(b.b.tups) != tc.n {
+			t.Errorf("%s: want size %d, got %d", tc.name, tc.n, len(b.b.tups))
+		}
+		if !reflect.DeepEqual(b.chrono(), tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, b.chrono())
+		}
+		if b.b.bytes != tupsSize(b.b.tups) {
+			t.Errorf("%s: want %d bytes, got %d", tc.name, tupsSize(b.b.tups), b.b.bytes)
+		}
+		loaded := roundTrip(t, b)
+		if !reflect.DeepEqual(loaded.chrono(), tc.want) || loaded.i != len(tc.want)%tc.n || loaded.seq != b.seq {
+			t.Errorf("%s: after dump and load, want %v at %d, got %v at %d", tc.name, tc.want, len(tc.want)%tc.n, loaded.chrono(), loaded.i)
+		}
+	}
+}
+
+func TestCycBufDelta(t *testing.T) {
+	retyped := newCycBuf(newNamespace().make([]string{"b"}), 4, 0)
+	retyped.set("", []interface{}{1.0})
+	for _, tc := range []struct {
+		name string
+		next *CycBuf
+		want string // delta; empty if sent in full
+	}{
+		{"appended", newTestCycBuf(4, 1, 2, 3, 4), `{"d":[[4]]}`},
+		{"appended and evicted", newTestCycBuf(4, 1, 2, 3, 4, 5), `{"d":[[4],[5]],"e":1}`},
+		{"unchanged", newTestCycBuf(4, 1, 2, 3), `{"d":[]}`},
+		{"too many appended", newTestCycBuf(4, 3, 4, 5, 6), ``},
+		{"diverged", newTestCycBuf(4, 1, 9, 3, 4), ``},
+		{"evicted, not appended", newTestCycBuf(4, 2, 3), ``},
+		{"resized", newTestCycBuf(5, 1, 2, 3, 4), ``},
+		{"retyped", retyped, ``},
+		{"emptied", newTestCycBuf(4), ``},
+	} {
+		got := ""
+		if d, ok := newTestCycBuf(4, 1, 2, 3).delta(tc.next); ok {
+			got = toJSON(t, d)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestCycBufDumpSeq(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		xs   []float64
+		want string
+	}{
+		{"empty", nil, `{"c":{"f":["a"],"d":[null,null,null],"n":3,"i":0}}`},
+		{"partial", []float64{1, 2}, `{"c":{"f":["a"],"d":[[1],[2],null],"n":3,"i":2,"l":2}}`},
+		{"full", []float64{1, 2, 3}, `{"c":{"f":["a"],"d":[[1],[2],[3]],"n":3,"i":0,"l":3}}`},
+		{"wrapped", []float64{1, 2, 3, 4, 5}, `{"c":{"f":["a"],"d":[[3],[4],[5]],"n":3,"i":0,"l":3,"q":2}}`},
+		{"wrapped twice", []float64{1, 2, 3, 4, 5, 6, 7}, `{"c":{"f":["a"],"d":[[5],[6],[7]],"n":3,"i":0,"l":3,"q":4}}`},
+	} {
+		if got := toJSON(t, newTestCycBuf(3, tc.xs...).dump()); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
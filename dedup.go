@@ -0,0 +1,160 @@
+package wave
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	dedupParam    = "token" // query parameter holding a token chosen by the client, stable across reconnects
+	maxDedupToken = 128     // longer tokens are ignored
+)
+
+// Deduper remembers the ids of ops recently applied by each client, so that ops resent by clients
+// (e.g. after reconnecting, if unsure whether they were received) are applied at most once.
+// Clients that supply a token are identified by it, qualified by principal, so that ids are remembered
+// across reconnects; else by their connection. Windows are discarded least recently used first once there are
+// more than a set number of them. A nil Deduper skips nothing.
+type Deduper struct {
+	sync.Mutex
+	size    int                      // ids remembered per client
+	max     int                      // max windows held
+	lru     *list.List               // windows, most recently used first
+	windows map[string]*list.Element // client key => window
+}
+
+// DedupWindow represents the most recently applied op ids of a client.
+type DedupWindow struct {
+	key  string         // client key
+	ids  []string       // ring of ids, oldest first from i, once full
+	i    int            // next slot to use, once full
+	seen map[string]int // id => slot
+}
+
+// newDeduper returns a deduper remembering up to size op ids per client, for up to max clients,
+// or nil if size is not positive.
+func newDeduper(size, max int) *Deduper {
+	if size <= 0 {
+		return nil
+	}
+	if max < 1 {
+		max = 1
+	}
+	return &Deduper{size: size, max: max, lru: list.New(), windows: make(map[string]*list.Element)}
+}
+
+// dedupKey returns the key identifying a client's ops: its token, if any, qualified by principal, else fallback.
+func dedupKey(principal, token, fallback string) string {
+	if len(token) == 0 || len(token) > maxDedupToken {
+		return fallback
+	}
+	return principal + "\x00" + token
+}
+
+// claim returns the ops that have not been applied before, marking their ids, if any, as applied.
+// Ops without ids are always applied. The ids marked are returned, so that they can be released
+// if the ops fail to apply.
+func (d *Deduper) claim(key string, ops []OpD) ([]OpD, []string) {
+	if d == nil {
+		return ops, nil
+	}
+
+	if !hasIDs(ops) { // avoid creating windows for clients that never send ids
+		return ops, nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	w := d.window(key)
+	var kept []OpD
+	var ids []string
+	for _, op := range ops {
+		if len(op.I) == 0 {
+			kept = append(kept, op)
+			continue
+		}
+		if _, ok := w.seen[op.I]; ok {
+			continue
+		}
+		w.add(op.I, d.size)
+		kept = append(kept, op)
+		ids = append(ids, op.I)
+	}
+	return kept, ids
+}
+
+// hasIDs reports whether any op carries an id.
+func hasIDs(ops []OpD) bool {
+	for _, op := range ops {
+		if len(op.I) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// window returns the window of a client, creating it if necessary, and marks it as most recently used.
+func (d *Deduper) window(key string) *DedupWindow {
+	if e, ok := d.windows[key]; ok {
+		d.lru.MoveToFront(e)
+		return e.Value.(*DedupWindow)
+	}
+	for d.lru.Len() >= d.max {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.windows, oldest.Value.(*DedupWindow).key)
+	}
+	w := &DedupWindow{key, nil, 0, make(map[string]int)}
+	d.windows[key] = d.lru.PushFront(w)
+	return w
+}
+
+// release forgets ids claimed by ops that failed to apply, so that they can be retried.
+func (d *Deduper) release(key string, ids []string) {
+	if d == nil || len(ids) == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.windows[key]; ok {
+		w := e.Value.(*DedupWindow)
+		for _, id := range ids {
+			if i, ok := w.seen[id]; ok {
+				w.ids[i] = ""
+				delete(w.seen, id)
+			}
+		}
+	}
+}
+
+// forget discards the window of a client.
+func (d *Deduper) forget(key string) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	if e, ok := d.windows[key]; ok {
+		d.lru.Remove(e)
+		delete(d.windows, key)
+	}
+	d.Unlock()
+}
+
+// add remembers an id, evicting the oldest id if the window holds size ids.
+// Slots are allocated as needed, so that windows of clients sending few ids stay small.
+func (w *DedupWindow) add(id string, size int) {
+	if len(w.ids) < size {
+		w.seen[id] = len(w.ids)
+		w.ids = append(w.ids, id)
+		return
+	}
+	if old := w.ids[w.i]; len(old) > 0 {
+		delete(w.seen, old)
+	}
+	w.ids[w.i] = id
+	w.seen[id] = w.i
+	w.i = (w.i + 1) % len(w.ids)
+}
@@ -0,0 +1,152 @@
+package wave
+
+import (
+	"strings"
+	"testing"
+)
+
+// opIDs returns ops with the given ids; "-" denotes an op without an id.
+func opIDs(ids ...string) []OpD {
+	ops := make([]OpD, len(ids))
+	for i, id := range ids {
+		if id != "-" {
+			ops[i].I = id
+		}
+		ops[i].K = "k" + id
+	}
+	return ops
+}
+
+// keptIDs returns the ids of ops kept, "-" for ops without ids.
+func keptIDs(ops []OpD) string {
+	ids := make([]string, len(ops))
+	for i, op := range ops {
+		if ids[i] = op.I; ids[i] == "" {
+			ids[i] = "-"
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestDeduperClaim(t *testing.T) {
+	d := newDeduper(3, 10)
+	for _, tc := range []struct {
+		name string
+		key  string
+		ids  []string
+		kept string
+	}{
+		{"new", "a", []string{"1", "2"}, "1,2"},
+		{"resent", "a", []string{"1", "2", "3"}, "3"},
+		{"without ids", "a", []string{"-", "1", "-"}, "-,-"},
+		{"repeated in batch", "a", []string{"4", "4"}, "4"},
+		{"other client", "b", []string{"1"}, "1"},
+		{"evicted from window", "a", []string{"1"}, "1"}, // window holds 4, 2, 3
+		{"window slides", "a", []string{"2", "4"}, "2"},
+	} {
+		kept, _ := d.claim(tc.key, opIDs(tc.ids...))
+		if got := keptIDs(kept); got != tc.kept {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.kept, got)
+		}
+	}
+}
+
+func TestDeduperRelease(t *testing.T) {
+	d := newDeduper(3, 10)
+	_, ids := d.claim("a", opIDs("1", "2", "-"))
+	if strings.Join(ids, ",") != "1,2" {
+		t.Fatalf("want ids claimed, got %v", ids)
+	}
+	d.release("a", []string{"2"})
+	if kept, _ := d.claim("a", opIDs("1", "2")); keptIDs(kept) != "2" {
+		t.Errorf("want released id applied again, got %s", keptIDs(kept))
+	}
+}
+
+func TestDeduperWindows(t *testing.T) {
+	d := newDeduper(3, 2)
+	for _, tc := range []struct {
+		name    string
+		key     string
+		id      string
+		kept    string
+		windows int
+	}{
+		{"first", "a", "1", "1", 1},
+		{"second", "b", "1", "1", 2},
+		{"first, used again", "a", "2", "2", 2},
+		{"third evicts least recently used", "c", "1", "1", 2},
+		{"evicted forgotten", "b", "1", "1", 2}, // evicts a
+		{"kept remembered", "c", "1", "", 2},
+		{"no ids, no window", "d", "-", "-", 2},
+	} {
+		kept, _ := d.claim(tc.key, opIDs(tc.id))
+		if got := keptIDs(kept); got != tc.kept {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.kept, got)
+		}
+		if len(d.windows) != tc.windows || d.lru.Len() != tc.windows {
+			t.Errorf("%s: want %d windows, got %d", tc.name, tc.windows, len(d.windows))
+		}
+	}
+	d.forget("c")
+	if _, ok := d.windows["c"]; ok || d.lru.Len() != 1 {
+		t.Error("want window forgotten")
+	}
+}
+
+func TestDeduperDisabled(t *testing.T) {
+	d := newDeduper(0, 10)
+	if d != nil {
+		t.Fatal("want deduper disabled")
+	}
+	for i := 0; i < 2; i++ {
+		if kept, _ := d.claim("a", opIDs("1")); keptIDs(kept) != "1" {
+			t.Errorf("want ops applied, got %s", keptIDs(kept))
+		}
+	}
+	d.release("a", []string{"1"})
+	d.forget("a")
+}
+
+func TestDedupKey(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		principal string
+		token     string
+		want      string
+	}{
+		{"token", "alice", "t", "alice\x00t"},
+		{"no token", "alice", "", "conn"},
+		{"token too long", "alice", strings.Repeat("t", maxDedupToken+1), "conn"},
+		{"token, other principal", "bob", "t", "bob\x00t"},
+	} {
+		if got := dedupKey(tc.principal, tc.token, "conn"); got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestBrokerDedup(t *testing.T) {
+	b := newBroker(newSite(), nil, nil, ServerConf{DedupWindow: 8, DedupClients: 8})
+	go b.run()
+	mustPatch(t, b, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"n":4}}]}]}`)
+	for _, tc := range []struct {
+		name   string
+		key    string
+		data   string
+		strict bool
+		want   string // buffer contents after patch
+	}{
+		{"applied", "a", `{"d":[{"k":"c items","a":{"d":[[1]]},"i":"1"}]}`, false, `[[1]]`},
+		{"resent", "a", `{"d":[{"k":"c items","a":{"d":[[1]]},"i":"1"}]}`, false, `[[1]]`},
+		{"resent with new op", "a", `{"d":[{"k":"c items","a":{"d":[[1]]},"i":"1"},{"k":"c items","a":{"d":[[2]]},"i":"2"}]}`, false, `[[1],[2]]`},
+		{"other client", "b", `{"d":[{"k":"c items","a":{"d":[[1]]},"i":"1"}]}`, false, `[[1],[2],[1]]`},
+		{"rejected", "a", `{"d":[{"k":"c items","a":{"d":[[3]]},"i":"3"},{"k":"z items","a":{"d":[[3]]}}]}`, true, `[[1],[2],[1]]`},
+		{"rejected, retried", "a", `{"d":[{"k":"c items","a":{"d":[[3]]},"i":"3"}]}`, false, `[[1],[2],[1],[3]]`},
+	} {
+		b.patch("alice", tc.key, "/p", []byte(tc.data), tc.strict)
+		if got := toJSON(t, b.site.at("/p").at("c items").(*CycBuf).chrono()); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package wave
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Query parameters understood by the event server.
+const (
+	eventClientParam = "c" // client id, when posting messages
+	eventRouteParam  = "r" // route to watch, when connecting
+)
+
+var eventSeqPrefix = []byte(`{"q":`)
+
+// EventStream represents a client connected using server-sent events.
+type EventStream struct {
+	sync.Mutex // serializes messages posted by the client
+	client     *Client
+}
+
+// EventServer represents a server-sent events (SSE) server, a fallback for clients that cannot use websockets.
+//
+// Clients connect with a GET, optionally naming a route to watch, and receive the client's id as the first event,
+// followed by the same messages websocket clients receive. Messages carrying a sequence number use it as the
+// event id, so that clients reconnecting with a Last-Event-ID header are replayed the messages they missed.
+// Clients send messages by POSTing them, one per request, using the same protocol as websocket clients.
+type EventServer struct {
+	broker      *Broker
+	sessions    *OIDCSessions
+	oidcEnabled bool
+	maxSize     int64 // max request body size
+	streamsMux  sync.Mutex
+	streams     map[string]*EventStream // client id => stream
+}
+
+func newEventServer(broker *Broker, sessions *OIDCSessions, oidcEnabled bool, maxSize int64) *EventServer {
+	return &EventServer{broker, sessions, oidcEnabled, maxSize, sync.Mutex{}, make(map[string]*EventStream)}
+}
+
+func (s *EventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := getSessionID(r)
+	if s.oidcEnabled { // reject connections from logged-out or expired sessions
+		if _, ok := s.sessions.get(session); !ok {
+			echo(Log{"t": "events", "error": "session not found"})
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.stream(w, r, session)
+	case http.MethodPost:
+		s.post(w, r, session)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *EventServer) stream(w http.ResponseWriter, r *http.Request, session string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	username, subject := getIdentity(r, s.sessions)
+	client := newClient(getRemoteAddr(r), username, subject, session, s.broker, nil)
+	client.strict = isStrict(r.URL.Query().Get(strictParam))
+	client.token = r.URL.Query().Get(dedupParam)
+	stream := &EventStream{client: client}
+
+	s.streamsMux.Lock()
+	s.streams[client.id] = stream
+	s.streamsMux.Unlock()
+
+	atomic.AddInt64(&metrics.clients, 1)
+	s.broker.conns.Add(1)
+	s.broker.join <- client
+	defer func() {
+		s.streamsMux.Lock()
+		delete(s.streams, client.id)
+		s.streamsMux.Unlock()
+		atomic.AddInt64(&metrics.clients, -1)
+		s.broker.conns.Done()
+		s.broker.unsubscribe <- client
+	}()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // disable buffering by nginx
+
+	var out io.Writer = w
+	flush := flusher.Flush
+	if gz := s.broker.compression.gzip(w, r); gz != nil {
+		defer gz.Close()
+		out = gz
+		flush = func() {
+			gz.Flush()
+			flusher.Flush()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent(out, "client", nil, []byte(client.id))
+	flush()
+
+	if route := r.URL.Query().Get(eventRouteParam); route != "" {
+		seq, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		stream.Lock()
+		client.resume(route, seq)
+		stream.Unlock()
+	}
+
+	ticker := time.NewTicker(s.broker.pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-client.data:
+			if !ok { // broker closed the channel.
+				return
+			}
+			n := writeEvent(out, "", eventSeq(data), data)
+			for i := len(client.data); i > 0; i-- { // push queued messages, if any
+				data, ok := <-client.data
+				if !ok {
+					break
+				}
+				n += writeEvent(out, "", eventSeq(data), data)
+			}
+			flush()
+			atomic.AddInt64(&metrics.bytesOut, int64(n))
+			client.touch()
+		case <-ticker.C:
+			if client.isIdle(s.broker.idleTimeout) {
+				echo(Log{"t": "ui_idle", "addr": client.addr, "timeout": s.broker.idleTimeout.String()})
+				return
+			}
+			out.Write([]byte(":\n\n")) // comment; keeps proxies from timing out the connection
+			flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *EventServer) post(w http.ResponseWriter, r *http.Request, session string) {
+	id := r.URL.Query().Get(eventClientParam)
+	s.streamsMux.Lock()
+	stream, ok := s.streams[id]
+	s.streamsMux.Unlock()
+	if !ok || stream.client.session != session {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	msg, err := readBody(r, s.maxSize)
+	if err != nil {
+		echo(Log{"t": "read event request body", "error": err.Error()})
+		replyBodyError(w, err)
+		return
+	}
+	stream.Lock()
+	stream.client.handle(msg)
+	stream.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventSeq returns the sequence number a message is annotated with, if any.
+func eventSeq(data []byte) []byte {
+	if !bytes.HasPrefix(data, eventSeqPrefix) {
+		return nil
+	}
+	seq := data[len(eventSeqPrefix):]
+	if i := bytes.IndexAny(seq, ",}"); i > 0 {
+		return seq[:i]
+	}
+	return nil
+}
+
+// writeEvent writes a server-sent event, and returns the number of bytes written.
+func writeEvent(w io.Writer, event string, id, data []byte) int {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event)
+		buf.WriteByte('\n')
+	}
+	if id != nil {
+		buf.WriteString("id: ")
+		buf.Write(id)
+		buf.WriteByte('\n')
+	}
+	for _, line := range bytes.Split(data, newline) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	n, _ := w.Write(buf.Bytes())
+	return n
+}
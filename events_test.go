@@ -0,0 +1,130 @@
+package wave
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event string
+		id    string
+		data  string
+		want  string
+	}{
+		{"data", "", "", `{"a":1}`, "data: {\"a\":1}\n\n"},
+		{"named", "client", "", `abc`, "event: client\ndata: abc\n\n"},
+		{"id", "", "42", `{"q":42}`, "id: 42\ndata: {\"q\":42}\n\n"},
+		{"multiline", "", "", "{\"a\":1}\n{\"b\":2}", "data: {\"a\":1}\ndata: {\"b\":2}\n\n"},
+	} {
+		var buf bytes.Buffer
+		var id []byte
+		if tc.id != "" {
+			id = []byte(tc.id)
+		}
+		n := writeEvent(&buf, tc.event, id, []byte(tc.data))
+		if buf.String() != tc.want || n != len(tc.want) {
+			t.Errorf("%s: want %q, got %q (%d bytes)", tc.name, tc.want, buf.String(), n)
+		}
+	}
+}
+
+func TestEventSeq(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{`{"q":42,"d":[]}`, "42"},
+		{`{"q":42}`, "42"},
+		{`{"d":[],"q":42}`, ""},
+		{`{"q":}`, ""},
+		{``, ""},
+	} {
+		if got := string(eventSeq([]byte(tc.data))); got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.data, tc.want, got)
+		}
+	}
+}
+
+// readEvent reads the next server-sent event from a stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (event, id, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != "" {
+				return
+			}
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if data != "" {
+				data += "\n"
+			}
+			data += strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventServer(t *testing.T) {
+	b := newBroker(newSite(), nil, nil, ServerConf{ReplaySize: 8})
+	go b.run()
+	s := newEventServer(b, newOIDCSessions(), false, 1<<20)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	mustPatch(t, b, "/p", `{"d":[{"k":"x","d":{"v":1}}]}`)
+
+	resp, err := http.Get(server.URL + "?r=/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	timeout := time.AfterFunc(5*time.Second, func() { resp.Body.Close() }) // unblocks reads
+	defer timeout.Stop()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("want event stream, got %s", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	event, _, id := readEvent(t, events) // client id, as data
+	if event != "client" || id == "" {
+		t.Fatalf("want client id, got %s %s", event, id)
+	}
+	if _, _, data := readEvent(t, events); !strings.Contains(data, `"p":`) {
+		t.Fatalf("want page, got %s", data)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		client string
+		msg    string
+		status int
+	}{
+		{"patch", id, `* /p {"d":[{"k":"x v","v":2}]}`, http.StatusNoContent},
+		{"unknown client", "nope", `* /p {"d":[{"k":"x v","v":3}]}`, http.StatusNotFound},
+	} {
+		resp, err := http.Post(server.URL+"?c="+tc.client, "text/plain", strings.NewReader(tc.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+	if _, seq, data := readEvent(t, events); seq == "" || data != `{"q":`+seq+`,"d":[{"k":"x v","v":2}]}` {
+		t.Errorf("want change with sequence number as event id, got %s %s", seq, data)
+	}
+}
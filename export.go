@@ -0,0 +1,203 @@
+package wave
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Query parameters understood by the export server.
+const (
+	exportPageParam   = "p"      // page url
+	exportKeyParam    = "k"      // buffer key
+	exportFormatParam = "format" // "csv" or "json"; else determined by the Accept header
+)
+
+const (
+	contentTypeCSV = "text/csv"
+	exportKeyField = "_key" // name of the column holding keys of map buffer records
+)
+
+// ExportServer represents a server for exporting buffer contents as CSV or JSON.
+type ExportServer struct {
+	site     *Site
+	access   *AccessControl
+	sessions *OIDCSessions
+	apiKeys  []APIKey
+}
+
+func newExportServer(site *Site, access *AccessControl, sessions *OIDCSessions, apiKeys []APIKey) *ExportServer {
+	return &ExportServer{site, access, sessions, apiKeys}
+}
+
+// Export represents the tuples in a buffer, as of the time of export.
+type Export struct {
+	f    []string        // field names
+	k    []string        // keys, if a map buffer
+	tups [][]interface{} // tuples
+}
+
+func (s *ExportServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	url, key := q.Get(exportPageParam), q.Get(exportKeyParam)
+	if principals := principalsOf(r, s.sessions, s.apiKeys); !s.access.canRead(url, principals...) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	x, err := s.export(url, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	format := q.Get(exportFormatParam)
+	if format == "" && strings.Contains(r.Header.Get("Accept"), contentTypeCSV) {
+		format = "csv"
+	}
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", contentTypeCSV)
+		err = x.writeCSV(bw)
+	case "", "json":
+		w.Header().Set("Content-Type", contentTypeJSON)
+		err = x.writeJSON(bw)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format: %s", format), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		echo(Log{"t": "export", "url": url, "key": key, "error": err.Error()})
+	}
+}
+
+// export captures the tuples in the buffer at key k on the page at url.
+// Tuples are shallow-copied under a read lock, and written out after the lock is released,
+// so that slow downloads do not hold up writes to the page.
+func (s *ExportServer) export(url, k string) (*Export, error) {
+	page := s.site.at(url)
+	if page == nil {
+		return nil, fmt.Errorf("page not found: %s", url)
+	}
+	page.RLock()
+	defer page.RUnlock()
+
+	switch b := page.at(k).(type) {
+	case *FixBuf:
+		return &Export{f: b.t.f, tups: copyTups(b.tups)}, nil
+	case *CycBuf:
+		return &Export{f: b.b.t.f, tups: copyTups(b.chrono())}, nil
+	case *MapBuf:
+		keys := b.keys()
+		tups := make([][]interface{}, len(keys))
+		for i, k := range keys {
+			tups[i] = b.tups[k]
+		}
+		return &Export{f: b.t.f, k: keys, tups: copyTups(tups)}, nil
+	}
+	return nil, fmt.Errorf("buffer not found: %s", k)
+}
+
+// copyTups returns shallow copies of the non-empty tuples.
+func copyTups(tups [][]interface{}) [][]interface{} {
+	xs := make([][]interface{}, 0, len(tups))
+	for _, tup := range tups {
+		if tup != nil {
+			xs = append(xs, append([]interface{}(nil), tup...))
+		}
+	}
+	return xs
+}
+
+// writeCSV writes a header row of field names, followed by one row per tuple.
+func (x *Export) writeCSV(w *bufio.Writer) error {
+	cw := csv.NewWriter(w)
+	header := x.f
+	if x.k != nil {
+		header = append([]string{exportKeyField}, x.f...)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	row := make([]string, len(header))
+	for i, tup := range x.tups {
+		j := 0
+		if x.k != nil {
+			row[0], j = x.k[i], 1
+		}
+		for f := range x.f {
+			var v interface{}
+			if f < len(tup) {
+				v = tup[f]
+			}
+			row[j+f] = csvValue(v)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// writeJSON writes {"f":[fields],"k":[keys],"d":[tuples]}, one tuple at a time; "k" is omitted unless a map buffer.
+func (x *Export) writeJSON(w *bufio.Writer) error {
+	write := func(prefix string, v interface{}) error {
+		w.WriteString(prefix)
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	if err := write(`{"f":`, x.f); err != nil {
+		return err
+	}
+	if x.k != nil {
+		if err := write(`,"k":`, x.k); err != nil {
+			return err
+		}
+	}
+	w.WriteString(`,"d":[`)
+	for i, tup := range x.tups {
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		if err := write(sep, tup); err != nil {
+			return err
+		}
+	}
+	_, err := w.WriteString("]}")
+	return err
+}
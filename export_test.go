@@ -0,0 +1,58 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportServer(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/p": `{"d":[
+			{"k":"m","d":{"~items":0},"b":[{"m":{"f":["a","b"],"d":{"y":[2,"v,w"],"x":[1,null]}}}]},
+			{"k":"f","d":{"~items":0},"b":[{"f":{"f":["a"],"d":[[1],null,[true]],"n":3}}]},
+			{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[4],[2],[3]],"n":3,"i":1}}]},
+			{"k":"n","d":{"~items":0},"b":[{"f":{"f":["a"],"d":[[[1,2]],[{"x":"y"}]],"n":2}}]}
+		]}`,
+	})
+	s := newExportServer(site, &AccessControl{map[string]AccessPolicy{"/secret": {}}}, nil, nil)
+	for _, tc := range []struct {
+		name   string
+		query  string
+		accept string
+		status int
+		ctype  string
+		body   string
+	}{
+		{"map, json", "p=/p&k=m+items", "", http.StatusOK, contentTypeJSON, `{"f":["a","b"],"k":["x","y"],"d":[[1,null],[2,"v,w"]]}`},
+		{"map, csv", "p=/p&k=m+items&format=csv", "", http.StatusOK, contentTypeCSV, "_key,a,b\nx,1,\ny,2,\"v,w\"\n"},
+		{"fixed, csv by accept", "p=/p&k=f+items", "text/csv", http.StatusOK, contentTypeCSV, "a\n1\ntrue\n"},
+		{"fixed, json", "p=/p&k=f+items&format=json", "text/csv", http.StatusOK, contentTypeJSON, `{"f":["a"],"d":[[1],[true]]}`},
+		{"cyclic, oldest first", "p=/p&k=c+items&format=csv", "", http.StatusOK, contentTypeCSV, "a\n2\n3\n4\n"},
+		{"nested values, csv", "p=/p&k=n+items&format=csv", "", http.StatusOK, contentTypeCSV, "a\n\"[1,2]\"\n\"{\"\"x\"\":\"\"y\"\"}\"\n"},
+		{"bad format", "p=/p&k=m+items&format=xml", "", http.StatusBadRequest, "", ""},
+		{"no buffer", "p=/p&k=m", "", http.StatusNotFound, "", ""},
+		{"no page", "p=/q&k=m+items", "", http.StatusNotFound, "", ""},
+		{"forbidden", "p=/secret&k=m+items", "", http.StatusForbidden, "", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/_x?"+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tc.ctype {
+			t.Errorf("%s: want content type %s, got %s", tc.name, tc.ctype, ct)
+		}
+		if w.Body.String() != tc.body {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.body, w.Body.String())
+		}
+	}
+}
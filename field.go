@@ -0,0 +1,364 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind represents the kind of values a field can hold.
+type Kind int
+
+const (
+	anyKind   Kind = iota // any value; unchecked
+	timeKind              // datetime
+	intKind               // integer
+	floatKind             // number
+	strKind               // string
+	boolKind              // boolean
+	tupleKind             // tuple of fields
+)
+
+var kindNames = map[string]Kind{
+	"time":  timeKind,
+	"int":   intKind,
+	"float": floatKind,
+	"str":   strKind,
+	"bool":  boolKind,
+}
+
+func (k Kind) String() string {
+	if k == tupleKind {
+		return "tuple"
+	}
+	for name, kind := range kindNames {
+		if kind == k {
+			return name
+		}
+	}
+	return "any"
+}
+
+const arrayPrefix = "[]"
+
+// Marks a kind as coercing, e.g. "~float".
+const coercePrefix = "~"
+
+// Enum kind syntax: "enum(a|b|c)".
+const (
+	enumPrefix = "enum("
+	enumSuffix = ")"
+	enumSep    = "|"
+)
+
+// Tuple kind syntax: "(spec,spec,...)".
+const (
+	tuplePrefix = "("
+	tupleSuffix = ")"
+	tupleSep    = ","
+)
+
+// Canonical representation of datetime values: RFC3339, UTC, millisecond precision.
+// Being fixed-width, canonical values compare correctly as strings.
+const timeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Field represents the attributes of a field in a data type.
+//
+// Field specs are written as "name[:kind][?|=value]", where:
+//
+//	kind is the kind of values the field can hold ("time", "int", "float", "str", "bool"); any value if omitted.
+//	  "enum(a|b|c)" denotes strings restricted to the listed values.
+//	  "(spec,spec,...)" denotes a nested tuple of fields; one level of nesting is supported.
+//	  "[]kind" denotes a variable-length array of values of that kind.
+//	  "~kind" (or "~[]kind") converts values of other kinds, where sensible, e.g. "42" to 42 for "~int".
+//	"?" marks the field nullable.
+//	"=value" marks the field nullable, with a default value; value is JSON, or a bare string if not valid JSON.
+//
+// Values of typed fields are checked; nil is rejected unless the field is nullable.
+// Namespaces can be configured to coerce values of all typed fields.
+type Field struct {
+	name     string      // name
+	kind     Kind        // kind of values
+	array    bool        // array of values of kind?
+	nullable bool        // can be nil or omitted?
+	def      interface{} // default value, if nil or omitted
+	enum     []string    // allowed values, if an enum
+	sub      Typ         // type of nested tuples, if a tuple
+	coerce   bool        // convert values of other kinds?
+}
+
+// spec returns a description of the kind of values the field can hold, e.g. "[]int".
+func (fd Field) spec() string {
+	name := fd.kind.String()
+	if fd.kind == tupleKind {
+		name = tuplePrefix + strings.Join(fieldsOf(fd.sub.f, fd.sub.s), tupleSep) + tupleSuffix
+	}
+	if fd.enum != nil {
+		name = enumPrefix + strings.Join(fd.enum, enumSep) + enumSuffix
+	}
+	if fd.array {
+		return arrayPrefix + name
+	}
+	return name
+}
+
+// parseKind parses a kind, other than the array prefix, returning the allowed values if an enum.
+func parseKind(k string) (Kind, []string, bool) {
+	if strings.HasPrefix(k, enumPrefix) && strings.HasSuffix(k, enumSuffix) && len(k) > len(enumPrefix+enumSuffix) {
+		return strKind, strings.Split(k[len(enumPrefix):len(k)-len(enumSuffix)], enumSep), true
+	}
+	kind, ok := kindNames[k]
+	return kind, nil, ok
+}
+
+func parseField(spec string) Field {
+	if fd, ok := parseTupleField(spec); ok {
+		return fd
+	}
+	name, fd := spec, Field{}
+	if i := strings.IndexByte(name, '='); i > 0 {
+		v := name[i+1:]
+		name = name[:i]
+		var def interface{}
+		if err := json.Unmarshal([]byte(v), &def); err != nil {
+			def = v
+		}
+		fd.nullable, fd.def = true, def
+	}
+	if strings.HasSuffix(name, "?") && len(name) > 1 {
+		name = strings.TrimSuffix(name, "?")
+		fd.nullable = true
+	}
+	if i := strings.LastIndexByte(name, ':'); i > 0 {
+		k := name[i+1:]
+		coerce := strings.HasPrefix(k, coercePrefix)
+		k = strings.TrimPrefix(k, coercePrefix)
+		array := strings.HasPrefix(k, arrayPrefix)
+		if kind, enum, ok := parseKind(strings.TrimPrefix(k, arrayPrefix)); ok {
+			name = name[:i]
+			fd.kind, fd.array, fd.enum, fd.coerce = kind, array, enum, coerce
+		}
+	}
+	fd.name = name
+	if fd.def != nil {
+		if def, err := fd.conform(fd.def); err == nil {
+			fd.def = def
+		} else {
+			fd.def = nil
+		}
+	}
+	return fd
+}
+
+// parseTupleField parses a field spec having a tuple kind.
+// Nested specs can contain any of the delimiters used by field specs, so the kind is located first.
+func parseTupleField(spec string) (Field, bool) {
+	i := strings.Index(spec, ":"+tuplePrefix)
+	array := false
+	if j := strings.Index(spec, ":"+arrayPrefix+tuplePrefix); j > 0 && (i < 0 || j < i) {
+		i, array = j, true
+	}
+	j := strings.LastIndex(spec, tupleSuffix)
+	if i <= 0 {
+		return Field{}, false
+	}
+	k := i + 1 + len(tuplePrefix)
+	if array {
+		k += len(arrayPrefix)
+	}
+	if j < k {
+		return Field{}, false
+	}
+	fd := parseField(spec[:i] + spec[j+len(tupleSuffix):]) // name and attributes
+	fd.kind, fd.array = tupleKind, array
+	var specs []string
+	if inner := spec[k:j]; inner != "" {
+		specs = strings.Split(inner, tupleSep)
+	}
+	fd.sub = newType(specs)
+	if fd.def != nil {
+		if def, err := fd.conform(fd.def); err == nil {
+			fd.def = def
+		} else {
+			fd.def = nil
+		}
+	}
+	return fd, true
+}
+
+// conform validates a value against the field's attributes, and returns the value in its canonical representation.
+func (fd Field) conform(v interface{}) (interface{}, error) {
+	if v == nil {
+		if fd.def != nil {
+			return deepClone(fd.def), nil // not shared between tuples
+		}
+		if fd.kind == anyKind || fd.nullable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("field %s: want value, got nil", fd.name)
+	}
+	if fd.array {
+		xs, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("field %s: want array, got %v", fd.name, v)
+		}
+		ys := make([]interface{}, len(xs))
+		for i, x := range xs {
+			y, err := fd.conformOne(x)
+			if err != nil {
+				return nil, fmt.Errorf("field %s[%d]: %v", fd.name, i, err)
+			}
+			ys[i] = y
+		}
+		return ys, nil
+	}
+	x, err := fd.conformOne(v)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %v", fd.name, err)
+	}
+	return x, nil
+}
+
+// conformOne validates a scalar value against the field's kind and allowed values.
+func (fd Field) conformOne(v interface{}) (interface{}, error) {
+	if fd.kind == tupleKind {
+		return fd.sub.checkNested(v)
+	}
+	x, err := conform(fd.kind, v)
+	if err != nil && fd.coerce {
+		x, err = coerce(fd.kind, v)
+	}
+	if err != nil || fd.enum == nil {
+		return x, err
+	}
+	for _, s := range fd.enum {
+		if x == s {
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("want one of %s, got %q", strings.Join(fd.enum, enumSep), x)
+}
+
+// conform validates a scalar value against a kind, and returns the value in its canonical representation.
+func conform(kind Kind, v interface{}) (interface{}, error) {
+	switch kind {
+	case timeKind:
+		t, err := toTime(v)
+		if err != nil {
+			return nil, err
+		}
+		return t.UTC().Format(timeLayout), nil
+	case intKind:
+		if x, ok := v.(float64); ok && x == math.Trunc(x) {
+			return x, nil
+		}
+		return nil, fmt.Errorf("want int, got %v", v)
+	case floatKind:
+		if x, ok := v.(float64); ok {
+			return x, nil
+		}
+		return nil, fmt.Errorf("want float, got %v", v)
+	case strKind:
+		if x, ok := v.(string); ok {
+			return x, nil
+		}
+		return nil, fmt.Errorf("want str, got %v", v)
+	case boolKind:
+		if x, ok := v.(bool); ok {
+			return x, nil
+		}
+		return nil, fmt.Errorf("want bool, got %v", v)
+	}
+	return v, nil
+}
+
+// coerce converts a scalar value of another kind to a kind, and returns the value in its canonical representation.
+// Numeric strings convert to numbers, "true"/"false" (or "1"/"0") to booleans, booleans to 1 or 0,
+// 1 or 0 to booleans, and numbers and booleans to strings.
+func coerce(kind Kind, v interface{}) (interface{}, error) {
+	var x interface{}
+	switch kind {
+	case intKind, floatKind:
+		switch v := v.(type) {
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				x = f
+			}
+		case bool:
+			x = 0.0
+			if v {
+				x = 1.0
+			}
+		}
+	case strKind:
+		switch v := v.(type) {
+		case float64:
+			x = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			x = strconv.FormatBool(v)
+		}
+	case boolKind:
+		switch v := v.(type) {
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				x = b
+			}
+		case float64:
+			if v == 0 || v == 1 {
+				x = v == 1
+			}
+		}
+	case timeKind:
+		if s, ok := v.(string); ok { // epoch milliseconds
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				x = f
+			}
+		}
+	}
+	if x != nil {
+		if y, err := conform(kind, x); err == nil {
+			return y, nil
+		}
+	}
+	got := fmt.Sprint(v)
+	if s, ok := v.(string); ok {
+		got = strconv.Quote(s)
+	}
+	return nil, fmt.Errorf("want %s, got %s: cannot convert %s to %s", kind, got, kindOf(v), kind)
+}
+
+// kindOf returns the name of the kind of a JSON value.
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "str"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// toTime converts a RFC3339 string or epoch milliseconds to a time.
+func toTime(v interface{}) (time.Time, error) {
+	switch x := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, x)
+		if err != nil {
+			return t, fmt.Errorf("want RFC3339 datetime, got %q", x)
+		}
+		return t, nil
+	case float64:
+		ms := int64(x)
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)), nil
+	}
+	return time.Time{}, fmt.Errorf("want datetime, got %v", v)
+}
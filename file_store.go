@@ -9,17 +9,19 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // FileStore represents a file store.
 type FileStore struct {
-	dir string
+	dir     string
+	uploads *Uploads // resumable uploads in progress
 }
 
-func newFileStore(dir string) http.Handler {
-	return &FileStore{dir}
+func newFileStore(dir string, uploadTimeout time.Duration) *FileStore {
+	return &FileStore{dir, newUploads(filepath.Join(dir, partialDir), uploadTimeout)}
 }
 
 // UploadResponse represents a response to a file upload operation.
@@ -95,6 +97,31 @@ func (fs *FileStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(res)
+	case http.MethodPut: // resumable uploads
+		file, err := fs.put(w, r)
+		if err != nil {
+			echo(Log{"t": "file_upload", "error": err.Error()})
+			status := http.StatusBadRequest
+			if err == errUploadNotFound {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if len(file) == 0 { // incomplete
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		res, err := json.Marshal(UploadResponse{Files: []string{file}})
+		if err != nil {
+			echo(Log{"t": "file_upload", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(res)
+	case http.MethodHead:
+		fs.head(w, r)
 	default:
 		echo(Log{"t": "file_upload", "method": r.Method, "path": r.URL.Path, "error": "method not allowed"})
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -0,0 +1,205 @@
+package wave
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Filter represents a request to limit the changes to a map buffer that are sent to a client
+// to those affecting specific records.
+type Filter struct {
+	route  string
+	client *Client
+	key    string   // buffer key
+	keys   []string // record keys; a trailing "*" matches keys by prefix; empty=remove filter
+}
+
+// KeyFilter represents the record keys of interest to a client, per map buffer.
+type KeyFilter map[string][]string // buffer key => record keys
+
+// set sets or removes the record keys of interest for the buffer at k.
+func (f KeyFilter) set(k string, keys []string) {
+	if len(keys) == 0 {
+		delete(f, k)
+		return
+	}
+	f[k] = keys
+}
+
+// matches reports whether any of the patterns matches the record key k.
+func matches(patterns []string, k string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(k, p[:len(p)-1]) {
+				return true
+			}
+		} else if p == k {
+			return true
+		}
+	}
+	return false
+}
+
+// record returns the keys of interest for the map buffer an op key addresses, and the record key it addresses, if any.
+func (f KeyFilter) record(k string) ([]string, string, bool) {
+	if patterns, ok := f[k]; ok {
+		return patterns, "", true
+	}
+	for bk, patterns := range f {
+		if strings.HasPrefix(k, bk+keySeparator) {
+			rk := k[len(bk)+1:]
+			if i := strings.Index(rk, keySeparator); i >= 0 { // field of record
+				rk = rk[:i]
+			}
+			return patterns, rk, true
+		}
+	}
+	return nil, "", false
+}
+
+// signature returns a string identifying the filter: filters with equal signatures filter alike.
+func (f KeyFilter) signature() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		for _, p := range f[k] {
+			sb.WriteByte(0)
+			sb.WriteString(p)
+		}
+		sb.WriteByte(1)
+	}
+	return sb.String()
+}
+
+// Filtered represents a message published to a route, decoded once for all filtered clients, along with the
+// results of filtering it, per distinct filter, so that clients with identical filters share the result.
+type Filtered struct {
+	data    []byte
+	seq     int64             // sequence number of the message, if recorded in the route's history; else 0
+	ops     *OpsD             // decoded changes; nil until decoded, or if the message holds no changes
+	decoded bool              // decoded yet?
+	results map[string][]byte // filter signature => filtered message
+}
+
+func newFiltered(data []byte, seq int64) *Filtered {
+	return &Filtered{data, seq, nil, false, make(map[string][]byte)}
+}
+
+// apply returns the message filtered for a client, with its sequence number, if any, or nil if none of the
+// changes are of interest.
+func (p *Filtered) apply(f KeyFilter) []byte {
+	if !p.decoded {
+		p.decoded = true
+		var ops OpsD
+		if err := json.Unmarshal(p.data, &ops); err == nil && len(ops.D) > 0 {
+			p.ops = &ops
+		}
+	}
+	sig := f.signature()
+	if data, ok := p.results[sig]; ok {
+		return data
+	}
+	data := p.data
+	if p.ops != nil {
+		data = f.apply(*p.ops, p.data)
+	}
+	if data != nil && p.seq > 0 {
+		data = withSeq(data, p.seq)
+	}
+	p.results[sig] = data
+	return data
+}
+
+// apply returns the changes in a message, decoded as ops, that affect records of interest, re-marshaled if
+// changed, or nil if none of the changes are of interest. The ops are not modified.
+func (f KeyFilter) apply(ops OpsD, data []byte) []byte {
+	changed := false
+	d := make([]OpD, 0, len(ops.D))
+	for _, op := range ops.D {
+		patterns, rk, ok := f.record(op.K)
+		if !ok {
+			d = append(d, op)
+			continue
+		}
+		if len(rk) > 0 { // record-level
+			if matches(patterns, rk) {
+				d = append(d, op)
+			} else {
+				changed = true
+			}
+			continue
+		}
+		switch { // buffer-level
+		case op.U != nil:
+			op.U = filterRecords(patterns, op.U)
+			changed = true
+			if len(op.U) == 0 {
+				continue
+			}
+		case op.M != nil:
+			op.M = filterMapBufD(patterns, op.M)
+			changed = true
+		case op.V != nil:
+			if xs, ok := op.V.(map[string]interface{}); ok {
+				op.V = filterRecords(patterns, xs)
+				changed = true
+			}
+		}
+		d = append(d, op)
+	}
+	if !changed {
+		return data
+	}
+	if len(d) == 0 {
+		return nil
+	}
+	ops.D = d
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return data
+	}
+	return b
+}
+
+func filterRecords(patterns []string, xs map[string]interface{}) map[string]interface{} {
+	ys := make(map[string]interface{})
+	for k, x := range xs {
+		if matches(patterns, k) {
+			ys[k] = x
+		}
+	}
+	return ys
+}
+
+func filterMapBufD(patterns []string, b *MapBufD) *MapBufD {
+	c := *b
+	if b.O == colsFormat {
+		c.K = nil
+		c.X = make([][]interface{}, len(b.X))
+		for i, k := range b.K {
+			if !matches(patterns, k) {
+				continue
+			}
+			c.K = append(c.K, k)
+			for j, col := range b.X {
+				if i < len(col) {
+					c.X[j] = append(c.X[j], col[i])
+				}
+			}
+		}
+		return &c
+	}
+	c.D = make(map[string][]interface{})
+	for k, tup := range b.D {
+		if matches(patterns, k) {
+			c.D[k] = tup
+		}
+	}
+	return &c
+}
@@ -0,0 +1,132 @@
+package wave
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	patterns := []string{"a", "b*"}
+	for _, tc := range []struct {
+		k    string
+		want bool
+	}{
+		{"a", true},
+		{"ab", false},
+		{"b", true},
+		{"bc", true},
+		{"c", false},
+		{"", false},
+	} {
+		if got := matches(patterns, tc.k); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.k, tc.want, got)
+		}
+	}
+}
+
+func TestKeyFilterApply(t *testing.T) {
+	f := KeyFilter{"c items": {"a", "b*"}}
+	for _, tc := range []struct {
+		name string
+		data string
+		want string // filtered; "" if none of interest, "=" if unchanged
+	}{
+		{"record", `{"d":[{"k":"c items a","v":[1]}]}`, `=`},
+		{"record by prefix", `{"d":[{"k":"c items bc","v":[1]}]}`, `=`},
+		{"field of record", `{"d":[{"k":"c items bc a","v":1}]}`, `=`},
+		{"other record", `{"d":[{"k":"c items x","v":[1]}]}`, ``},
+		{"other key", `{"d":[{"k":"c title","v":"x"},{"k":"c itemsx x","v":1}]}`, `=`},
+		{"some of interest", `{"d":[{"k":"d","v":1},{"k":"c items x","v":[1]}]}`, `{"d":[{"k":"d","v":1}]}`},
+		{"update", `{"d":[{"k":"c items","u":{"a":[1],"x":[2],"bb":[3]}}]}`, `{"d":[{"k":"c items","u":{"a":[1],"bb":[3]}}]}`},
+		{"update, none of interest", `{"d":[{"k":"c items","u":{"x":[2]}}]}`, ``},
+		{"buffer", `{"d":[{"k":"c items","m":{"f":["a"],"d":{"a":[1],"x":[2]}}}]}`, `{"d":[{"k":"c items","m":{"f":["a"],"d":{"a":[1]}}}]}`},
+		{"buffer, columnar", `{"d":[{"k":"c items","m":{"f":["a"],"d":null,"o":1,"k":["a","x","b1"],"x":[[1,2,3]]}}]}`, `{"d":[{"k":"c items","m":{"f":["a"],"d":null,"o":1,"k":["a","b1"],"x":[[1,3]]}}]}`},
+		{"records", `{"d":[{"k":"c items","v":{"a":[1],"x":[2]}}]}`, `{"d":[{"k":"c items","v":{"a":[1]}}]}`},
+	} {
+		var ops OpsD
+		if err := json.Unmarshal([]byte(tc.data), &ops); err != nil {
+			t.Fatal(err)
+		}
+		want := tc.want
+		if want == "=" {
+			want = tc.data
+		}
+		if got := string(f.apply(ops, []byte(tc.data))); got != want {
+			t.Errorf("%s: want %s, got %s", tc.name, want, got)
+		}
+	}
+}
+
+func TestKeyFilterSignature(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b KeyFilter
+		same bool
+	}{
+		{"equal", KeyFilter{"x": {"a"}, "y": {"b"}}, KeyFilter{"y": {"b"}, "x": {"a"}}, true},
+		{"other keys", KeyFilter{"x": {"a"}}, KeyFilter{"x": {"b"}}, false},
+		{"other buffer", KeyFilter{"x": {"a"}}, KeyFilter{"y": {"a"}}, false},
+		{"split", KeyFilter{"x": {"ab"}}, KeyFilter{"x": {"a", "b"}}, false},
+	} {
+		if same := tc.a.signature() == tc.b.signature(); same != tc.same {
+			t.Errorf("%s: want same=%v, got %v", tc.name, tc.same, same)
+		}
+	}
+}
+
+func TestFiltered(t *testing.T) {
+	p := newFiltered([]byte(`{"d":[{"k":"c items a","v":[1]},{"k":"c items x","v":[2]}]}`), 7)
+	a := p.apply(KeyFilter{"c items": {"a"}})
+	if string(a) != `{"q":7,"d":[{"k":"c items a","v":[1]}]}` {
+		t.Errorf("want record a, with sequence number, got %s", a)
+	}
+	if b := p.apply(KeyFilter{"c items": {"a"}}); &b[0] != &a[0] {
+		t.Error("want result shared between identical filters")
+	}
+	if b := p.apply(KeyFilter{"c items": {"z"}}); b != nil {
+		t.Errorf("want nothing of interest, got %s", b)
+	}
+	if b := newFiltered([]byte(`{"p":{}}`), 0).apply(KeyFilter{"c items": {"a"}}); string(b) != `{"p":{}}` {
+		t.Errorf("want messages other than changes passed through, got %s", b)
+	}
+}
+
+func TestBrokerFilter(t *testing.T) {
+	b := newTestBroker(nil)
+	mustPatch(t, b, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"m":{"f":["v"],"d":{}}}]}]}`)
+	all, some := newTestClient(b, "alice"), newTestClient(b, "bob")
+	all.subscribe("/p")
+	some.subscribe("/p")
+	some.filter("/p", []byte(`{"k":"c items","s":["a","b*"]}`))
+	b.sync()
+	for _, tc := range []struct {
+		name string
+		data string
+		want string // change received by filtered client; "" if none
+	}{
+		{"of interest", `{"d":[{"k":"c items bc","v":[1]}]}`, `{"d":[{"k":"c items bc","v":[1]}]}`},
+		{"not of interest", `{"d":[{"k":"c items x","v":[1]}]}`, ``},
+		{"some of interest", `{"d":[{"k":"c items","u":{"a":[2],"x":[3]}}]}`, `{"d":[{"k":"c items a","v":[2]}]}`}, // broadcast as record changes
+	} {
+		mustPatch(t, b, "/p", tc.data)
+		recv(t, all) // any change
+		if tc.want == "" {
+			b.sync()
+			select {
+			case data := <-some.data:
+				t.Errorf("%s: want nothing, got %s", tc.name, data)
+			default:
+			}
+			continue
+		}
+		if got := toJSON(t, recv(t, some)); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+	some.filter("/p", []byte(`{"k":"c items"}`)) // remove
+	b.sync()
+	mustPatch(t, b, "/p", `{"d":[{"k":"c items x","v":[4]}]}`)
+	if got := toJSON(t, recv(t, some)); got != `{"d":[{"k":"c items x","v":[4]}]}` {
+		t.Errorf("want all changes once filter removed, got %s", got)
+	}
+}
@@ -4,12 +4,14 @@ import "strconv"
 
 // FixBuf represents a fixed-sized buffer.
 type FixBuf struct {
-	t    Typ
-	tups [][]interface{}
+	t     Typ
+	tups  [][]interface{}
+	cols  bool  // dump column-wise?
+	bytes int64 // approximate memory used by tuples
 }
 
 func newFixBuf(t Typ, n int) *FixBuf {
-	return &FixBuf{t, make([][]interface{}, n)}
+	return &FixBuf{t, make([][]interface{}, n), false, 0}
 }
 
 func (b *FixBuf) put(ixs interface{}) {
@@ -22,6 +24,23 @@ func (b *FixBuf) put(ixs interface{}) {
 	}
 }
 
+// appendAll writes tuples to the empty slots, in order, starting from the first empty slot, and returns the indices
+// written. Tuples that do not match the buffer's type are skipped; tuples that do not fit are discarded.
+func (b *FixBuf) appendAll(xs [][]interface{}) []int {
+	var written []int
+	for _, x := range xs {
+		if _, ok := b.t.match(x); !ok {
+			continue
+		}
+		i := b.append(x)
+		if i < 0 {
+			break
+		}
+		written = append(written, i)
+	}
+	return written
+}
+
 func (b *FixBuf) set(k string, v interface{}) {
 	if i, err := strconv.Atoi(k); err == nil {
 		b.seti(i, v)
@@ -29,15 +48,75 @@ func (b *FixBuf) set(k string, v interface{}) {
 }
 
 func (b *FixBuf) seti(i int, v interface{}) {
+	i = b.norm(i)
 	if i >= 0 && i < len(b.tups) {
 		if v == nil {
-			b.tups[i] = nil
+			b.write(i, nil)
 		} else if tup, ok := b.t.match(v); ok {
-			b.tups[i] = tup
+			b.write(i, tup)
 		}
 	}
 }
 
+// write stores a tuple at index i, accounting for the memory used.
+func (b *FixBuf) write(i int, tup []interface{}) {
+	b.bytes += tupSize(tup) - tupSize(b.tups[i])
+	b.tups[i] = tup
+}
+
+func (b *FixBuf) size() int64 {
+	return int64(len(b.tups))*sliceSize + b.bytes
+}
+
+// clear empties every slot.
+func (b *FixBuf) clear() {
+	for i := range b.tups {
+		b.tups[i] = nil
+	}
+	b.bytes = 0
+}
+
+// fill writes copies of a tuple, already matched to the buffer's type, to every slot.
+// Copies are deep, so that nested values are not shared between slots.
+func (b *FixBuf) fill(tup []interface{}) {
+	for i := range b.tups {
+		b.write(i, deepClone(tup).([]interface{}))
+	}
+}
+
+// append writes a tuple to the first empty slot and returns its index, or -1 if the buffer is full.
+func (b *FixBuf) append(v interface{}) int {
+	tup, ok := b.t.match(v)
+	if !ok {
+		return -1
+	}
+	for i, x := range b.tups {
+		if x == nil {
+			b.write(i, tup)
+			return i
+		}
+	}
+	return -1
+}
+
+// insert writes a tuple at index i, shifting subsequent tuples down; the last tuple is dropped.
+// Negative indices count from the end. It reports whether the tuple was inserted.
+func (b *FixBuf) insert(i int, v interface{}) bool {
+	i = b.norm(i)
+	if i < 0 || i >= len(b.tups) {
+		return false
+	}
+	tup, ok := b.t.match(v)
+	if !ok {
+		return false
+	}
+	b.bytes -= tupSize(b.tups[len(b.tups)-1])
+	copy(b.tups[i+1:], b.tups[i:])
+	b.tups[i] = nil
+	b.write(i, tup)
+	return true
+}
+
 func (b *FixBuf) get(k string) (Cur, bool) {
 	if i, err := strconv.Atoi(k); err == nil {
 		return b.geti(i)
@@ -46,24 +125,43 @@ func (b *FixBuf) get(k string) (Cur, bool) {
 }
 
 func (b *FixBuf) geti(i int) (Cur, bool) {
+	i = b.norm(i)
 	if i >= 0 && i < len(b.tups) {
 		return Cur{b.t, b.tups[i]}, true
 	}
 	return Cur{}, false
 }
 
+// norm converts a negative (from-the-end) index to its positive equivalent.
+func (b *FixBuf) norm(i int) int {
+	if i < 0 {
+		return len(b.tups) + i
+	}
+	return i
+}
+
 func (b *FixBuf) dump() BufD {
-	return BufD{F: &FixBufD{b.t.f, b.tups, len(b.tups)}}
+	d := &FixBufD{F: b.t.f, N: len(b.tups), S: b.t.s}
+	if b.cols {
+		d.O, d.X = colsFormat, toCols(len(b.t.f), b.tups)
+	} else {
+		d.D = b.tups
+	}
+	return BufD{F: d}
 }
 
 func loadFixBuf(ns *Namespace, b *FixBufD) *FixBuf {
-	t := ns.make(b.F)
-	if len(b.D) == 0 {
+	t := ns.make(fieldsOf(b.F, b.S))
+	tups := b.D
+	if b.X != nil {
+		tups = fromCols(b.X)
+	}
+	if len(tups) == 0 {
 		n := b.N
 		if n <= 0 {
 			n = 10
 		}
-		return newFixBuf(t, n)
+		tups = make([][]interface{}, n)
 	}
-	return &FixBuf{t, b.D}
+	return &FixBuf{t, tups, b.O == colsFormat, tupsSize(tups)}
 }
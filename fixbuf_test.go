@@ -0,0 +1,137 @@
+package wave
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func newTestFixBuf(n int, xs ...interface{}) *FixBuf {
+	b := newFixBuf(newNamespace().make([]string{"a"}), n)
+	for i, x := range xs {
+		if x != nil {
+			b.write(i, []interface{}{x})
+		}
+	}
+	return b
+}
+
+func slotsOf(xs ...interface{}) [][]interface{} {
+	tups := make([][]interface{}, len(xs))
+	for i, x := range xs {
+		if x != nil {
+			tups[i] = []interface{}{x}
+		}
+	}
+	return tups
+}
+
+func TestFixBufAppend(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		b     *FixBuf
+		v     interface{}
+		i     int
+		slots [][]interface{}
+	}{
+		{"empty", newTestFixBuf(2), []interface{}{1.0}, 0, slotsOf(1.0, nil)},
+		{"first empty slot", newTestFixBuf(3, 1.0, nil, 3.0), []interface{}{2.0}, 1, slotsOf(1.0, 2.0, 3.0)},
+		{"full", newTestFixBuf(2, 1.0, 2.0), []interface{}{3.0}, -1, slotsOf(1.0, 2.0)},
+		{"mismatch", newTestFixBuf(2), []interface{}{1.0, 2.0}, -1, slotsOf(nil, nil)},
+	} {
+		if i := tc.b.append(tc.v); i != tc.i {
+			t.Errorf("%s: want index %d, got %d", tc.name, tc.i, i)
+		}
+		if !reflect.DeepEqual(tc.b.tups, tc.slots) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.slots, tc.b.tups)
+		}
+		if tc.b.bytes != tupsSize(tc.b.tups) {
+			t.Errorf("%s: want %d bytes, got %d", tc.name, tupsSize(tc.b.tups), tc.b.bytes)
+		}
+	}
+}
+
+func TestFixBufAppendAll(t *testing.T) {
+	b := newTestFixBuf(4, nil, 2.0)
+	written := b.appendAll([][]interface{}{{1.0}, {"x", "y"}, {3.0}, {4.0}, {5.0}})
+	if want := []int{0, 2, 3}; !reflect.DeepEqual(written, want) {
+		t.Errorf("want written %v, got %v", want, written)
+	}
+	if want := slotsOf(1.0, 2.0, 3.0, 4.0); !reflect.DeepEqual(b.tups, want) {
+		t.Errorf("want %v, got %v", want, b.tups)
+	}
+}
+
+func TestFixBufInsert(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		b     *FixBuf
+		i     int
+		ok    bool
+		slots [][]interface{}
+	}{
+		{"front, drops last", newTestFixBuf(3, 1.0, 2.0, 3.0), 0, true, slotsOf(9.0, 1.0, 2.0)},
+		{"middle", newTestFixBuf(3, 1.0, 2.0, nil), 1, true, slotsOf(1.0, 9.0, 2.0)},
+		{"last", newTestFixBuf(3, 1.0, 2.0, 3.0), 2, true, slotsOf(1.0, 2.0, 9.0)},
+		{"from end", newTestFixBuf(3, 1.0, 2.0, 3.0), -2, true, slotsOf(1.0, 9.0, 2.0)},
+		{"out of range", newTestFixBuf(3, 1.0, 2.0, 3.0), 3, false, slotsOf(1.0, 2.0, 3.0)},
+	} {
+		if ok := tc.b.insert(tc.i, []interface{}{9.0}); ok != tc.ok {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.ok, ok)
+		}
+		if !reflect.DeepEqual(tc.b.tups, tc.slots) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.slots, tc.b.tups)
+		}
+		if tc.b.bytes != tupsSize(tc.b.tups) {
+			t.Errorf("%s: want %d bytes, got %d", tc.name, tupsSize(tc.b.tups), tc.b.bytes)
+		}
+	}
+}
+
+func TestFixBufDumpShape(t *testing.T) {
+	b := newTestFixBuf(3, 1.0)
+	b.append([]interface{}{2.0})
+	b.insert(0, []interface{}{0.0})
+	data, err := json.Marshal(b.dump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"f":{"f":["a"],"d":[[0],[1],[2]],"n":3}}`; string(data) != want {
+		t.Errorf("want %s, got %s", want, data)
+	}
+}
+
+func TestFixBufNegativeIndex(t *testing.T) {
+	for _, tc := range []struct {
+		k    string
+		want interface{} // value of field a; nil if out of range
+		ok   bool
+	}{
+		{"0", 1.0, true},
+		{"2", 3.0, true},
+		{"-1", 3.0, true},
+		{"-3", 1.0, true},
+		{"3", nil, false},
+		{"-4", nil, false},
+		{"x", nil, false},
+	} {
+		b := newTestFixBuf(3, 1.0, 2.0, 3.0)
+		c, ok := b.get(tc.k)
+		if ok != tc.ok {
+			t.Errorf("get %s: want %v, got %v", tc.k, tc.ok, ok)
+			continue
+		}
+		if ok && c.get("a") != tc.want {
+			t.Errorf("get %s: want %v, got %v", tc.k, tc.want, c.get("a"))
+		}
+
+		b.set(tc.k, []interface{}{9.0})
+		if ok {
+			if c, _ := b.get(tc.k); c.get("a") != 9.0 {
+				t.Errorf("set %s: want 9, got %v", tc.k, c.get("a"))
+			}
+		} else if want := slotsOf(1.0, 2.0, 3.0); !reflect.DeepEqual(b.tups, want) {
+			t.Errorf("set %s: want unchanged, got %v", tc.k, b.tups)
+		}
+	}
+}
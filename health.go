@@ -0,0 +1,52 @@
+package wave
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Health represents the server's readiness to serve requests.
+type Health struct {
+	ready int32 // atomic; 1 if started up and not shutting down
+}
+
+func (h *Health) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&h.ready, v)
+}
+
+func (h *Health) isReady() bool {
+	return atomic.LoadInt32(&h.ready) == 1
+}
+
+// HealthHandler is a HTTP handler for health checks.
+type HealthHandler struct {
+	health    *Health
+	readiness bool // check readiness? else, liveness
+}
+
+func newLivenessHandler(health *Health) *HealthHandler {
+	return &HealthHandler{health, false}
+}
+
+func newReadinessHandler(health *Health) *HealthHandler {
+	return &HealthHandler{health, true}
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if h.readiness && !h.health.isReady() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,85 @@
+package wave
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ready  bool
+		live   int // liveness status
+		readyz int // readiness status
+	}{
+		{"starting up", false, http.StatusOK, http.StatusServiceUnavailable},
+		{"ready", true, http.StatusOK, http.StatusOK},
+	} {
+		health := &Health{}
+		health.setReady(tc.ready)
+		for _, h := range []struct {
+			handler http.Handler
+			status  int
+		}{
+			{newLivenessHandler(health), tc.live},
+			{newReadinessHandler(health), tc.readyz},
+		} {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				w := httptest.NewRecorder()
+				h.handler.ServeHTTP(w, httptest.NewRequest(method, "/_health", nil))
+				if w.Code != h.status {
+					t.Errorf("%s, %s: want status %d, got %d", tc.name, method, h.status, w.Code)
+				}
+				if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+					t.Errorf("%s, %s: want no-store, got %q", tc.name, method, cc)
+				}
+			}
+			w := httptest.NewRecorder()
+			h.handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/_health", nil))
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s, POST: want status %d, got %d", tc.name, http.StatusMethodNotAllowed, w.Code)
+			}
+		}
+	}
+}
+
+func TestShutdownReadiness(t *testing.T) {
+	health := &Health{}
+	health.setReady(true)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newReadinessHandler(health)}
+	go server.Serve(l)
+	url := "http://" + l.Addr().String()
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(server, health, newTestBroker(nil), newSite(), ServerConf{ReadinessDelay: 200 * time.Millisecond, DrainTimeout: time.Second})
+		close(done)
+	}()
+	for health.isReady() {
+		time.Sleep(time.Millisecond)
+	}
+	// Still served during the readiness delay, but reported as not ready.
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("want readiness served during readiness delay, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want not ready during shutdown, got %d", resp.StatusCode)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("want listener closed once shut down")
+	}
+}
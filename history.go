@@ -0,0 +1,57 @@
+package wave
+
+import (
+	"strconv"
+	"time"
+)
+
+// History represents a bounded sequence of recent messages published to a route, for replaying to reconnecting clients.
+type History struct {
+	seq  int64    // sequence number of the most recent message
+	msgs [][]byte // ring of recent messages; message seq is at seq % len(msgs)
+	n    int      // number of messages held
+}
+
+func newHistory(size int) *History {
+	// Start from a time-based sequence number, so that sequence numbers presented by clients
+	// from before a restart are treated as stale instead of being replayed against the wrong messages.
+	// Milliseconds * 1000 stays well within the range of integers exactly representable in Javascript.
+	return &History{seq: time.Now().UnixNano() / int64(time.Millisecond) * 1000, msgs: make([][]byte, size)}
+}
+
+// add records a message, and returns the message annotated with its sequence number.
+func (h *History) add(data []byte) []byte {
+	h.seq++
+	data = withSeq(data, h.seq)
+	h.msgs[h.seq%int64(len(h.msgs))] = data
+	if h.n < len(h.msgs) {
+		h.n++
+	}
+	return data
+}
+
+// since returns the messages published after seq, or false if any of them are no longer held.
+func (h *History) since(seq int64) ([][]byte, bool) {
+	if seq > h.seq || h.seq-seq > int64(h.n) {
+		return nil, false
+	}
+	msgs := make([][]byte, 0, h.seq-seq)
+	for i := seq + 1; i <= h.seq; i++ {
+		msgs = append(msgs, h.msgs[i%int64(len(h.msgs))])
+	}
+	return msgs, true
+}
+
+// withSeq annotates a JSON object with a sequence number ("q").
+func withSeq(data []byte, seq int64) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	buf := make([]byte, 0, len(data)+24)
+	buf = append(buf, `{"q":`...)
+	buf = strconv.AppendInt(buf, seq, 10)
+	if len(data) > 2 {
+		buf = append(buf, ',')
+	}
+	return append(buf, data[1:]...)
+}
@@ -0,0 +1,63 @@
+package wave
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	start := h.seq
+	for i := 1; i <= 5; i++ {
+		if got, want := string(h.add([]byte(`{"m":`+strconv.Itoa(i)+`}`))), `{"q":`+strconv.FormatInt(start+int64(i), 10)+`,"m":`+strconv.Itoa(i)+`}`; got != want {
+			t.Fatalf("want %s, got %s", want, got)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		seq  int64 // relative to the first sequence number
+		want []string
+		ok   bool
+	}{
+		{"up to date", 5, []string{}, true},
+		{"one behind", 4, []string{"5"}, true},
+		{"all held", 2, []string{"3", "4", "5"}, true},
+		{"no longer held", 1, nil, false},
+		{"from before restart", -100, nil, false},
+		{"ahead", 6, nil, false},
+	} {
+		msgs, ok := h.since(start + tc.seq)
+		if ok != tc.ok {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, ok)
+			continue
+		}
+		got := make([]string, len(msgs))
+		for i, msg := range msgs {
+			got[i] = string(msg)
+		}
+		want := make([]string, len(tc.want))
+		for i, m := range tc.want {
+			n, _ := strconv.Atoi(m)
+			want[i] = `{"q":` + strconv.FormatInt(start+int64(n), 10) + `,"m":` + m + `}`
+		}
+		if ok && toJSON(t, got) != toJSON(t, want) {
+			t.Errorf("%s: want %v, got %v", tc.name, want, got)
+		}
+	}
+}
+
+func TestWithSeq(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{`{"d":[]}`, `{"q":7,"d":[]}`},
+		{`{}`, `{"q":7}`},
+		{`[]`, `[]`},
+		{``, ``},
+	} {
+		if got := string(withSeq([]byte(tc.data), 7)); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.data, tc.want, got)
+		}
+	}
+}
@@ -1,50 +1,420 @@
 package wave
 
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Number of records examined for expiry on each write, if the buffer has a TTL.
+const mapBufExpirySample = 16
+
+// Go maps do not shrink when entries are deleted, so buffers are compacted automatically once the number of records
+// falls below this fraction of the most held since the last compaction, if that is at least mapBufCompactMin.
+const (
+	mapBufCompactRatio = 0.25
+	mapBufCompactMin   = 4096
+)
+
+// Sort orders for dumping MapBuf records.
+const (
+	insertionOrder = ""  // order in which keys were first set
+	keyOrder       = "*" // lexicographic, by key
+	// any other value: ascending, by the named numeric field
+)
+
 // MapBuf represents a map (dictionary) buffer.
 type MapBuf struct {
-	t    Typ
-	tups map[string][]interface{}
+	t     Typ
+	tups  map[string][]interface{}
+	cols  bool                 // dump column-wise?
+	ttl   time.Duration        // time-to-live for records; 0=forever
+	ts    map[string]time.Time // key => last set time, if ttl > 0
+	order string               // sort order for dumps
+	ins   map[string]uint64    // key => insertion sequence
+	n     uint64               // last insertion sequence
+	bytes int64                // approximate memory used by keys and tuples
+	peak  int                  // most records held since the last compaction
 }
 
 func newMapBuf(t Typ) *MapBuf {
-	return &MapBuf{t, make(map[string][]interface{})}
+	return &MapBuf{t, make(map[string][]interface{}), false, 0, nil, insertionOrder, make(map[string]uint64), 0, 0, 0}
 }
 
 func (b *MapBuf) put(ixs interface{}) {
 	if xs, ok := ixs.(map[string]interface{}); ok {
-		tups := make(map[string][]interface{})
-		for k, x := range xs {
-			if tup, ok := b.t.match(x); ok {
-				tups[k] = tup
+		b.tups = make(map[string][]interface{})
+		b.ins = make(map[string]uint64)
+		b.bytes = 0
+		if b.ttl > 0 {
+			b.ts = make(map[string]time.Time)
+		}
+		for _, k := range sortedKeys(xs) { // map order is random; insert in a stable order.
+			if tup, ok := b.t.match(xs[k]); ok {
+				b.store(k, tup)
 			}
 		}
-		b.tups = tups
 	}
 }
 
+func sortedKeys(xs map[string]interface{}) []string {
+	keys := make([]string, 0, len(xs))
+	for k := range xs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setAll sets multiple records, and returns the keys of records set or deleted, and the keys of records
+// that did not match the buffer's type, in order.
+func (b *MapBuf) setAll(xs map[string]interface{}) ([]string, []string) {
+	var set, rejected []string
+	for _, k := range sortedKeys(xs) {
+		x := xs[k]
+		if x == nil {
+			b.del(k)
+			set = append(set, k)
+			continue
+		}
+		tup, ok := b.t.match(x)
+		if !ok {
+			rejected = append(rejected, k)
+			continue
+		}
+		b.store(k, tup)
+		set = append(set, k)
+	}
+	return set, rejected
+}
+
 func (b *MapBuf) set(k string, v interface{}) {
 	if v == nil {
-		delete(b.tups, k)
+		b.del(k)
 	} else if tup, ok := b.t.match(v); ok {
-		b.tups[k] = tup
+		b.store(k, tup)
 	}
 }
 
-func (b *MapBuf) get(k string) (Cur, bool) {
+// swap sets the record at key k to v only if its current value equals expected, or, if expected is nil,
+// only if there is no record at k; it returns the record as stored, and reports whether the record was set.
+func (b *MapBuf) swap(k string, expected, v interface{}) ([]interface{}, bool) {
+	cur, found := b.get(k)
+	if expected == nil {
+		if found {
+			return nil, false
+		}
+	} else {
+		if !found {
+			return nil, false
+		}
+		want, ok := b.t.match(expected)
+		if !ok {
+			return nil, false
+		}
+		if have, ok := b.t.match(cur.tup); !ok || !reflect.DeepEqual(have, want) { // loaded records may lack defaults
+			return nil, false
+		}
+	}
+	tup, ok := b.t.match(v)
+	if !ok {
+		return nil, false
+	}
+	b.store(k, tup)
+	return tup, true
+}
+
+func (b *MapBuf) store(k string, tup []interface{}) {
+	if old, ok := b.tups[k]; ok {
+		b.bytes -= tupSize(old)
+	} else {
+		b.bytes += recordSize(k)
+	}
+	b.bytes += tupSize(tup)
+	b.tups[k] = tup
+	if len(b.tups) > b.peak {
+		b.peak = len(b.tups)
+	}
+	if _, ok := b.ins[k]; !ok {
+		b.n++
+		b.ins[k] = b.n
+	}
+	if b.ttl > 0 {
+		b.ts[k] = time.Now()
+		b.expire(mapBufExpirySample)
+	}
+}
+
+func (b *MapBuf) del(k string) {
 	if tup, ok := b.tups[k]; ok {
+		b.bytes -= recordSize(k) + tupSize(tup)
+	}
+	delete(b.tups, k)
+	delete(b.ins, k)
+	if b.ts != nil {
+		delete(b.ts, k)
+	}
+	if b.peak >= mapBufCompactMin && float64(len(b.tups)) < mapBufCompactRatio*float64(b.peak) {
+		b.compact()
+	}
+}
+
+// compact rebuilds the buffer's maps from its unexpired records, releasing memory held by deleted records,
+// and returns the number of records retained. The new maps are built alongside the old ones, then swapped in.
+func (b *MapBuf) compact() int {
+	tups := make(map[string][]interface{}, len(b.tups))
+	ins := make(map[string]uint64, len(b.tups))
+	var ts map[string]time.Time
+	if b.ts != nil {
+		ts = make(map[string]time.Time, len(b.ts))
+	}
+	var bytes int64
+	for k, tup := range b.tups {
+		if b.expired(k) {
+			continue
+		}
+		tups[k], ins[k] = tup, b.ins[k]
+		if ts != nil {
+			ts[k] = b.ts[k]
+		}
+		bytes += recordSize(k) + tupSize(tup)
+	}
+	b.tups, b.ins, b.ts, b.bytes, b.peak = tups, ins, ts, bytes, len(tups)
+	return len(tups)
+}
+
+// recordSize returns the approximate memory used to hold the key and bookkeeping for a record, excluding the tuple.
+func recordSize(k string) int64 {
+	return 2*(stringSize+int64(len(k))) + 8 // tups, ins
+}
+
+func (b *MapBuf) size() int64 {
+	return mapSize + b.bytes
+}
+
+// expired reports whether the record at key k has outlived the buffer's TTL.
+// time.Since uses the monotonic clock, so wall clock changes do not affect expiry.
+func (b *MapBuf) expired(k string) bool {
+	if b.ttl <= 0 {
+		return false
+	}
+	t, ok := b.ts[k]
+	return ok && time.Since(t) > b.ttl
+}
+
+// expire examines up to n records, deleting expired ones.
+// Map iteration order is random, so each call samples a different set of records,
+// keeping the cost of each write bounded regardless of buffer size.
+func (b *MapBuf) expire(n int) {
+	for k := range b.ts {
+		if n <= 0 {
+			return
+		}
+		if b.expired(k) {
+			b.del(k)
+		}
+		n--
+	}
+}
+
+// keys returns the keys of the records that have not expired, in the buffer's sort order.
+// Ties are broken by key, so that the same records are always ordered the same way.
+func (b *MapBuf) keys() []string {
+	keys := make([]string, 0, len(b.tups))
+	for k := range b.tups {
+		if !b.expired(k) {
+			keys = append(keys, k)
+		}
+	}
+	switch b.order {
+	case insertionOrder:
+		sort.Slice(keys, func(i, j int) bool { return b.ins[keys[i]] < b.ins[keys[j]] })
+	case keyOrder:
+		sort.Strings(keys)
+	default:
+		f, ok := b.t.offset(b.order)
+		if !ok {
+			sort.Strings(keys)
+			break
+		}
+		num := func(k string) (float64, bool) {
+			x, err := Cur{b.t, b.tups[k]}.Float(f)
+			return x, err == nil
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			x, xok := num(keys[i])
+			y, yok := num(keys[j])
+			if xok && yok && x != y {
+				return x < y
+			}
+			if xok != yok { // non-numeric values last
+				return xok
+			}
+			return keys[i] < keys[j]
+		})
+	}
+	return keys
+}
+
+// live returns the records that have not expired.
+func (b *MapBuf) live() map[string][]interface{} {
+	if b.ttl <= 0 {
+		return b.tups
+	}
+	tups := make(map[string][]interface{}, len(b.tups))
+	for k, tup := range b.tups {
+		if !b.expired(k) {
+			tups[k] = tup
+		}
+	}
+	return tups
+}
+
+// deletePrefix deletes all records whose keys start with prefix, and returns the keys deleted, sorted.
+func (b *MapBuf) deletePrefix(prefix string) []string {
+	var deleted []string
+	for k := range b.tups {
+		if strings.HasPrefix(k, prefix) {
+			deleted = append(deleted, k)
+		}
+	}
+	sort.Strings(deleted)
+	for _, k := range deleted {
+		b.del(k)
+	}
+	return deleted
+}
+
+// deleteMatch deletes all records whose keys match the glob pattern, and returns the keys deleted, sorted.
+// The pattern syntax is the same as path.Match.
+func (b *MapBuf) deleteMatch(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for k := range b.tups {
+		if ok, _ := path.Match(pattern, k); ok {
+			deleted = append(deleted, k)
+		}
+	}
+	sort.Strings(deleted)
+	for _, k := range deleted {
+		b.del(k)
+	}
+	return deleted, nil
+}
+
+// check verifies that a delete operation has a key prefix or a well-formed pattern.
+func (d *DeleteD) check() error {
+	if len(d.P) > 0 {
+		return nil
+	}
+	if len(d.G) == 0 {
+		return fmt.Errorf("want key prefix or pattern")
+	}
+	_, err := path.Match(d.G, "")
+	return err
+}
+
+// get returns a cursor for the record at key k, and whether the record was found.
+// Expired records are reported as missing, but not deleted, so that get is safe to call under a read lock;
+// they are deleted by writes instead.
+func (b *MapBuf) get(k string) (Cur, bool) {
+	if tup, ok := b.tups[k]; ok && !b.expired(k) {
 		return Cur{b.t, tup}, true
 	}
 	return Cur{}, false
 }
 
+// getAll returns cursors for records at keys, and whether each record was found.
+// Expired records are reported as missing, but not deleted, so that getAll is safe to call under a read lock.
+func (b *MapBuf) getAll(keys []string) ([]Cur, []bool) {
+	curs, found := make([]Cur, len(keys)), make([]bool, len(keys))
+	for i, k := range keys {
+		if tup, ok := b.tups[k]; ok && !b.expired(k) {
+			curs[i], found[i] = Cur{b.t, tup}, true
+		}
+	}
+	return curs, found
+}
+
+// records returns the tuples of unexpired records, in no particular order.
+func (b *MapBuf) records() [][]interface{} {
+	tups := make([][]interface{}, 0, len(b.tups))
+	for k, tup := range b.tups {
+		if !b.expired(k) {
+			tups = append(tups, tup)
+		}
+	}
+	return tups
+}
+
 func (b *MapBuf) dump() BufD {
-	return BufD{M: &MapBufD{b.t.f, b.tups}}
+	d := &MapBufD{F: b.t.f, S: b.t.s, T: int(b.ttl / time.Second), Y: b.order}
+	keys := b.keys()
+	if b.cols {
+		tups := make([][]interface{}, len(keys))
+		for i, k := range keys {
+			tups[i] = b.tups[k]
+		}
+		d.O, d.K, d.X = colsFormat, keys, toCols(len(b.t.f), tups)
+	} else {
+		d.D, d.K = b.live(), keys
+	}
+	return BufD{M: d}
 }
 
 func loadMapBuf(ns *Namespace, b *MapBufD) *MapBuf {
-	t := ns.make(b.F)
-	if b.D == nil {
-		return newMapBuf(t)
+	t := ns.make(fieldsOf(b.F, b.S))
+	cols := b.O == colsFormat
+	tups := b.D
+	if b.X != nil {
+		tups = make(map[string][]interface{})
+		for i, tup := range fromCols(b.X) {
+			if i < len(b.K) && tup != nil {
+				tups[b.K[i]] = tup
+			}
+		}
+	}
+	if tups == nil {
+		tups = make(map[string][]interface{})
+	}
+	var ts map[string]time.Time
+	ttl := time.Duration(b.T) * time.Second
+	if ttl > 0 {
+		now := time.Now()
+		ts = make(map[string]time.Time, len(tups))
+		for k := range tups {
+			ts[k] = now
+		}
+	}
+	// Restore insertion order from the dumped key order, if any; remaining keys follow in lexicographic order.
+	ins, n := make(map[string]uint64, len(tups)), uint64(0)
+	for _, k := range b.K {
+		if _, ok := tups[k]; ok {
+			if _, ok := ins[k]; !ok {
+				n++
+				ins[k] = n
+			}
+		}
+	}
+	rest := make([]string, 0, len(tups)-len(ins))
+	for k := range tups {
+		if _, ok := ins[k]; !ok {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		n++
+		ins[k] = n
+	}
+	var bytes int64
+	for k, tup := range tups {
+		bytes += recordSize(k) + tupSize(tup)
 	}
-	return &MapBuf{t, b.D}
+	return &MapBuf{t, tups, cols, ttl, ts, b.Y, ins, n, bytes, len(tups)}
 }
@@ -0,0 +1,227 @@
+package wave
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestMapBuf(keys ...string) *MapBuf {
+	b := newMapBuf(newNamespace().make([]string{"a"}))
+	for i, k := range keys {
+		b.set(k, []interface{}{float64(i)})
+	}
+	return b
+}
+
+func TestMapBufDeleteKeys(t *testing.T) {
+	keys := []string{"user:1", "user:2", "user:10", "group:1", "usr"}
+	for _, tc := range []struct {
+		name    string
+		d       DeleteD
+		deleted []string
+		kept    []string
+		err     bool
+	}{
+		{"prefix", DeleteD{P: "user:"}, []string{"user:1", "user:10", "user:2"}, []string{"group:1", "usr"}, false},
+		{"prefix, no match", DeleteD{P: "x"}, nil, keys, false},
+		{"glob", DeleteD{G: "user:?"}, []string{"user:1", "user:2"}, []string{"user:10", "group:1", "usr"}, false},
+		{"glob, all", DeleteD{G: "*"}, []string{"group:1", "user:1", "user:10", "user:2", "usr"}, nil, false},
+		{"glob, class", DeleteD{G: "*:[12]"}, []string{"group:1", "user:1", "user:2"}, []string{"user:10", "usr"}, false},
+		{"bad pattern", DeleteD{G: "user:["}, nil, keys, true},
+		{"neither", DeleteD{}, nil, keys, true},
+	} {
+		p := newPage()
+		p.cards["c"] = &Card{map[string]interface{}{"items": newTestMapBuf(keys...)}}
+		changes, err := p.deleteKeys("c items", &tc.d)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: want error", tc.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: want no error, got %v", tc.name, err)
+		}
+		var deleted []string
+		for _, c := range changes {
+			if c.V != nil {
+				t.Errorf("%s: want deletion, got %v", tc.name, c.V)
+			}
+			deleted = append(deleted, c.K[len("c items "):])
+		}
+		if !reflect.DeepEqual(deleted, tc.deleted) {
+			t.Errorf("%s: want deleted %v, got %v", tc.name, tc.deleted, deleted)
+		}
+		// Dumps hold the remaining records only, in insertion order.
+		d := p.at("c items").(*MapBuf).dump().M
+		if len(d.D) != len(tc.kept) {
+			t.Errorf("%s: want %d records, got %v", tc.name, len(tc.kept), d.D)
+		}
+		if !reflect.DeepEqual(d.K, tc.kept) && !(len(d.K) == 0 && len(tc.kept) == 0) {
+			t.Errorf("%s: want keys %v, got %v", tc.name, tc.kept, d.K)
+		}
+	}
+}
+
+func TestMapBufDeleteKeysNotMap(t *testing.T) {
+	p := newPage()
+	p.cards["c"] = &Card{map[string]interface{}{"items": newTestCycBuf(2)}}
+	if _, err := p.deleteKeys("c items", &DeleteD{P: "x"}); err == nil {
+		t.Error("want error for cyclic buffer")
+	}
+}
+
+func newTestTTLMapBuf(ages map[string]time.Duration) *MapBuf {
+	tups := make(map[string][]interface{})
+	for k := range ages {
+		tups[k] = []interface{}{k}
+	}
+	b := loadMapBuf(newNamespace(), &MapBufD{F: []string{"a"}, D: tups, T: 60})
+	for k, age := range ages {
+		b.ts[k] = time.Now().Add(-age)
+	}
+	return b
+}
+
+func TestMapBufTTL(t *testing.T) {
+	ages := map[string]time.Duration{"old": time.Hour, "new": time.Second}
+	for _, tc := range []struct {
+		name string
+		f    func(b *MapBuf)
+		live []string
+		held int // records held, including expired records not yet deleted
+	}{
+		{"reads skip expired", func(b *MapBuf) {}, []string{"new"}, 2},
+		{"writes delete expired", func(b *MapBuf) { b.set("x", []interface{}{"x"}) }, []string{"new", "x"}, 2},
+		{"writes refresh", func(b *MapBuf) { b.set("old", []interface{}{"y"}) }, []string{"new", "old"}, 2},
+		{"expire", func(b *MapBuf) { b.expire(len(ages)) }, []string{"new"}, 1},
+		{"compact", func(b *MapBuf) { b.compact() }, []string{"new"}, 1},
+	} {
+		b := newTestTTLMapBuf(ages)
+		tc.f(b)
+		if got := b.keys(); !reflect.DeepEqual(got, tc.live) {
+			t.Errorf("%s: want keys %v, got %v", tc.name, tc.live, got)
+		}
+		if len(b.live()) != len(tc.live) || len(b.records()) != len(tc.live) {
+			t.Errorf("%s: want %d records live", tc.name, len(tc.live))
+		}
+		for k := range ages {
+			_, ok := b.get(k)
+			if want := contains(tc.live, k); ok != want {
+				t.Errorf("%s: want get %s found=%v, got %v", tc.name, k, want, ok)
+			}
+		}
+		if len(b.tups) != tc.held {
+			t.Errorf("%s: want %d records held, got %d", tc.name, tc.held, len(b.tups))
+		}
+		if d := b.dump().M; d.T != 60 || len(d.D) != len(tc.live) {
+			t.Errorf("%s: want dump of live records with ttl, got %v", tc.name, d)
+		}
+	}
+}
+
+func contains(xs []string, x string) bool {
+	for _, y := range xs {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMapBufOrder(t *testing.T) {
+	// Records set, in order; nil deletes.
+	sets := []struct {
+		k string
+		v interface{}
+	}{
+		{"b", []interface{}{3.0, "x"}},
+		{"c", []interface{}{1.0, "y"}},
+		{"a", []interface{}{"n/a", "z"}},
+		{"d", []interface{}{1.0, "w"}},
+		{"e", []interface{}{2.0, "v"}},
+		{"b", []interface{}{0.0, "x"}}, // updating keeps insertion order
+		{"e", nil},
+		{"e", []interface{}{2.0, "v"}}, // re-inserted after deletion
+	}
+	for _, tc := range []struct {
+		name  string
+		order string
+		keys  []string
+	}{
+		{"insertion", insertionOrder, []string{"b", "c", "a", "d", "e"}},
+		{"key", keyOrder, []string{"a", "b", "c", "d", "e"}},
+		{"numeric field", "x", []string{"b", "c", "d", "e", "a"}}, // ties by key; non-numeric last
+		{"numeric field, by index", "0", []string{"b", "c", "d", "e", "a"}},
+		{"non-numeric field", "y", []string{"a", "b", "c", "d", "e"}}, // all non-numeric: by key
+		{"unknown field", "z", []string{"a", "b", "c", "d", "e"}},
+	} {
+		b := loadMapBuf(newNamespace(), &MapBufD{F: []string{"x", "y"}, Y: tc.order})
+		for _, s := range sets {
+			b.set(s.k, s.v)
+		}
+		for i := 0; i < 3; i++ { // stable across dumps
+			if d := b.dump().M; !reflect.DeepEqual(d.K, tc.keys) {
+				t.Errorf("%s: want keys %v, got %v", tc.name, tc.keys, d.K)
+			}
+		}
+		if d := loadMapBuf(newNamespace(), b.dump().M).dump().M; !reflect.DeepEqual(d.K, tc.keys) || d.Y != tc.order {
+			t.Errorf("%s: want order kept once loaded, got %v %q", tc.name, d.K, d.Y)
+		}
+	}
+}
+
+func TestMapBufCompact(t *testing.T) {
+	b := newTestTTLMapBuf(map[string]time.Duration{"a": 0, "b": 2 * time.Minute, "c": 0})
+	b.set("d", []interface{}{"d"})
+	b.del("a")
+	keys := b.dump().M.K
+	if n := b.compact(); n != 2 {
+		t.Errorf("want 2 records retained, got %d", n)
+	}
+	for _, tc := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"records", len(b.tups), 2},
+		{"insertion order", toJSON(t, b.dump().M.K), toJSON(t, []string{"c", "d"})},
+		{"timestamps", len(b.ts), 2},
+		{"peak", b.peak, 2},
+		{"size", b.bytes, recordSize("c") + tupSize(b.tups["c"]) + recordSize("d") + tupSize(b.tups["d"])},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, tc.got)
+		}
+	}
+	if contains(keys, "b") {
+		t.Error("want expired record hidden before compaction")
+	}
+}
+
+func TestMapBufAutoCompact(t *testing.T) {
+	b := newMapBuf(newNamespace().make([]string{"a"}))
+	for i := 0; i < mapBufCompactMin; i++ {
+		b.set(strconv.Itoa(i), []interface{}{float64(i)})
+	}
+	deleted := 0
+	for _, tc := range []struct {
+		live int // records remaining after deletions
+		peak int
+	}{
+		{mapBufCompactMin / 2, mapBufCompactMin},
+		{mapBufCompactMin/4 + 1, mapBufCompactMin}, // above the ratio
+		{mapBufCompactMin/4 - 1, mapBufCompactMin/4 - 1},
+		{10, mapBufCompactMin/4 - 1}, // peak too small to compact again
+	} {
+		for ; mapBufCompactMin-deleted > tc.live; deleted++ {
+			b.del(strconv.Itoa(deleted))
+		}
+		if b.peak != tc.peak {
+			t.Errorf("%d live: want peak %d, got %d", tc.live, tc.peak, b.peak)
+		}
+		if len(b.tups) != tc.live {
+			t.Errorf("%d live: want %d records, got %d", tc.live, tc.live, len(b.tups))
+		}
+	}
+}
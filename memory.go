@@ -0,0 +1,248 @@
+package wave
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Approximate sizes of values held in buffers and cards, in bytes, as laid out on a 64-bit platform.
+const (
+	ifaceSize  = 16 // interface value
+	sliceSize  = 24 // slice header
+	stringSize = 16 // string header
+	mapSize    = 48 // map header
+)
+
+var errMemoryLimit = errors.New("memory limit exceeded")
+
+// sizeOf returns the approximate number of bytes used to hold a value.
+func sizeOf(ix interface{}) int64 {
+	switch x := ix.(type) {
+	case nil:
+		return 0
+	case string:
+		return stringSize + int64(len(x))
+	case []interface{}:
+		if x == nil {
+			return 0
+		}
+		n := int64(sliceSize)
+		for _, v := range x {
+			n += ifaceSize + sizeOf(v)
+		}
+		return n
+	case map[string]interface{}:
+		n := int64(mapSize)
+		for k, v := range x {
+			n += stringSize + int64(len(k)) + ifaceSize + sizeOf(v)
+		}
+		return n
+	case Buf:
+		return x.size()
+	}
+	return 8 // numbers, booleans
+}
+
+// tupSize returns the approximate number of bytes used to hold a tuple.
+func tupSize(tup []interface{}) int64 {
+	return sizeOf(tup)
+}
+
+// tupsSize returns the approximate number of bytes used to hold tuples, excluding slots.
+func tupsSize(tups [][]interface{}) int64 {
+	var n int64
+	for _, tup := range tups {
+		n += tupSize(tup)
+	}
+	return n
+}
+
+// bufDSize estimates the number of bytes needed to hold a marshaled buffer once loaded.
+func bufDSize(b BufD) int64 {
+	est := func(n int, tups, cols [][]interface{}) int64 {
+		if len(tups) > n {
+			n = len(tups)
+		}
+		return int64(n)*sliceSize + tupsSize(tups) + tupsSize(cols)
+	}
+	switch {
+	case b.C != nil:
+		return est(b.C.N, b.C.D, b.C.X)
+	case b.F != nil:
+		return est(b.F.N, b.F.D, b.F.X)
+	case b.M != nil:
+		n := int64(mapSize) + tupsSize(b.M.X)
+		for k, tup := range b.M.D {
+			n += stringSize + int64(len(k)) + tupSize(tup)
+		}
+		return n
+	case b.X != nil:
+		return int64(b.X.N)*sliceSize + sizeOf(b.X.D)
+	}
+	return 0
+}
+
+// estimate estimates the number of bytes a set of changes would add to the page: the values written, less the
+// values they replace, if smaller. Deletions are free; records merged into map buffers are counted in full.
+// Replacements are not credited with memory they free, since later changes in the set may replace the same values.
+func (p *Page) estimate(ops []OpD) int64 {
+	var n int64
+	net := func(add, replaced int64) {
+		if add > replaced {
+			n += add - replaced
+		}
+	}
+	for _, op := range ops {
+		switch {
+		case len(op.K) == 0, op.X != nil: // drop page, delete records
+		case op.C != nil:
+			net(bufDSize(BufD{C: op.C}), p.sizeAt(op.K))
+		case op.F != nil:
+			net(bufDSize(BufD{F: op.F}), p.sizeAt(op.K))
+		case op.M != nil:
+			net(bufDSize(BufD{M: op.M}), p.sizeAt(op.K))
+		case op.D != nil:
+			add := sizeOf(op.D)
+			for _, b := range op.B {
+				add += bufDSize(b)
+			}
+			net(add, p.cardSize(op.K))
+		case op.U != nil:
+			n += sizeOf(op.U)
+		case op.W != nil:
+			net(sizeOf(op.W.V), p.sizeAt(op.K))
+		case op.A != nil:
+			n += tupsSize(op.A.D)
+		case op.J != nil:
+			n += sizeOf(op.J.V)
+		case op.S != 0:
+			if b, ok := p.at(op.K).(*CycBuf); ok {
+				net(int64(op.S)*sliceSize, int64(len(b.b.tups))*sliceSize) // slots; tuples are retained or discarded
+			}
+		case op.L != nil:
+			if b, ok := p.at(op.K).(*FixBuf); ok {
+				net(int64(len(b.tups))*sizeOf(op.L.V), b.bytes) // a copy per slot
+			}
+		default:
+			net(sizeOf(op.V), p.sizeAt(op.K))
+		}
+	}
+	return n
+}
+
+// sizeAt returns the approximate number of bytes used by the value at key k, if any.
+func (p *Page) sizeAt(k string) int64 {
+	switch x := p.at(k).(type) {
+	case Cur:
+		return tupSize(x.tup)
+	case nil:
+		return 0
+	default:
+		return sizeOf(x)
+	}
+}
+
+// size returns the approximate number of bytes used by a card.
+func (c *Card) size() int64 {
+	n := int64(mapSize)
+	for k, v := range c.data {
+		n += stringSize + int64(len(k)) + ifaceSize + sizeOf(v)
+	}
+	return n
+}
+
+// measure returns the approximate number of bytes used by a page's cards.
+func (p *Page) measure() int64 {
+	var n int64
+	for k := range p.cards {
+		n += p.cardSize(k)
+	}
+	return n
+}
+
+// cardSize returns the approximate number of bytes used by the card at key k, if any.
+func (p *Page) cardSize(k string) int64 {
+	if card, ok := p.cards[k]; ok {
+		return stringSize + int64(len(k)) + card.size()
+	}
+	return 0
+}
+
+// Footprint represents the resources held by a card: its approximate size, and the types of its buffers.
+type Footprint struct {
+	size  int64          // approximate bytes used
+	types map[string]Typ // types of buffers held, keyed by type key
+}
+
+// footprint returns the footprint of the card at key k, if any.
+func (p *Page) footprint(k string) Footprint {
+	if card, ok := p.cards[k]; ok {
+		return Footprint{p.cardSize(k), card.types()}
+	}
+	return Footprint{}
+}
+
+// touch records the footprint of the card addressed by key k, before the card is changed, unless already recorded,
+// so that the page's size and the references to buffer types can be updated incrementally, without examining unchanged cards.
+func (p *Page) touch(before map[string]Footprint, k string) {
+	if i := strings.Index(k, keySeparator); i >= 0 {
+		k = k[:i]
+	}
+	if _, ok := before[k]; !ok {
+		before[k] = p.footprint(k)
+	}
+}
+
+// settle updates the page's size and the namespace's references to buffer types from the footprints of the cards
+// recorded by touch, and returns the change in size. Types referenced only by cards deleted or replaced are freed.
+func (p *Page) settle(ns *Namespace, before map[string]Footprint) int64 {
+	var d int64
+	for k, b := range before {
+		a := p.footprint(k)
+		d += a.size - b.size
+		ns.retain(a.types) // before releasing, so that types still referenced are never removed
+		ns.release(b.types)
+	}
+	atomic.AddInt64(&p.size, d)
+	return d
+}
+
+// retain records the references to buffer types held by the page's cards.
+func (p *Page) retain(ns *Namespace) {
+	for _, card := range p.cards {
+		ns.retain(card.types())
+	}
+}
+
+// release drops the references to buffer types held by the page's cards.
+func (p *Page) release(ns *Namespace) {
+	for _, card := range p.cards {
+		ns.release(card.types())
+	}
+}
+
+// usage returns the approximate number of bytes used by pages in the namespace.
+func (ns *Namespace) usage() int64 {
+	return atomic.LoadInt64(&ns.used)
+}
+
+// grow adjusts the namespace's memory usage by n bytes.
+func (ns *Namespace) grow(n int64) {
+	atomic.AddInt64(&ns.used, n)
+}
+
+// charge adds n bytes to the namespace's memory usage, unless that would exceed the namespace's memory limit, if any.
+// Checking and adding is a single atomic step, so that concurrent changes cannot together exceed the limit.
+func (ns *Namespace) charge(n int64) error {
+	for {
+		used := ns.usage()
+		if ns.limit > 0 && n > 0 && used+n > ns.limit {
+			return fmt.Errorf("%w: %d bytes in use, %d requested, limit is %d", errMemoryLimit, used, n, ns.limit)
+		}
+		if atomic.CompareAndSwapInt64(&ns.used, used, used+n) {
+			return nil
+		}
+	}
+}
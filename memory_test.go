@@ -0,0 +1,133 @@
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSizeOf(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want int64
+	}{
+		{`null`, 0},
+		{`1`, 8},
+		{`true`, 8},
+		{`"abc"`, stringSize + 3},
+		{`[]`, sliceSize},
+		{`[1,"a"]`, sliceSize + ifaceSize + 8 + ifaceSize + stringSize + 1},
+		{`{"k":1}`, mapSize + stringSize + 1 + ifaceSize + 8},
+	} {
+		if got := sizeOf(mustJSON(t, tc.v)); got != tc.want {
+			t.Errorf("%s: want %d, got %d", tc.v, tc.want, got)
+		}
+	}
+}
+
+func TestNamespaceCharge(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		limit int64
+		used  int64
+		n     int64
+		ok    bool
+	}{
+		{"unlimited", 0, 1000, 1000, true},
+		{"within limit", 100, 50, 50, true},
+		{"past limit", 100, 50, 51, false},
+		{"shrinking past limit", 100, 150, -10, true},
+	} {
+		ns := newNamespace()
+		ns.limit, ns.used = tc.limit, tc.used
+		err := ns.charge(tc.n)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, err)
+		}
+		if err != nil && !errors.Is(err, errMemoryLimit) {
+			t.Errorf("%s: want memory limit error, got %v", tc.name, err)
+		}
+		want := tc.used
+		if tc.ok {
+			want += tc.n
+		}
+		if ns.usage() != want {
+			t.Errorf("%s: want usage %d, got %d", tc.name, want, ns.usage())
+		}
+	}
+}
+
+func TestExecMemoryLimit(t *testing.T) {
+	site := newSite()
+	site.ns.limit = 4096
+	mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{"x":[1]}}}]}]}`)
+	checkSize(t, site, "/p")
+	used := site.ns.usage()
+
+	for _, tc := range []struct {
+		name string
+		op   string
+		ok   bool
+	}{
+		{"small", `{"k":"c items y","v":[2]}`, true},
+		{"large card", `{"k":"big","d":{"v":"` + strings.Repeat("x", 4096) + `"}}`, false},
+		{"large record", `{"k":"c items z","v":["` + strings.Repeat("x", 4096) + `"]}`, false},
+		{"large fixed buffer", `{"k":"f","d":{"~items":0},"b":[{"f":{"f":["a"],"n":1000}}]}`, false},
+		{"delete", `{"k":"c items x"}`, true},
+	} {
+		var ops OpsD
+		if err := json.Unmarshal([]byte(`{"d":[`+tc.op+`]}`), &ops); err != nil {
+			t.Fatal(err)
+		}
+		before := toJSON(t, site.at("/p").dump())
+		_, err := site.exec("/p", ops, false)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, err)
+		}
+		if err != nil {
+			if !errors.Is(err, errMemoryLimit) {
+				t.Errorf("%s: want memory limit error, got %v", tc.name, err)
+			}
+			if after := toJSON(t, site.at("/p").dump()); after != before {
+				t.Errorf("%s: want page unchanged, got %s", tc.name, after)
+			}
+		}
+		checkSize(t, site, "/p")
+	}
+
+	site.del("/p")
+	if site.ns.usage() != 0 {
+		t.Errorf("want usage 0 once page deleted, got %d (was %d)", site.ns.usage(), used)
+	}
+}
+
+func TestExecFillMemoryLimit(t *testing.T) {
+	site := newSite()
+	site.ns.limit = 8192
+	mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"f":{"f":["a"],"n":100}}]}]}`)
+	for _, tc := range []struct {
+		name string
+		v    string
+		ok   bool
+	}{
+		{"small", `[1]`, true},
+		{"large in total", `["` + strings.Repeat("x", 100) + `"]`, false}, // fits once, but not in every slot
+		{"clear", ``, true},
+	} {
+		op := `{"k":"c items","l":{}}`
+		if tc.v != "" {
+			op = `{"k":"c items","l":{"v":` + tc.v + `}}`
+		}
+		var ops OpsD
+		if err := json.Unmarshal([]byte(`{"d":[`+op+`]}`), &ops); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := site.exec("/p", ops, false); tc.ok != (err == nil) {
+			t.Errorf("%s: want ok=%v, got %v", tc.name, tc.ok, err)
+		} else if err != nil && !errors.Is(err, errMemoryLimit) {
+			t.Errorf("%s: want memory limit error, got %v", tc.name, err)
+		}
+		checkSize(t, site, "/p")
+	}
+}
@@ -0,0 +1,85 @@
+package wave
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics represents server-wide counters, exposed in the Prometheus text format.
+type Metrics struct {
+	clients  int64     // active websocket clients
+	msgs     int64     // messages processed
+	bytesIn  int64     // bytes received
+	bytesOut int64     // bytes sent
+	latency  Histogram // message processing latency
+}
+
+const metricsContentType = "text/plain; version=0.0.4"
+
+var metrics = &Metrics{latency: newHistogram(0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1)}
+
+// Histogram represents a cumulative histogram with fixed bucket boundaries, in seconds.
+type Histogram struct {
+	bounds []float64
+	counts []int64 // per bound, plus +Inf
+	sum    int64   // nanoseconds
+}
+
+func newHistogram(bounds ...float64) Histogram {
+	return Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && s > h.bounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *Histogram) write(w http.ResponseWriter, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var n int64
+	for i, b := range h.bounds {
+		n += atomic.LoadInt64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, n)
+	}
+	n += atomic.LoadInt64(&h.counts[len(h.bounds)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, n)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, n)
+}
+
+// MetricsHandler is a HTTP handler for serving metrics.
+type MetricsHandler struct {
+	site *Site
+}
+
+func newMetricsHandler(site *Site) *MetricsHandler {
+	return &MetricsHandler{site}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, v interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, v)
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	m := metrics
+	writeMetric(w, "wave_clients", "gauge", "Active websocket clients.", atomic.LoadInt64(&m.clients))
+	writeMetric(w, "wave_pages", "gauge", "Pages hosted.", h.site.count())
+	writeMetric(w, "wave_memory_bytes", "gauge", "Approximate memory used by pages.", h.site.ns.usage())
+	writeMetric(w, "wave_memory_limit_bytes", "gauge", "Max memory that can be used by pages; 0=unlimited.", h.site.ns.limit)
+	writeMetric(w, "wave_messages_total", "counter", "Messages processed.", atomic.LoadInt64(&m.msgs))
+	writeMetric(w, "wave_received_bytes_total", "counter", "Bytes received from clients.", atomic.LoadInt64(&m.bytesIn))
+	writeMetric(w, "wave_sent_bytes_total", "counter", "Bytes sent to clients.", atomic.LoadInt64(&m.bytesOut))
+	m.latency.write(w, "wave_message_duration_seconds", "Message processing latency.")
+}
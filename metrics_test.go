@@ -0,0 +1,69 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.001, 0.01)
+	for _, d := range []time.Duration{500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, time.Second} {
+		h.observe(d)
+	}
+	w := httptest.NewRecorder()
+	h.write(w, "x", "help")
+	for _, want := range []string{
+		"# TYPE x histogram\n",
+		"x_bucket{le=\"0.001\"} 2\n", // bounds are inclusive
+		"x_bucket{le=\"0.01\"} 3\n",
+		"x_bucket{le=\"+Inf\"} 4\n",
+		"x_sum 1.0065\n",
+		"x_count 4\n",
+	} {
+		if got := w.Body.String(); !strings.Contains(got, want) {
+			t.Errorf("want %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/a": `{"d":[{"k":"x","d":{"v":1}}]}`,
+		"/b": `{"d":[{"k":"x","d":{"v":1}}]}`,
+	})
+	h := newMetricsHandler(site)
+	for _, tc := range []struct {
+		method string
+		status int
+		want   []string
+	}{
+		{http.MethodGet, http.StatusOK, []string{
+			"# TYPE wave_clients gauge\n",
+			"wave_pages 2\n",
+			"# TYPE wave_messages_total counter\n",
+			"# TYPE wave_message_duration_seconds histogram\n",
+		}},
+		{http.MethodPost, http.StatusMethodNotAllowed, nil},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, "/_m", nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.method, tc.status, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != metricsContentType {
+			t.Errorf("want content type %s, got %s", metricsContentType, ct)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("want %q in:\n%s", want, w.Body.String())
+			}
+		}
+	}
+}
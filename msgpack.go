@@ -0,0 +1,293 @@
+package wave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A minimal MessagePack (https://msgpack.org) codec, for the subset of values that can be represented in JSON.
+// Values are converted to and from JSON at the transport boundary, so that both formats behave identically:
+// integers decode to float64, as JSON numbers do; integral floats encode as integers, for compactness.
+
+const contentTypeMsgpack = "application/x-msgpack"
+
+var (
+	errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+	errMsgpackDepth     = errors.New("msgpack: exceeded max depth")
+)
+
+// Max nesting depth of arrays and maps when decoding; same as encoding/json's.
+const maxMsgpackDepth = 10000
+
+// Largest integer exactly representable as a float64.
+const maxExactInt = 1 << 53
+
+// Websocket subprotocol or query parameter used by clients to request MessagePack.
+const (
+	msgpackSubprotocol = "wave.msgpack"
+	formatParam        = "format"
+	msgpackFormat      = "msgpack"
+)
+
+// fromMsgpackMsg converts the data in a message to JSON, if the message carries JSON data (patches and queries).
+func fromMsgpackMsg(msg []byte) ([]byte, error) {
+	parts := bytes.SplitN(msg, msgSep, 3)
+	if len(parts) < 3 {
+		return msg, nil
+	}
+	switch parseMsgT(parts[0]) {
+	case patchMsgT, queryMsgT:
+		data, err := msgpackToJSON(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Join([][]byte{parts[0], parts[1], data}, msgSep), nil
+	}
+	return msg, nil
+}
+
+// jsonToMsgpack converts a JSON value to MessagePack.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackToJSON converts a MessagePack value to JSON.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	v, rest, err := decodeMsgpack(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(rest))
+	}
+	return json.Marshal(v)
+}
+
+func encodeMsgpack(buf *bytes.Buffer, ix interface{}) error {
+	switch x := ix.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if x {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < maxExactInt {
+			encodeMsgpackInt(buf, int64(x))
+		} else {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, x)
+		}
+	case string:
+		n := len(x)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(x)
+	case []interface{}:
+		encodeMsgpackLen(buf, len(x), 0x90, 0xdc)
+		for _, v := range x {
+			if err := encodeMsgpack(buf, v); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		encodeMsgpackLen(buf, len(x), 0x80, 0xde)
+		for _, k := range sortedKeys(x) {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, x[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode %T", ix)
+	}
+	return nil
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// encodeMsgpackLen writes the header of an array or map; fix is the fixarray/fixmap prefix, and
+// ext the 16-bit variant's prefix (the 32-bit variant's prefix follows it).
+func encodeMsgpackLen(buf *bytes.Buffer, n int, fix, ext byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(ext)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(ext + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// decodeMsgpack decodes a value nested depth levels deep, and returns the remaining data.
+func decodeMsgpack(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errMsgpackTruncated
+	}
+	c, b := b[0], b[1:]
+	switch {
+	case c <= 0x7f:
+		return float64(c), b, nil
+	case c >= 0xe0:
+		return float64(int8(c)), b, nil
+	case c&0xe0 == 0xa0:
+		return decodeMsgpackStr(b, int(c&0x1f))
+	case c&0xf0 == 0x90:
+		return decodeMsgpackArray(b, int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return decodeMsgpackMap(b, int(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xca:
+		u, b, err := decodeMsgpackUint(b, 4)
+		return float64(math.Float32frombits(uint32(u))), b, err
+	case 0xcb:
+		u, b, err := decodeMsgpackUint(b, 8)
+		return math.Float64frombits(u), b, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, b, err := decodeMsgpackUint(b, 1<<(c-0xcc))
+		return float64(u), b, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		u, b, err := decodeMsgpackUint(b, n)
+		shift := uint(64 - 8*n)
+		return float64(int64(u<<shift) >> shift), b, err // sign-extend
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6: // str, bin
+		k := 1 << (c - 0xd9)
+		if c <= 0xc6 {
+			k = 1 << (c - 0xc4)
+		}
+		n, b, err := decodeMsgpackUint(b, k)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackStr(b, int(n))
+	case 0xdc, 0xdd:
+		n, b, err := decodeMsgpackUint(b, 2<<(c-0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackArray(b, int(n), depth)
+	case 0xde, 0xdf:
+		n, b, err := decodeMsgpackUint(b, 2<<(c-0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackMap(b, int(n), depth)
+	}
+	return nil, nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+func decodeMsgpackUint(b []byte, n int) (uint64, []byte, error) {
+	if len(b) < n {
+		return 0, nil, errMsgpackTruncated
+	}
+	var u uint64
+	for _, x := range b[:n] {
+		u = u<<8 | uint64(x)
+	}
+	return u, b[n:], nil
+}
+
+func decodeMsgpackStr(b []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || len(b) < n {
+		return nil, nil, errMsgpackTruncated
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func decodeMsgpackArray(b []byte, n, depth int) (interface{}, []byte, error) {
+	if depth >= maxMsgpackDepth {
+		return nil, nil, errMsgpackDepth
+	}
+	if n < 0 || n > len(b) { // each element takes at least one byte
+		return nil, nil, errMsgpackTruncated
+	}
+	xs := make([]interface{}, n)
+	for i := range xs {
+		x, rest, err := decodeMsgpack(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		xs[i], b = x, rest
+	}
+	return xs, b, nil
+}
+
+func decodeMsgpackMap(b []byte, n, depth int) (interface{}, []byte, error) {
+	if depth >= maxMsgpackDepth {
+		return nil, nil, errMsgpackDepth
+	}
+	if n < 0 || 2*n > len(b) { // each entry takes at least two bytes
+		return nil, nil, errMsgpackTruncated
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, rest, err := decodeMsgpack(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		s, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("msgpack: want string key, got %v", k)
+		}
+		v, rest, err := decodeMsgpack(rest, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[s], b = v, rest
+	}
+	return m, b, nil
+}
@@ -0,0 +1,146 @@
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		`null`,
+		`true`,
+		`false`,
+		`0`,
+		`127`,
+		`128`,
+		`-1`,
+		`-32`,
+		`-33`,
+		`-129`,
+		`65536`,
+		`-2147483649`,
+		`9007199254740991`,
+		`1.5`,
+		`-0.25`,
+		`1e300`,
+		`""`,
+		`"hello"`,
+		`"` + string(bytes.Repeat([]byte("x"), 40)) + `"`,
+		`"` + string(bytes.Repeat([]byte("x"), 300)) + `"`,
+		`"` + string(bytes.Repeat([]byte("x"), 70000)) + `"`,
+		`[]`,
+		`[1,"a",null,[true,false]]`,
+		`{}`,
+		`{"a":1,"b":[1,2,{"c":"d"}]}`,
+	} {
+		b, err := jsonToMsgpack([]byte(s))
+		if err != nil {
+			t.Fatalf("%.40s: encode: %v", s, err)
+		}
+		j, err := msgpackToJSON(b)
+		if err != nil {
+			t.Fatalf("%.40s: decode: %v", s, err)
+		}
+		if !jsonEqual(t, []byte(s), j) {
+			t.Errorf("%.40s: got %.40s", s, j)
+		}
+	}
+}
+
+func TestMsgpackRoundTripLarge(t *testing.T) {
+	xs := make([]interface{}, 70000)
+	m := make(map[string]interface{})
+	for i := range xs {
+		xs[i] = float64(i)
+		if i < 20 {
+			m[string(rune('a'+i))] = float64(i)
+		}
+	}
+	data, _ := json.Marshal([]interface{}{xs, m})
+	b, err := jsonToMsgpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := msgpackToJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jsonEqual(t, data, j) {
+		t.Error("large values differ after round trip")
+	}
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"empty":            {},
+		"truncated str":    {0xa5, 'a', 'b'},
+		"truncated str8":   {0xd9},
+		"truncated float":  {0xcb, 0, 0},
+		"truncated array":  {0x92, 0x01},
+		"truncated map":    {0x81, 0xa1, 'a'},
+		"huge array":       {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"huge map":         {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"non-string key":   {0x81, 0x01, 0x02},
+		"unsupported type": {0xc1},
+		"ext type":         {0xd4, 0x01, 0x02},
+		"trailing bytes":   {0x01, 0x02},
+	} {
+		if _, err := msgpackToJSON(b); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestMsgpackDepth(t *testing.T) {
+	deep := append(bytes.Repeat([]byte{0x91}, 4<<20), 0xc0) // 4 MiB of nested single-element arrays
+	if _, err := msgpackToJSON(deep); err != errMsgpackDepth {
+		t.Errorf("arrays: want %v, got %v", errMsgpackDepth, err)
+	}
+
+	deepMap := append(bytes.Repeat([]byte{0x81, 0xa1, 'k'}, maxMsgpackDepth+1), 0xc0)
+	if _, err := msgpackToJSON(deepMap); err != errMsgpackDepth {
+		t.Errorf("maps: want %v, got %v", errMsgpackDepth, err)
+	}
+
+	ok := append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth), 0xc0)
+	if _, err := msgpackToJSON(ok); err != nil {
+		t.Errorf("max depth: want no error, got %v", err)
+	}
+}
+
+func TestFromMsgpackMsg(t *testing.T) {
+	data, _ := jsonToMsgpack([]byte(`{"d":[{"k":"a","v":1}]}`))
+	msg := append([]byte("* /foo "), data...)
+	got, err := fromMsgpackMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `* /foo {"d":[{"k":"a","v":1}]}`
+	if string(got) != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	if _, err := fromMsgpackMsg(append([]byte("* /foo "), bytes.Repeat([]byte{0x91}, 1<<20)...)); err == nil {
+		t.Error("deeply nested patch: want error")
+	}
+
+	watch := []byte("+ /foo ")
+	if got, err := fromMsgpackMsg(watch); err != nil || !bytes.Equal(got, watch) {
+		t.Errorf("non-data message: want as-is, got %q, %v", got, err)
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := json.Marshal(x)
+	q, _ := json.Marshal(y)
+	return bytes.Equal(p, q)
+}
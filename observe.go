@@ -0,0 +1,176 @@
+package wave
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Observer is a callback invoked when a record in a buffer changes, with the url of the page,
+// the key of the buffer, and a cursor over the new record.
+//
+// Observers are invoked after a set of changes has been applied in its entirety, in the goroutine that applied it,
+// once all locks have been released; they can read from the site, but should return promptly, since the writer
+// waits for them. Records deleted by key prefix or pattern are reported with empty cursors (see Cur.Empty), one per record;
+// other deletions, and buffers created, replaced or restructured, are not observed.
+type Observer func(page, key string, cur Cur)
+
+// Observers represents the observers registered with a namespace.
+type Observers struct {
+	sync.RWMutex
+	n    int32 // number of observers; atomic
+	next int
+	obs  map[int]observer
+}
+
+type observer struct {
+	key string // buffer key; ""=all buffers
+	fn  Observer
+}
+
+// Change represents a change to a record in a buffer, to be reported to observers.
+type Change struct {
+	page string
+	key  string
+	cur  Cur
+}
+
+// NewNamespace creates a namespace, so that observers can be registered with it before running a server
+// using ServerConf.Namespace.
+func NewNamespace() *Namespace {
+	return newNamespace()
+}
+
+// Observe registers an observer for changes to records in the buffer at key (e.g. "card_name data"),
+// or in any buffer if key is empty. It returns a function that unregisters the observer.
+func (ns *Namespace) Observe(key string, fn Observer) func() {
+	o := &ns.observers
+	o.Lock()
+	defer o.Unlock()
+	if o.obs == nil {
+		o.obs = make(map[int]observer)
+	}
+	id := o.next
+	o.next++
+	o.obs[id] = observer{key, fn}
+	atomic.AddInt32(&o.n, 1)
+	return func() {
+		o.Lock()
+		defer o.Unlock()
+		if _, ok := o.obs[id]; ok {
+			delete(o.obs, id)
+			atomic.AddInt32(&o.n, -1)
+		}
+	}
+}
+
+// observed reports whether any observers have been registered.
+func (ns *Namespace) observed() bool {
+	return atomic.LoadInt32(&ns.observers.n) > 0
+}
+
+// notify reports changes to observers.
+func (ns *Namespace) notify(changes []Change) {
+	o := &ns.observers
+	o.RLock()
+	obs := make([]observer, 0, len(o.obs))
+	for _, x := range o.obs {
+		obs = append(obs, x)
+	}
+	o.RUnlock()
+
+	for _, c := range changes {
+		for _, x := range obs {
+			if len(x.key) == 0 || x.key == c.key {
+				x.fn(c.page, c.key, c.cur)
+			}
+		}
+	}
+}
+
+// changes returns the changes to buffer records made by an op already applied to a page, given the changes
+// as applied. Tuples are copied, so that observers see them as of the change.
+func (p *Page) changes(url string, op OpD, done []OpD, changes []Change) []Change {
+	add := func(k string, t Typ, tup []interface{}) {
+		if tup != nil {
+			changes = append(changes, Change{url, k, Cur{t, append([]interface{}(nil), tup...)}})
+		}
+	}
+	addAll := func(k string, b Buf) {
+		switch b := b.(type) {
+		case *FixBuf:
+			for _, tup := range b.tups {
+				add(k, b.t, tup)
+			}
+		case *CycBuf:
+			for _, tup := range b.chrono() {
+				add(k, b.b.t, tup)
+			}
+		case *MapBuf:
+			for _, rk := range b.keys() {
+				add(k, b.t, b.tups[rk])
+			}
+		}
+	}
+	record := func(k, rk string) {
+		switch b := p.at(k).(type) {
+		case *FixBuf:
+			if c, ok := b.get(rk); ok {
+				add(k, b.t, c.tup)
+			}
+		case *CycBuf:
+			if c, ok := b.latest(); ok {
+				add(k, b.b.t, c.tup)
+			}
+		case *MapBuf:
+			if c, ok := b.get(rk); ok {
+				add(k, b.t, c.tup)
+			}
+		}
+	}
+
+	switch {
+	case len(op.K) == 0, op.C != nil, op.F != nil, op.M != nil, op.D != nil, op.N != nil, op.S != 0, op.Z:
+	case op.U != nil: // records set, not those rejected or deleted
+		for _, c := range done {
+			if c.V != nil {
+				record(op.K, c.K[len(op.K)+len(keySeparator):])
+			}
+		}
+	case op.X != nil:
+		if b, ok := p.at(op.K).(*MapBuf); ok {
+			for range done {
+				changes = append(changes, Change{url, op.K, Cur{t: b.t}})
+			}
+		}
+	case op.W != nil:
+		if i := strings.LastIndex(op.K, keySeparator); i >= 0 {
+			record(op.K[:i], op.K[i+1:])
+		}
+	case op.J != nil:
+		record(op.K, strconv.Itoa(op.J.I))
+	case op.A != nil:
+		if _, ok := p.at(op.K).(*FixBuf); ok {
+			for _, c := range done {
+				record(op.K, c.K[len(op.K)+len(keySeparator):])
+			}
+		} else if b, ok := p.at(op.K).(*CycBuf); ok && len(done) == 1 && done[0].A != nil {
+			for _, tup := range done[0].A.D { // tuples appended, not those skipped
+				add(op.K, b.b.t, tup)
+			}
+		}
+	case op.L != nil:
+		if b, ok := p.at(op.K).(Buf); ok {
+			addAll(op.K, b)
+		}
+	case op.V == nil:
+	default:
+		if b, ok := p.at(op.K).(Buf); ok { // put
+			addAll(op.K, b)
+		} else if i := strings.LastIndex(op.K, keySeparator); i >= 0 {
+			record(op.K[:i], op.K[i+1:])
+		}
+	}
+	return changes
+}
@@ -0,0 +1,93 @@
+package wave
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const observedPage = `{"d":[
+	{"k":"m","d":{"~items":0},"b":[{"m":{"f":["a","b"],"d":{"x":[1,2]}}}]},
+	{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[1],null,null],"n":3,"i":1}}]},
+	{"k":"f","d":{"~items":0},"b":[{"f":{"f":["a"],"d":[[1],null],"n":2}}]}
+]}`
+
+func TestObserve(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ops  string
+		want []string
+	}{
+		{"put record", `{"k":"m items y","v":[3,4]}`, []string{`m items [3,4]`}},
+		{"put buffer", `{"k":"f items","v":[[5],[6]]}`, []string{`f items [5]`, `f items [6]`}},
+		{"update", `{"k":"m items","u":{"y":[3,4],"z":[5,6]}}`, []string{`m items [3,4]`, `m items [5,6]`}},
+		{"update, rejected", `{"k":"m items","u":{"x":[1,2,3],"y":[3,4]}}`, []string{`m items [3,4]`}},
+		{"update, deleted", `{"k":"m items","u":{"x":null}}`, nil},
+		{"swap", `{"k":"m items x","w":{"e":[1,2],"v":[7,8]}}`, []string{`m items [7,8]`}},
+		{"swap, mismatch", `{"k":"m items x","w":{"e":[0,0],"v":[7,8]}}`, nil},
+		{"append", `{"k":"c items","a":{"d":[[2],[3]]}}`, []string{`c items [2]`, `c items [3]`}},
+		{"append, partial", `{"k":"c items","a":{"d":[[2],["x","y"],[3]]}}`, []string{`c items [2]`, `c items [3]`}},
+		{"append to fixed", `{"k":"f items","a":{"d":[[2],[3]]}}`, []string{`f items [2]`}},
+		{"fill", `{"k":"f items","l":{"v":[9]}}`, []string{`f items [9]`, `f items [9]`}},
+		{"delete by prefix", `{"k":"m items","x":{"p":"x"}}`, []string{`m items null`}},
+		{"replace card", `{"k":"m","d":{"x":1}}`, nil},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", observedPage)
+		var got []string
+		unobserve := site.ns.Observe("", func(page, key string, cur Cur) {
+			if page != "/p" {
+				t.Errorf("%s: want page /p, got %s", tc.name, page)
+			}
+			tup, _ := json.Marshal(cur.tup)
+			got = append(got, key+" "+string(tup))
+		})
+		mustExec(t, site, "/p", `{"d":[`+tc.ops+`]}`)
+		unobserve()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestObserveKey(t *testing.T) {
+	site := newSite()
+	mustExec(t, site, "/p", observedPage)
+	var got int
+	unobserve := site.ns.Observe("m items", func(page, key string, cur Cur) { got++ })
+	mustExec(t, site, "/p", `{"d":[{"k":"m items y","v":[3,4]},{"k":"c items","a":{"d":[[2]]}}]}`)
+	unobserve()
+	mustExec(t, site, "/p", `{"d":[{"k":"m items z","v":[5,6]}]}`)
+	if got != 1 {
+		t.Errorf("want 1 change observed, got %d", got)
+	}
+}
+
+func TestObserveOutsideLock(t *testing.T) {
+	site := newSite()
+	mustExec(t, site, "/p", observedPage)
+	called := false
+	site.ns.Observe("", func(page, key string, cur Cur) {
+		called = true
+		p := site.at(page)
+		locked := make(chan struct{})
+		go func() {
+			p.Lock()
+			p.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Error("want observer called without the page locked")
+		}
+		if p.marshal() == nil { // reading the page must not deadlock either
+			t.Error("want page readable from observer")
+		}
+	})
+	mustExec(t, site, "/p", `{"d":[{"k":"m items y","v":[3,4]}]}`)
+	if !called {
+		t.Error("want observer called")
+	}
+}
@@ -254,11 +254,12 @@ func (h *OAuth2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // OIDCLogoutHandler handles logout requests
 type OIDCLogoutHandler struct {
 	sessions      *OIDCSessions
+	broker        *Broker
 	endSessionURL string
 }
 
-func newOIDCLogoutHandler(sessions *OIDCSessions, endSessionURL string) http.Handler {
-	return &OIDCLogoutHandler{sessions, endSessionURL}
+func newOIDCLogoutHandler(sessions *OIDCSessions, broker *Broker, endSessionURL string) http.Handler {
+	return &OIDCLogoutHandler{sessions, broker, endSessionURL}
 }
 
 func (h *OIDCLogoutHandler) logoutRedirect(w http.ResponseWriter, r *http.Request) {
@@ -295,7 +296,7 @@ func (h *OIDCLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, cookie)
 
 	// Clean up session.
-	_, ok := h.sessions.get(sessionID)
+	session, ok := h.sessions.get(sessionID)
 	if !ok {
 		echo(Log{"t": "logout_session", "error": "not found"})
 		h.logoutRedirect(w, r)
@@ -303,5 +304,10 @@ func (h *OIDCLogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	h.sessions.remove(sessionID)
 
+	// Disconnect clients using this session.
+	h.broker.logout <- sessionID
+
+	echo(Log{"t": "logout", "subject": session.subject, "username": session.username})
+
 	h.logoutRedirect(w, r)
 }
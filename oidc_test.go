@@ -0,0 +1,79 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOIDCLogout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cookie  string
+		dropped []bool // per client, with sessions s1, s1, s2
+	}{
+		{"session", "s1", []bool{true, true, false}},
+		{"unknown session", "s3", []bool{false, false, false}},
+		{"no cookie", "", []bool{false, false, false}},
+	} {
+		sessions := newOIDCSessions()
+		sessions.set("s1", OIDCSession{username: "alice"})
+		sessions.set("s2", OIDCSession{username: "bob"})
+		b := newTestBroker(nil)
+		var clients []*Client
+		for _, session := range []string{"s1", "s1", "s2"} {
+			c := newClient("test", "", "", session, b, nil)
+			b.join <- c
+			clients = append(clients, c)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/_logout", nil)
+		if tc.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: oidcSessionKey, Value: tc.cookie})
+		}
+		w := httptest.NewRecorder()
+		newOIDCLogoutHandler(sessions, b, "").ServeHTTP(w, r)
+		b.sync()
+		if w.Code != http.StatusFound {
+			t.Errorf("%s: want redirect, got %d", tc.name, w.Code)
+		}
+		if _, ok := sessions.get(tc.cookie); ok {
+			t.Errorf("%s: want session removed", tc.name)
+		}
+		for i, c := range clients {
+			if c.dropped != tc.dropped[i] {
+				t.Errorf("%s: client %d: want dropped=%v, got %v", tc.name, i, tc.dropped[i], c.dropped)
+			}
+			if c.dropped && c.closeCode != websocket.ClosePolicyViolation {
+				t.Errorf("%s: client %d: want close code %d, got %d", tc.name, i, websocket.ClosePolicyViolation, c.closeCode)
+			}
+		}
+	}
+}
+
+func TestSocketServerRejectsStaleSessions(t *testing.T) {
+	sessions := newOIDCSessions()
+	sessions.set("s1", OIDCSession{username: "alice"})
+	for _, tc := range []struct {
+		name   string
+		cookie string
+		oidc   bool
+		status int
+	}{
+		{"stale session", "s2", true, http.StatusUnauthorized},
+		{"no session", "", true, http.StatusUnauthorized},
+		{"live session", "s1", true, http.StatusBadRequest}, // not a websocket handshake; upgrade fails
+		{"oidc disabled", "", false, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/_s", nil)
+		if tc.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: oidcSessionKey, Value: tc.cookie})
+		}
+		w := httptest.NewRecorder()
+		newSocketServer(newTestBroker(nil), sessions, tc.oidc).ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package wave
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -11,6 +13,7 @@ type Page struct {
 	sync.RWMutex
 	cards map[string]*Card
 	cache []byte
+	size  int64 // approximate memory used by cards, as of the last change; atomic
 }
 
 func newPage() *Page {
@@ -35,6 +38,249 @@ func (p *Page) set(k string, v interface{}) {
 	}
 }
 
+// put sets the value at key k, and returns the change as applied, or false if nothing was changed.
+// Buffers overwritten in their entirety are reported in full, and buffer records as stored.
+func (p *Page) put(k string, v interface{}) (OpD, bool) {
+	i := strings.LastIndex(k, keySeparator)
+	if i < 0 {
+		p.set(k, v)
+		return OpD{K: k, V: v}, true
+	}
+	if _, ok := p.at(k).(Buf); ok { // overwrite all records
+		p.set(k, v)
+		if b, ok := p.at(k).(Buf); ok {
+			return bufOp(k, b), true
+		}
+		return OpD{K: k, V: v}, true
+	}
+	rk := k[i+len(keySeparator):]
+	switch b := p.at(k[:i]).(type) {
+	case *CycBuf:
+		seq := b.seq
+		p.set(k, v)
+		if b.seq == seq {
+			return OpD{}, false
+		}
+		c, _ := b.latest()
+		return OpD{K: k, V: tupValue(c.tup)}, true
+	case *FixBuf:
+		if _, ok := b.get(rk); !ok { // out of range
+			return OpD{}, false
+		}
+		p.set(k, v)
+		c, _ := b.get(rk)
+		return OpD{K: k, V: tupValue(c.tup)}, true
+	case *MapBuf:
+		p.set(k, v)
+		c, _ := b.get(rk)
+		return OpD{K: k, V: tupValue(c.tup)}, true
+	}
+	p.set(k, v)
+	return OpD{K: k, V: v}, true
+}
+
+// bufOp returns an op that sets the buffer at key k in its entirety.
+func bufOp(k string, b Buf) OpD {
+	d := b.dump()
+	return OpD{K: k, C: d.C, F: d.F, M: d.M}
+}
+
+// tupValue returns a tuple as a value that is nil if the tuple is nil.
+func tupValue(tup []interface{}) interface{} {
+	if tup == nil {
+		return nil
+	}
+	return tup
+}
+
+// at returns the value at key k, else nil.
+func (p *Page) at(k string) interface{} {
+	ks := strings.Split(k, keySeparator)
+	card, ok := p.cards[ks[0]]
+	if !ok {
+		return nil
+	}
+	var x interface{} = card.data
+	for _, k := range ks[1:] {
+		x = get(x, k)
+	}
+	return x
+}
+
+// update merges records into the map buffer at key k, and returns the records set, as changes to individual
+// records with values as stored, and the keys of rejected records.
+func (p *Page) update(k string, xs map[string]interface{}) ([]OpD, []string, error) {
+	b, ok := p.at(k).(*MapBuf)
+	if !ok {
+		return nil, nil, fmt.Errorf("want map buffer at %q", k)
+	}
+	set, rejected := b.setAll(xs)
+	changes := make([]OpD, len(set))
+	for i, rk := range set {
+		c, _ := b.get(rk)
+		changes[i] = OpD{K: k + keySeparator + rk, V: tupValue(c.tup)}
+	}
+	return changes, rejected, nil
+}
+
+// deleteKeys deletes the records of the map buffer at key k whose keys have a prefix or match a pattern, and returns
+// the records deleted, as deletions of individual records.
+func (p *Page) deleteKeys(k string, d *DeleteD) ([]OpD, error) {
+	b, ok := p.at(k).(*MapBuf)
+	if !ok {
+		return nil, fmt.Errorf("want map buffer at %q", k)
+	}
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+	var deleted []string
+	if len(d.P) > 0 {
+		deleted = b.deletePrefix(d.P)
+	} else {
+		deleted, _ = b.deleteMatch(d.G)
+	}
+	changes := make([]OpD, len(deleted))
+	for i, rk := range deleted {
+		changes[i] = OpD{K: k + keySeparator + rk}
+	}
+	return changes, nil
+}
+
+// swap sets the record at key k (the buffer key, followed by the record key) using compare-and-swap,
+// and returns the record as stored, if set.
+func (p *Page) swap(k string, expected, v interface{}) ([]interface{}, bool, error) {
+	i := strings.LastIndex(k, keySeparator)
+	if i < 0 {
+		return nil, false, fmt.Errorf("want record key in %q", k)
+	}
+	b, ok := p.at(k[:i]).(*MapBuf)
+	if !ok {
+		return nil, false, fmt.Errorf("want map buffer at %q", k[:i])
+	}
+	tup, ok := b.swap(k[i+len(keySeparator):], expected, v)
+	return tup, ok, nil
+}
+
+// rename renames a field of the buffer at key k.
+func (p *Page) rename(ns *Namespace, k, from, to string) error {
+	var t *Typ
+	switch b := p.at(k).(type) {
+	case *FixBuf:
+		t = &b.t
+	case *CycBuf:
+		t = &b.b.t
+	case *MapBuf:
+		t = &b.t
+	default:
+		return fmt.Errorf("want buffer at %q", k)
+	}
+	renamed, err := ns.rename(*t, from, to)
+	if err != nil {
+		return err
+	}
+	*t = renamed
+	return nil
+}
+
+// fill writes a tuple to every slot of the fixed buffer at key k, or clears the buffer if v is nil, and returns
+// the tuple as stored.
+func (p *Page) fill(k string, v interface{}) ([]interface{}, error) {
+	b, ok := p.at(k).(*FixBuf)
+	if !ok {
+		return nil, fmt.Errorf("want fixed buffer at %q", k)
+	}
+	if v == nil {
+		b.clear()
+		return nil, nil
+	}
+	tup, err := b.t.check(v)
+	if err != nil {
+		return nil, err
+	}
+	b.fill(tup)
+	return tup, nil
+}
+
+// resize changes the size of the cyclic buffer at key k to n, retaining the most recent tuples, and returns the buffer.
+func (p *Page) resize(k string, n int) (*CycBuf, error) {
+	b, ok := p.at(k).(*CycBuf)
+	if !ok {
+		return nil, fmt.Errorf("want cyclic buffer at %q", k)
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("want positive size, got %d", n)
+	}
+	b.resize(n)
+	return b, nil
+}
+
+// appendSlots writes tuples to the empty slots of the fixed buffer at key k, and returns the slots written, as changes
+// to individual slots with values as stored. Tuples that do not match the buffer's type are skipped.
+func (p *Page) appendSlots(k string, tups [][]interface{}) ([]OpD, error) {
+	b, ok := p.at(k).(*FixBuf)
+	if !ok {
+		return nil, fmt.Errorf("want fixed buffer at %q", k)
+	}
+	written := b.appendAll(tups)
+	changes := make([]OpD, len(written))
+	for j, i := range written {
+		changes[j] = OpD{K: k + keySeparator + strconv.Itoa(i), V: tupValue(b.tups[i])}
+	}
+	return changes, nil
+}
+
+// insert inserts a tuple at index i of the fixed buffer at key k, shifting subsequent tuples down, and returns
+// the buffer.
+func (p *Page) insert(k string, i int, v interface{}) (*FixBuf, error) {
+	b, ok := p.at(k).(*FixBuf)
+	if !ok {
+		return nil, fmt.Errorf("want fixed buffer at %q", k)
+	}
+	if _, err := b.t.check(v); err != nil {
+		return nil, err
+	}
+	if !b.insert(i, v) {
+		return nil, fmt.Errorf("index out of range: %d", i)
+	}
+	return b, nil
+}
+
+// compact compacts the map buffer at key k.
+func (p *Page) compact(k string) error {
+	b, ok := p.at(k).(*MapBuf)
+	if !ok {
+		return fmt.Errorf("want map buffer at %q", k)
+	}
+	b.compact()
+	return nil
+}
+
+// append appends tuples to the cyclic buffer at key k, and returns the tuples appended, as stored.
+// Tuples that do not match the buffer's type are skipped.
+func (p *Page) append(k string, tups [][]interface{}) (*AppendD, error) {
+	b, ok := p.at(k).(*CycBuf)
+	if !ok {
+		return nil, fmt.Errorf("want cyclic buffer at %q", k)
+	}
+	d := &AppendD{}
+	if len(b.b.tups) == 0 {
+		return d, nil
+	}
+	for _, tup := range tups {
+		seq, full := b.seq, b.b.tups[b.i] != nil
+		b.set("", tup)
+		if b.seq == seq {
+			continue
+		}
+		c, _ := b.latest()
+		d.D = append(d.D, c.tup)
+		if full {
+			d.E++
+		}
+	}
+	return d, nil
+}
+
 func (p *Page) dump() *PageD {
 	c := make(map[string]CardD)
 	for k, v := range p.cards {
@@ -65,5 +311,8 @@ func loadPage(ns *Namespace, d *PageD) *Page {
 	for k, v := range d.C {
 		cards[k] = loadCard(ns, v)
 	}
-	return &Page{cards: cards}
+	p := &Page{cards: cards}
+	p.size = p.measure()
+	p.retain(ns)
+	return p
 }
@@ -1,15 +1,27 @@
 package wave
 
+import "encoding/json"
+
 // OpsD represents the set of changes to be applied to a Page. This is a discriminated union.
 type OpsD struct {
 	P *PageD                 `json:"p,omitempty"` // page
 	C map[string]interface{} `json:"c,omitempty"` // FIXME comment - is this required?
 	D []OpD                  `json:"d,omitempty"` // deltas
 	R int                    `json:"r,omitempty"` // reset
+	E string                 `json:"e,omitempty"` // error
+	U string                 `json:"u,omitempty"` // page url, if sent to clients watching a pattern
+	X []OpErrorD             `json:"x,omitempty"` // errors, per invalid op, if changes were rejected
+}
+
+// OpErrorD represents an error in an op.
+type OpErrorD struct {
+	I int    `json:"i"` // index of op
+	K string `json:"k"` // key
+	E string `json:"e"` // error
 }
 
 // OpD represents a delta operation (effector)
-// Discriminated union; valid combos: K, set:KV|KC|KF|KM, put:KD|KDB
+// Discriminated union; valid combos: K, set:KV|KC|KF|KM, put:KD|KDB, update:KU, swap:KW, rename:KN, fill:KL, append:KA, compact:KZ
 type OpD struct {
 	K string                 `json:"k,omitempty"` // key; ""=drop page
 	V interface{}            `json:"v,omitempty"` // value
@@ -18,6 +30,63 @@ type OpD struct {
 	M *MapBufD               `json:"m,omitempty"` // value
 	D map[string]interface{} `json:"d,omitempty"` // card data
 	B []BufD                 `json:"b,omitempty"` // card buffers
+	U map[string]interface{} `json:"u,omitempty"` // records to merge into map buffer
+	W *SwapD                 `json:"w,omitempty"` // compare-and-swap record in map buffer
+	N *RenameD               `json:"n,omitempty"` // rename field in buffer's type
+	L *FillD                 `json:"l,omitempty"` // fill fixed buffer
+	A *AppendD               `json:"a,omitempty"` // append to cyclic buffer, or to the empty slots of fixed buffer
+	J *InsertD               `json:"j,omitempty"` // insert into fixed buffer
+	Z bool                   `json:"z,omitempty"` // compact map buffer; not broadcast or logged
+	X *DeleteD               `json:"x,omitempty"` // delete records from map buffer by key prefix or pattern
+	S int                    `json:"s,omitempty"` // resize cyclic buffer, retaining the most recent tuples
+	I string                 `json:"i,omitempty"` // op id, if supplied by the client; ops with ids already applied are skipped
+}
+
+// FilterD represents the records of a map buffer a client is interested in.
+type FilterD struct {
+	K string   `json:"k"`           // buffer key
+	S []string `json:"s,omitempty"` // record keys; a trailing "*" matches keys by prefix; empty=all records
+}
+
+// AppendD represents tuples appended to a cyclic buffer.
+type AppendD struct {
+	D [][]interface{} `json:"d"`           // tuples, oldest first
+	E int             `json:"e,omitempty"` // number of tuples evicted from the front of the buffer, as a result
+}
+
+// DeleteD represents an operation to delete the records of a map buffer whose keys have a prefix or match a pattern.
+type DeleteD struct {
+	P string `json:"p,omitempty"` // key prefix
+	G string `json:"g,omitempty"` // key pattern, using the syntax of path.Match, if no prefix
+}
+
+// InsertD represents an operation to insert a tuple into a fixed buffer, shifting subsequent tuples down.
+type InsertD struct {
+	I int         `json:"i"` // index; negative indices count from the end
+	V interface{} `json:"v"` // tuple
+}
+
+// FillD represents an operation to write a tuple to every slot of a fixed buffer.
+type FillD struct {
+	V interface{} `json:"v"` // tuple; nil=clear
+}
+
+// RenameD represents an operation to rename a field.
+type RenameD struct {
+	F string `json:"f"` // from: field name
+	T string `json:"t"` // to: new field name
+}
+
+// SwapD represents a compare-and-swap operation on a record.
+type SwapD struct {
+	E interface{} `json:"e"` // expected value; nil=record must not exist
+	V interface{} `json:"v"` // new value
+}
+
+// SiteD represents a snapshot of a Site.
+type SiteD struct {
+	T [][]string                 `json:"t"` // types
+	P map[string]json.RawMessage `json:"p"` // url => PageD
 }
 
 // PageD represents the marshaled data for a Page.
@@ -36,27 +105,126 @@ type BufD struct {
 	C *CycBufD `json:"c,omitempty"`
 	F *FixBufD `json:"f,omitempty"`
 	M *MapBufD `json:"m,omitempty"`
+	X *DataD   `json:"x,omitempty"` // buffer of declared kind
+}
+
+// DataD represents a buffer whose kind is declared at creation, rather than implied by the shape of its data.
+type DataD struct {
+	B string      `json:"b"`           // buffer: "c"=cyclic, "f"=fixed, "m"=map
+	F []string    `json:"f"`           // fields
+	S []string    `json:"s,omitempty"` // field specs, if different from fields
+	N int         `json:"n,omitempty"` // size (cyclic, fixed); defaults to the number of records, else 10
+	D interface{} `json:"d,omitempty"` // initial records: a list of tuples (cyclic, fixed), or an object of key => tuple (map)
 }
 
 // MapBufD represents the marshaled data for a MapBuf.
 type MapBufD struct {
-	F []string                 `json:"f"` // fields
-	D map[string][]interface{} `json:"d"` // tuples
+	F []string                 `json:"f"`           // fields
+	D map[string][]interface{} `json:"d"`           // tuples
+	S []string                 `json:"s,omitempty"` // field specs, if different from fields
+	O int                      `json:"o,omitempty"` // format: 0=rows (D), 1=columns (K, X)
+	K []string                 `json:"k,omitempty"` // keys, in sort order
+	X [][]interface{}          `json:"x,omitempty"` // columns, if columnar
+	T int                      `json:"t,omitempty"` // time-to-live for records, in seconds; 0=forever
+	Y string                   `json:"y,omitempty"` // sort order: ""=insertion, "*"=by key, else by the named numeric field
 }
 
 // FixBufD represents the marshaled data for a FixBuf.
 type FixBufD struct {
-	F []string        `json:"f"` // fields
-	D [][]interface{} `json:"d"` // tuples
-	N int             `json:"n"` // size
+	F []string        `json:"f"`           // fields
+	D [][]interface{} `json:"d"`           // tuples
+	N int             `json:"n"`           // size
+	S []string        `json:"s,omitempty"` // field specs, if different from fields
+	O int             `json:"o,omitempty"` // format: 0=rows (D), 1=columns (X)
+	X [][]interface{} `json:"x,omitempty"` // columns, if columnar
 }
 
 // CycBufD represents the marshaled data for a CycBuf.
 type CycBufD struct {
-	F []string        `json:"f"` // fields
-	D [][]interface{} `json:"d"` // tuples
-	N int             `json:"n"` // size
-	I int             `json:"i"` // index
+	F []string        `json:"f"`           // fields
+	D [][]interface{} `json:"d"`           // tuples
+	N int             `json:"n"`           // size
+	I int             `json:"i"`           // index
+	L int             `json:"l,omitempty"` // fill count: number of slots holding tuples; if omitted, counted from D
+	Q int64           `json:"q,omitempty"` // sequence number of the oldest tuple: the number of tuples appended before it
+	S []string        `json:"s,omitempty"` // field specs, if different from fields
+	O int             `json:"o,omitempty"` // format: 0=rows (D), 1=columns (X)
+	X [][]interface{} `json:"x,omitempty"` // columns, if columnar
+}
+
+// QueryD represents a read-only query against a buffer. This is a discriminated union.
+type QueryD struct {
+	P string   `json:"p"`           // page url
+	K string   `json:"k"`           // buffer key
+	G []string `json:"g,omitempty"` // get records at keys (MapBuf)
+	A string   `json:"a,omitempty"` // aggregate values of field (CycBuf)
+	R *RangeD  `json:"r,omitempty"` // get records in range (FixBuf, CycBuf)
+	T bool     `json:"t,omitempty"` // get schema (any buffer)
+	S *SampleD `json:"s,omitempty"` // get downsampled records (CycBuf)
+	B *GroupD  `json:"b,omitempty"` // aggregate values of field, grouped by another (any buffer)
+}
+
+// GroupD represents a request to group records by the values of a field, and aggregate each group.
+// Records having no value for the grouping field are grouped under "null".
+type GroupD struct {
+	G string `json:"g"`           // field to group by
+	F string `json:"f,omitempty"` // field to aggregate; not required for "count"
+	A string `json:"a"`           // aggregate: "count", "sum", "mean", "min" or "max"
+}
+
+// SampleD represents a request for a downsampled view of a buffer's records, in chronological order.
+type SampleD struct {
+	N int    `json:"n"`           // max records
+	M string `json:"m,omitempty"` // method: "stride" (default) or "lttb"
+	X string `json:"x,omitempty"` // lttb: numeric or datetime field to plot against; record index if omitted
+	Y string `json:"y,omitempty"` // lttb: numeric field to preserve the shape of
+}
+
+// RangeD represents a range of buffer indices, using Python slice semantics.
+// For cyclic buffers, indices are in chronological order (0=oldest).
+type RangeD struct {
+	Start *int `json:"start,omitempty"`
+	Stop  *int `json:"stop,omitempty"`
+	Step  *int `json:"step,omitempty"`
+}
+
+// QueryResultD represents the result of a query.
+type QueryResultD struct {
+	E string      `json:"e,omitempty"` // error
+	R interface{} `json:"r,omitempty"` // result
+}
+
+// RecordsD represents a list of records returned by a query.
+type RecordsD struct {
+	D [][]interface{} `json:"d"` // tuples; nil if not found
+	X []bool          `json:"x"` // found?
+}
+
+// SchemaD represents the data type of a buffer.
+type SchemaD struct {
+	B string   `json:"b"` // buffer: "c"=cyclic, "f"=fixed, "m"=map
+	F []FieldD `json:"f"` // fields
+}
+
+// FieldD represents the attributes of a field.
+type FieldD struct {
+	N string      `json:"n"`           // name
+	K string      `json:"k"`           // kind: "any", "time", "int", "float", "str", "bool", "tuple"
+	A bool        `json:"a,omitempty"` // array of values of kind?
+	O bool        `json:"o,omitempty"` // nullable (optional)?
+	D interface{} `json:"d,omitempty"` // default value
+	E []string    `json:"e,omitempty"` // allowed values, if an enum
+	T []FieldD    `json:"t,omitempty"` // fields of nested tuples, if a tuple
+	C bool        `json:"c,omitempty"` // values of other kinds converted?
+}
+
+// AggD represents summary statistics over the values of a field.
+type AggD struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
 }
 
 // AppRequest represents a request from an app.
@@ -3,6 +3,7 @@ package wave
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -11,7 +12,9 @@ import (
 
 // Proxy represents a HTTP proxy
 type Proxy struct {
-	client *http.Client
+	client  *http.Client
+	maxSize int64        // max request body size
+	stream  *http.Client // client for streamed responses; not subject to an overall timeout
 }
 
 // ProxyRequest represents the request to be sent to the upstream server.
@@ -20,6 +23,7 @@ type ProxyRequest struct {
 	URL     string              `json:"url"`
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
+	Stream  bool                `json:"stream"` // relay the upstream response as-is, as it arrives, instead of as a ProxyResult?
 }
 
 // ProxyResponse represents the response received from the upstream server.
@@ -36,21 +40,44 @@ type ProxyResult struct {
 	Result *ProxyResponse `json:"result"`
 }
 
-func newProxy() *Proxy {
+// Headers applicable to a single connection, which must not be relayed.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func newProxy(maxSize int64) *Proxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Second * 10
 	return &Proxy{
 		&http.Client{
 			Timeout: time.Second * 10,
 		},
+		maxSize,
+		&http.Client{
+			Transport: transport,
+		},
 	}
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
-		req, err := ioutil.ReadAll(r.Body) // XXX limit
+		req, err := readBody(r, p.maxSize)
 		if err != nil {
 			echo(Log{"t": "read proxy request body", "error": err.Error()})
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			replyBodyError(w, err)
+			return
+		}
+		var pr ProxyRequest
+		if err := json.Unmarshal(req, &pr); err == nil && pr.Stream {
+			p.relay(w, r, pr)
 			return
 		}
 		res, err := p.forward(req)
@@ -85,6 +112,61 @@ func (p *Proxy) forward(input []byte) ([]byte, error) {
 	return output, nil
 }
 
+// relay streams the upstream response to w as it arrives, flushing after every write, so that chunked
+// and event-stream responses reach the client incrementally. The upstream request is canceled if the client goes away.
+func (p *Proxy) relay(w http.ResponseWriter, r *http.Request, pr ProxyRequest) {
+	req, err := http.NewRequestWithContext(r.Context(), pr.Method, pr.URL, strings.NewReader(pr.Body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+		return
+	}
+	for name, values := range pr.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	resp, err := p.stream.Do(req)
+	if err != nil {
+		echo(Log{"t": "proxy_stream", "url": pr.URL, "error": err.Error()})
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusBadGateway), err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	h := w.Header()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	w.WriteHeader(resp.StatusCode) // headers go out before the body; without a Content-Length, the body is chunked.
+
+	var dst io.Writer = w
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+		dst = flushWriter{w, f}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil && r.Context().Err() == nil {
+		echo(Log{"t": "proxy_stream", "url": pr.URL, "error": err.Error()})
+	}
+}
+
+// flushWriter flushes after every write.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
 func (p *Proxy) do(pr ProxyRequest) (ProxyResponse, error) {
 	var none ProxyResponse
 
@@ -0,0 +1,121 @@
+package wave
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// proxyRequest returns the body of a request to proxy.
+func proxyRequest(t *testing.T, method, url string, stream bool) string {
+	t.Helper()
+	return toJSON(t, ProxyRequest{method, url, map[string][]string{"X-Test": {"1"}}, "", stream})
+}
+
+func TestProxyStream(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Echo", r.Header.Get("X-Test"))
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+		fmt.Fprint(w, "data: 2\n\n")
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(newProxy(1 << 20))
+	defer proxy.Close()
+
+	var timedOut int32
+	timer := time.AfterFunc(5*time.Second, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		close(next)
+	})
+	resp, err := http.Post(proxy.URL, contentTypeJSON, strings.NewReader(proxyRequest(t, http.MethodGet, upstream.URL, true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for _, tc := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"status", resp.StatusCode, http.StatusAccepted},
+		{"content type", resp.Header.Get("Content-Type"), "text/event-stream"},
+		{"request header", resp.Header.Get("X-Echo"), "1"},
+		{"hop header", resp.Header.Get("Keep-Alive"), ""},
+		{"chunked", resp.TransferEncoding, []string{"chunked"}},
+	} {
+		if fmt.Sprint(tc.got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, tc.got)
+		}
+	}
+	br := bufio.NewReader(resp.Body)
+	if line, err := br.ReadString('\n'); err != nil || line != "data: 1\n" {
+		t.Fatalf("want first event, got %q, %v", line, err)
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		t.Fatal("want first event relayed before upstream response completed")
+	}
+	if timer.Stop() {
+		close(next)
+	}
+	if rest, err := ioutil.ReadAll(br); err != nil || string(rest) != "\ndata: 2\n\n" {
+		t.Errorf("want rest of stream, got %q, %v", rest, err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.Header.Get("X-Test"))
+	}))
+	defer upstream.Close()
+	for _, tc := range []struct {
+		name   string
+		method string
+		body   string
+		status int
+		want   string // result body, or error, if buffered
+	}{
+		{"buffered", http.MethodPost, proxyRequest(t, http.MethodGet, upstream.URL, false), http.StatusOK, "hello 1"},
+		{"buffered, unreachable", http.MethodPost, proxyRequest(t, http.MethodGet, "http://127.0.0.1:0", false), http.StatusOK, "error"},
+		{"streamed", http.MethodPost, proxyRequest(t, http.MethodGet, upstream.URL, true), http.StatusOK, "hello 1"},
+		{"streamed, unreachable", http.MethodPost, proxyRequest(t, http.MethodGet, "http://127.0.0.1:0", true), http.StatusBadGateway, ""},
+		{"streamed, bad method", http.MethodPost, proxyRequest(t, "BAD METHOD", upstream.URL, true), http.StatusBadRequest, ""},
+		{"bad request", http.MethodPost, `{`, http.StatusBadRequest, ""},
+		{"not a post", http.MethodGet, ``, http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		newProxy(1<<20).ServeHTTP(w, httptest.NewRequest(tc.method, "/_p", strings.NewReader(tc.body)))
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, w.Code)
+			continue
+		}
+		if tc.want == "" {
+			continue
+		}
+		got := w.Body.String()
+		if strings.HasPrefix(tc.name, "buffered") {
+			var result ProxyResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if got = "error"; result.Result != nil {
+				got = result.Result.Body
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// QueryServer represents a server for read-only queries against buffers.
+type QueryServer struct {
+	site     *Site
+	access   *AccessControl
+	sessions *OIDCSessions
+	apiKeys  []APIKey
+	maxSize  int64 // max request body size
+}
+
+func newQueryServer(site *Site, access *AccessControl, sessions *OIDCSessions, apiKeys []APIKey, maxSize int64) *QueryServer {
+	return &QueryServer{site, access, sessions, apiKeys, maxSize}
+}
+
+func (s *QueryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := readBody(r, s.maxSize)
+	if err != nil {
+		echo(Log{"t": "read query request body", "error": err.Error()})
+		replyBodyError(w, err)
+		return
+	}
+	var q QueryD
+	if err := json.Unmarshal(b, &q); err != nil {
+		echo(Log{"t": "json_unmarshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if principals := principalsOf(r, s.sessions, s.apiKeys); !s.access.canRead(q.P, principals...) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var result QueryResultD
+	if res, err := s.query(q); err != nil {
+		result.E = err.Error()
+	} else {
+		result.R = res
+	}
+
+	res, err := json.Marshal(result)
+	if err != nil {
+		echo(Log{"t": "query", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(res)
+}
+
+func (s *QueryServer) query(q QueryD) (interface{}, error) {
+	page := s.site.at(q.P)
+	if page == nil {
+		return nil, fmt.Errorf("page not found: %s", q.P)
+	}
+	page.RLock()
+	defer page.RUnlock()
+
+	x := page.at(q.K)
+	if x == nil {
+		return nil, fmt.Errorf("buffer not found: %s", q.K)
+	}
+	if q.G != nil {
+		b, ok := x.(*MapBuf)
+		if !ok {
+			return nil, fmt.Errorf("want map buffer at %q", q.K)
+		}
+		curs, found := b.getAll(q.G)
+		tups := make([][]interface{}, len(curs))
+		for i, c := range curs {
+			tups[i] = c.tup
+		}
+		return RecordsD{tups, found}, nil
+	}
+	if q.R != nil {
+		switch b := x.(type) {
+		case *FixBuf:
+			return slice(b.tups, q.R.Start, q.R.Stop, q.R.Step)
+		case *CycBuf:
+			return slice(b.chrono(), q.R.Start, q.R.Stop, q.R.Step)
+		}
+		return nil, fmt.Errorf("want fixed or cyclic buffer at %q", q.K)
+	}
+	if q.T {
+		switch b := x.(type) {
+		case *FixBuf:
+			return SchemaD{"f", b.t.schema()}, nil
+		case *CycBuf:
+			return SchemaD{"c", b.b.t.schema()}, nil
+		case *MapBuf:
+			return SchemaD{"m", b.t.schema()}, nil
+		}
+		return nil, fmt.Errorf("want buffer at %q", q.K)
+	}
+	if q.S != nil {
+		b, ok := x.(*CycBuf)
+		if !ok {
+			return nil, fmt.Errorf("want cyclic buffer at %q", q.K)
+		}
+		return b.sample(*q.S)
+	}
+	if q.B != nil {
+		switch b := x.(type) {
+		case *FixBuf:
+			return group(b.t, b.tups, *q.B)
+		case *CycBuf:
+			return group(b.b.t, b.b.tups, *q.B)
+		case *MapBuf:
+			return group(b.t, b.records(), *q.B)
+		}
+		return nil, fmt.Errorf("want buffer at %q", q.K)
+	}
+	if len(q.A) > 0 {
+		b, ok := x.(*CycBuf)
+		if !ok {
+			return nil, fmt.Errorf("want cyclic buffer at %q", q.K)
+		}
+		return b.aggregate(q.A)
+	}
+	return nil, fmt.Errorf("empty query")
+}
@@ -0,0 +1,191 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var queryPages = map[string]string{
+	"/p": `{"d":[
+		{"k":"m","d":{"~items":0},"b":[{"m":{"f":["a","b"],"d":{"x":[1,"u"],"y":[2,"v"],"z":[3,"u"]}}}]},
+		{"k":"f","d":{"~items":0},"b":[{"f":{"f":["a"],"d":[[1],[2],[3],[4],[5]],"n":5}}]},
+		{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[4],[5],[3]],"n":3,"i":2}}]}
+	]}`,
+}
+
+// query posts a query to a query server over the site, and returns the response body.
+func query(t *testing.T, site *Site, q string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	newQueryServer(site, nil, nil, nil, 1<<20).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/_q", strings.NewReader(q)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("query %s: want status 200, got %d", q, w.Code)
+	}
+	return strings.TrimSpace(w.Body.String())
+}
+
+func TestQueryGet(t *testing.T) {
+	site := newTestSite(t, queryPages)
+	for _, tc := range []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"found", `{"p":"/p","k":"m items","g":["y","x"]}`, `{"r":{"d":[[2,"v"],[1,"u"]],"x":[true,true]}}`},
+		{"missing", `{"p":"/p","k":"m items","g":["x","w"]}`, `{"r":{"d":[[1,"u"],null],"x":[true,false]}}`},
+		{"none", `{"p":"/p","k":"m items","g":[]}`, `{"r":{"d":[],"x":[]}}`},
+		{"not a map buffer", `{"p":"/p","k":"f items","g":["x"]}`, `{"e":"want map buffer at \"f items\""}`},
+		{"no buffer", `{"p":"/p","k":"m other","g":["x"]}`, `{"e":"buffer not found: m other"}`},
+		{"no page", `{"p":"/q","k":"m items","g":["x"]}`, `{"e":"page not found: /q"}`},
+	} {
+		if got := query(t, site, tc.q); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestQueryServerRejects(t *testing.T) {
+	site := newTestSite(t, queryPages)
+	ac := &AccessControl{map[string]AccessPolicy{"/p": {Read: []string{"alice"}}}}
+	for _, tc := range []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"method", http.MethodGet, ``, http.StatusMethodNotAllowed},
+		{"bad json", http.MethodPost, `{`, http.StatusBadRequest},
+		{"forbidden", http.MethodPost, `{"p":"/p","k":"m items","g":["x"]}`, http.StatusForbidden},
+		{"too large", http.MethodPost, `{"p":"/p","k":"m items","g":["` + strings.Repeat("x", 100) + `"]}`, http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		newQueryServer(site, ac, nil, nil, 64).ServeHTTP(w, httptest.NewRequest(tc.method, "/_q", strings.NewReader(tc.body)))
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
+
+func TestQueryAggregate(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/p": `{"d":[
+			{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a","b"],"d":[[4,"x"],[null,"y"],[1,"z"],["2","w"],null],"n":5,"i":4}}]},
+			{"k":"m","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{"x":[1]}}}]}
+		]}`,
+	})
+	for _, tc := range []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"numbers", `{"p":"/p","k":"c items","a":"a"}`, `{"r":{"min":1,"max":4,"sum":5,"count":2,"mean":2.5}}`},
+		{"by index", `{"p":"/p","k":"c items","a":"0"}`, `{"r":{"min":1,"max":4,"sum":5,"count":2,"mean":2.5}}`},
+		{"no numbers", `{"p":"/p","k":"c items","a":"b"}`, `{"r":{"min":0,"max":0,"sum":0,"count":0,"mean":0}}`},
+		{"no field", `{"p":"/p","k":"c items","a":"z"}`, `{"e":"field not found: z"}`},
+		{"not a cyclic buffer", `{"p":"/p","k":"m items","a":"a"}`, `{"e":"want cyclic buffer at \"m items\""}`},
+	} {
+		if got := query(t, site, tc.q); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	site := newTestSite(t, queryPages)
+	for _, tc := range []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"fixed", `{"p":"/p","k":"f items","r":{"start":1,"stop":-1,"step":2}}`, `{"r":[[2],[4]]}`},
+		{"cyclic, oldest first", `{"p":"/p","k":"c items","r":{}}`, `{"r":[[3],[4],[5]]}`},
+		{"cyclic, newest first", `{"p":"/p","k":"c items","r":{"step":-1}}`, `{"r":[[5],[4],[3]]}`},
+		{"zero step", `{"p":"/p","k":"f items","r":{"step":0}}`, `{"e":"slice step cannot be zero"}`},
+		{"not a list buffer", `{"p":"/p","k":"m items","r":{}}`, `{"e":"want fixed or cyclic buffer at \"m items\""}`},
+	} {
+		if got := query(t, site, tc.q); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestQuerySchema(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/p": `{"d":[
+			{"k":"m","d":{"~items":0},"b":[{"m":{"f":["a","b:int?","c:str=x"],"d":{}}}]},
+			{"k":"f","d":{"~items":0},"b":[{"f":{"f":["a:[]float"],"n":1}}]},
+			{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a:enum(x|y)","t:time"],"n":1}}]},
+			{"k":"n","d":{"v":1}}
+		]}`,
+	})
+	for _, tc := range []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"map", `{"p":"/p","k":"m items","t":true}`, `{"r":{"b":"m","f":[{"n":"a","k":"any"},{"n":"b","k":"int","o":true},{"n":"c","k":"str","o":true,"d":"x"}]}}`},
+		{"fixed", `{"p":"/p","k":"f items","t":true}`, `{"r":{"b":"f","f":[{"n":"a","k":"float","a":true}]}}`},
+		{"cyclic", `{"p":"/p","k":"c items","t":true}`, `{"r":{"b":"c","f":[{"n":"a","k":"str","e":["x","y"]},{"n":"t","k":"time"}]}}`},
+		{"not a buffer", `{"p":"/p","k":"n v","t":true}`, `{"e":"want buffer at \"n v\""}`},
+	} {
+		if got := query(t, site, tc.q); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestQuerySample(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/p": `{"d":[
+			{"k":"c","d":{"~items":0},"b":[{"c":{"f":["t:time","v"],"d":[
+				["2020-01-01T00:00:03Z",0],["2020-01-01T00:00:04Z",9],
+				["2020-01-01T00:00:00Z",0],["2020-01-01T00:00:01Z",0],["2020-01-01T00:00:02Z",0]
+			],"n":5,"i":2}}]},
+			{"k":"m","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{"x":[1]}}}]}
+		]}`,
+	})
+	for _, tc := range []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"stride, oldest first", `{"p":"/p","k":"c items","s":{"n":3}}`, `{"r":[["2020-01-01T00:00:00Z",0],["2020-01-01T00:00:02Z",0],["2020-01-01T00:00:04Z",9]]}`},
+		{"lttb against time", `{"p":"/p","k":"c items","s":{"n":3,"m":"lttb","x":"t","y":"v"}}`, `{"r":[["2020-01-01T00:00:00Z",0],["2020-01-01T00:00:03Z",0],["2020-01-01T00:00:04Z",9]]}`},
+		{"no x field", `{"p":"/p","k":"c items","s":{"n":3,"m":"lttb","x":"z","y":"v"}}`, `{"e":"field not found: z"}`},
+		{"no y field", `{"p":"/p","k":"c items","s":{"n":3,"m":"lttb","y":"z"}}`, `{"e":"field not found: z"}`},
+		{"bad size", `{"p":"/p","k":"c items","s":{"n":0}}`, `{"e":"want sample size \u003e 0, got 0"}`},
+		{"not a cyclic buffer", `{"p":"/p","k":"m items","s":{"n":3}}`, `{"e":"want cyclic buffer at \"m items\""}`},
+	} {
+		if got := query(t, site, tc.q); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestQueryGroup(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/p": `{"d":[
+			{"k":"m","d":{"~items":0},"b":[{"m":{"f":["g","v"],"d":{"x":["a",1],"y":["b",2],"z":["a",3],"w":[null,4]}}}]},
+			{"k":"f","d":{"~items":0},"b":[{"f":{"f":["g","v"],"d":[["a",1],null,["a",2]],"n":3}}]},
+			{"k":"c","d":{"~items":0},"b":[{"c":{"f":["g","v"],"d":[["b",1],["b",5],null],"n":3,"i":2}}]},
+			{"k":"n","d":{"v":1}}
+		]}`,
+	})
+	for _, tc := range []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"map", `{"p":"/p","k":"m items","b":{"g":"g","f":"v","a":"sum"}}`, `{"r":{"a":4,"b":2,"null":4}}`},
+		{"fixed", `{"p":"/p","k":"f items","b":{"g":"g","a":"count"}}`, `{"r":{"a":2}}`},
+		{"cyclic", `{"p":"/p","k":"c items","b":{"g":"g","f":"v","a":"mean"}}`, `{"r":{"b":3}}`},
+		{"bad field", `{"p":"/p","k":"m items","b":{"g":"z","a":"count"}}`, `{"e":"field not found: z"}`},
+		{"not a buffer", `{"p":"/p","k":"n v","b":{"g":"g","a":"count"}}`, `{"e":"want buffer at \"n v\""}`},
+	} {
+		if got := query(t, site, tc.q); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package wave
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("rate limit exceeded: too many changes, try again later")
+
+// RateLimiter limits the rate at which each client can apply changes, using a token bucket per client.
+// A nil RateLimiter allows everything.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64            // tokens added per second
+	burst   float64            // max tokens held
+	exempt  map[string]bool    // principals not subject to limits
+	buckets map[string]*Bucket // client key => bucket
+	pruned  time.Time          // when full buckets were last discarded
+}
+
+// Bucket represents a token bucket.
+type Bucket struct {
+	tokens float64
+	last   time.Time // when tokens was last updated
+}
+
+// newRateLimiter returns a limiter allowing rate changes per second, in bursts of up to burst changes,
+// or nil if rate is not positive. exempt is a comma-separated list of principals not subject to limits.
+func newRateLimiter(rate float64, burst int, exempt string) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	ex := make(map[string]bool)
+	for _, p := range strings.Split(exempt, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			ex[p] = true
+		}
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), exempt: ex, buckets: make(map[string]*Bucket), pruned: time.Now()}
+}
+
+// allow reports whether the client identified by key, acting on behalf of principal, can apply a change now.
+func (l *RateLimiter) allow(key, principal string) bool {
+	if l == nil || l.exempt[principal] {
+		return true
+	}
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.pruned) > time.Minute {
+		l.prune(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &Bucket{l.burst, now}
+		l.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune discards buckets that would have refilled by now, since they are indistinguishable from new ones.
+func (l *RateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.pruned = now
+}
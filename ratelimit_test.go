@@ -0,0 +1,112 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2, "svc, ops")
+	for _, tc := range []struct {
+		name      string
+		key       string
+		principal string
+		wait      time.Duration // backdating of the key's bucket, before the change
+		want      bool
+	}{
+		{"burst", "a", "alice", 0, true},
+		{"burst", "a", "alice", 0, true},
+		{"burst exhausted", "a", "alice", 0, false},
+		{"other client", "b", "alice", 0, true},
+		{"exempt", "a", "svc", 0, true},
+		{"exempt, trimmed", "a", "ops", 0, true},
+		{"refilled", "a", "alice", time.Second, true},
+		{"refilled once", "a", "alice", 0, false},
+		{"refilled up to burst", "a", "alice", time.Hour, true},
+		{"refilled up to burst", "a", "alice", 0, true},
+		{"refilled up to burst", "a", "alice", 0, false},
+	} {
+		if b, ok := l.buckets[tc.key]; ok {
+			b.last = b.last.Add(-tc.wait)
+		}
+		if got := l.allow(tc.key, tc.principal); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+	if _, ok := l.buckets["svc"]; ok {
+		t.Error("want no buckets for exempt principals")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		l := newRateLimiter(rate, 1, "")
+		if l != nil {
+			t.Errorf("%v: want limiter disabled", rate)
+		}
+		for i := 0; i < 10; i++ {
+			if !l.allow("a", "alice") {
+				t.Fatalf("%v: want all changes allowed", rate)
+			}
+		}
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(1, 2, "")
+	l.allow("full", "alice")
+	l.allow("drained", "alice")
+	l.allow("drained", "alice")
+	now := time.Now()
+	l.buckets["full"].last = now.Add(-2 * time.Second)
+	l.prune(now)
+	if _, ok := l.buckets["full"]; ok {
+		t.Error("want refilled bucket discarded")
+	}
+	if _, ok := l.buckets["drained"]; !ok {
+		t.Error("want drained bucket kept")
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	b := newTestBroker(nil)
+	b.limiter = newRateLimiter(1e-6, 1, "")
+	c := newTestClient(b, "alice")
+	c.patch("/p", []byte(`{"d":[{"k":"x","d":{"v":1}}]}`))
+	c.patch("/p", []byte(`{"d":[{"k":"x","d":{"v":2}}]}`))
+	if m := recv(t, c); m["e"] != errRateLimited.Error() {
+		t.Errorf("want rate limit error, got %v", m)
+	}
+	if got := toJSON(t, b.site.at("/p").dump()); !strings.Contains(got, `"v":1`) {
+		t.Errorf("want only first change applied, got %s", got)
+	}
+}
+
+func TestWebServerRateLimit(t *testing.T) {
+	s := newTestWebServer(t, "svc:s3cret", nil)
+	s.broker.limiter = newRateLimiter(1e-6, 1, "svc")
+	for _, tc := range []struct {
+		name   string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"allowed", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, http.StatusOK},
+		{"limited", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, http.StatusTooManyRequests},
+		{"exempt", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"exempt, again", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/p", strings.NewReader(`{"d":[{"k":"x","d":{"v":1}}]}`))
+		tc.auth(r)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body)
+		}
+		if limited := w.Header().Get("Retry-After") != ""; limited != (tc.status == http.StatusTooManyRequests) {
+			t.Errorf("%s: want Retry-After only if limited, got %q", tc.name, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package wave
+
+import (
+	"fmt"
+	"math"
+)
+
+// Downsampling methods.
+const (
+	strideSampling = "stride" // every k-th tuple
+	lttbSampling   = "lttb"   // largest-triangle-three-buckets
+)
+
+// downsample returns at most n of tups, in order, chosen using the given method.
+// For LTTB, y is the offset of the numeric field to preserve the shape of, and x is the offset of the numeric
+// or datetime field to plot it against, or -1 to use tuple indices; tuples lacking either value are skipped.
+func downsample(tups [][]interface{}, n int, method string, x, y int) ([][]interface{}, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("want sample size > 0, got %d", n)
+	}
+	switch method {
+	case "", strideSampling:
+		return stride(tups, n), nil
+	case lttbSampling:
+		if y < 0 {
+			return nil, fmt.Errorf("want y field for %s sampling", lttbSampling)
+		}
+		return lttb(tups, n, x, y), nil
+	}
+	return nil, fmt.Errorf("unknown sampling method: %s", method)
+}
+
+// stride returns up to n tuples, evenly spaced, always including the last tuple.
+func stride(tups [][]interface{}, n int) [][]interface{} {
+	if len(tups) <= n {
+		return tups
+	}
+	is := strideIndices(len(tups), n)
+	xs := make([][]interface{}, len(is))
+	for i, j := range is {
+		xs[i] = tups[j]
+	}
+	return xs
+}
+
+// lttb returns n tuples chosen using the largest-triangle-three-buckets algorithm (Steinarsson, 2013).
+func lttb(tups [][]interface{}, n, x, y int) [][]interface{} {
+	type point struct {
+		x, y float64
+		tup  []interface{}
+	}
+	pts := make([]point, 0, len(tups))
+	for i, tup := range tups {
+		yv, ok := number(tup, y)
+		if !ok {
+			continue
+		}
+		xv := float64(i)
+		if x >= 0 {
+			if xv, ok = number(tup, x); !ok {
+				continue
+			}
+		}
+		pts = append(pts, point{xv, yv, tup})
+	}
+
+	if len(pts) <= n || n < 3 {
+		xs := make([][]interface{}, 0, len(pts))
+		for _, i := range strideIndices(len(pts), n) {
+			xs = append(xs, pts[i].tup)
+		}
+		return xs
+	}
+
+	xs := make([][]interface{}, 0, n)
+	xs = append(xs, pts[0].tup)
+	k := float64(len(pts)-2) / float64(n-2) // bucket size, excluding first and last points
+	a := 0                                  // selected point in previous bucket
+	for i := 0; i < n-2; i++ {
+		// average of next bucket
+		lo, hi := int(float64(i+1)*k)+1, int(float64(i+2)*k)+1
+		if hi > len(pts) {
+			hi = len(pts)
+		}
+		var ax, ay float64
+		for _, p := range pts[lo:hi] {
+			ax += p.x
+			ay += p.y
+		}
+		ax /= float64(hi - lo)
+		ay /= float64(hi - lo)
+
+		// point in this bucket forming the largest triangle with the previous point and the next bucket's average
+		lo, hi = int(float64(i)*k)+1, int(float64(i+1)*k)+1
+		best, area := lo, -1.0
+		pa := pts[a]
+		for j := lo; j < hi; j++ {
+			p := pts[j]
+			if s := math.Abs((pa.x-ax)*(p.y-pa.y) - (pa.x-p.x)*(ay-pa.y)); s > area {
+				best, area = j, s
+			}
+		}
+		xs = append(xs, pts[best].tup)
+		a = best
+	}
+	return append(xs, pts[len(pts)-1].tup)
+}
+
+// strideIndices returns the indices of up to n of m elements, evenly spaced, always including the last element.
+func strideIndices(m, n int) []int {
+	if m < n {
+		n = m
+	}
+	is := make([]int, n)
+	if n == 1 {
+		is[0] = m - 1
+		return is
+	}
+	k := float64(m-1) / float64(n-1)
+	for i := range is {
+		is[i] = int(math.Round(float64(i) * k))
+	}
+	return is
+}
+
+// number returns the value at offset i of a tuple as a number; datetimes are converted to epoch milliseconds.
+func number(tup []interface{}, i int) (float64, bool) {
+	if i >= len(tup) {
+		return 0, false
+	}
+	switch v := tup[i].(type) {
+	case float64:
+		return v, true
+	case string:
+		if t, err := toTime(v); err == nil {
+			return float64(t.UnixNano() / int64(1e6)), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,40 @@
+package wave
+
+import "testing"
+
+func TestDownsample(t *testing.T) {
+	spike := `[[0,0],[1,0],[2,0],[3,10],[4,0],[5,0],[6,0],[7,0],[8,-10],[9,0]]`
+	for _, tc := range []struct {
+		name   string
+		tups   string
+		n      int
+		method string
+		x, y   int
+		want   string // sampled tuples, or "error"
+	}{
+		{"stride", spike, 4, "", -1, -1, `[[0,0],[3,10],[6,0],[9,0]]`},
+		{"stride, named", spike, 4, "stride", -1, -1, `[[0,0],[3,10],[6,0],[9,0]]`},
+		{"stride, uneven", spike, 3, "", -1, -1, `[[0,0],[5,0],[9,0]]`},
+		{"stride, one", spike, 1, "", -1, -1, `[[9,0]]`},
+		{"stride, fewer tuples", `[[0,0],[1,0]]`, 4, "", -1, -1, `[[0,0],[1,0]]`},
+		{"lttb keeps extremes", spike, 4, "lttb", 0, 1, `[[0,0],[3,10],[8,-10],[9,0]]`},
+		{"lttb, by index", spike, 4, "lttb", -1, 1, `[[0,0],[3,10],[8,-10],[9,0]]`},
+		{"lttb skips missing values", `[[0,1],[1,null],[2,3]]`, 5, "lttb", 0, 1, `[[0,1],[2,3]]`},
+		{"lttb, too few buckets", spike, 2, "lttb", 0, 1, `[[0,0],[9,0]]`},
+		{"lttb, no y", spike, 4, "lttb", 0, -1, `error`},
+		{"zero size", spike, 0, "", -1, -1, `error`},
+		{"unknown method", spike, 4, "mean", -1, -1, `error`},
+	} {
+		var tups [][]interface{}
+		for _, tup := range mustJSON(t, tc.tups).([]interface{}) {
+			tups = append(tups, tup.([]interface{}))
+		}
+		got := "error"
+		if xs, err := downsample(tups, tc.n, tc.method, tc.x, tc.y); err == nil {
+			got = toJSON(t, xs)
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package wave
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -40,6 +46,12 @@ func Run(conf ServerConf) {
 	// FIXME RBAC
 	users := map[string][]byte{conf.AccessKeyID: accessKeyHash}
 
+	apiKeys, err := parseAPIKeys(conf.APIKeys)
+	if err != nil {
+		echo(Log{"t": "api_keys_init", "error": err.Error()})
+		return
+	}
+
 	// FIXME SESSIONS
 	sessions := newOIDCSessions()
 
@@ -48,45 +60,149 @@ func Run(conf ServerConf) {
 		return
 	}
 
+	// Serve health checks during startup, so that the process is reported live, but not ready,
+	// until the site has been restored.
+	health := &Health{}
+	http.Handle("/_health/live", newLivenessHandler(health))
+	http.Handle("/_health/ready", newReadinessHandler(health))
+
+	for _, line := range strings.Split(fmt.Sprintf(logo, conf.Version, conf.BuildDate), "\n") {
+		log.Println("#", line)
+	}
+
+	echo(Log{"t": "listen", "address": conf.Listen, "webroot": conf.WebDir})
+
+	server := &http.Server{Addr: conf.Listen}
+	done := make(chan struct{})
+	go func() {
+		serve(server, conf)
+		close(done)
+	}()
+
 	site := newSite()
+	if conf.Namespace != nil {
+		site.ns = conf.Namespace
+	}
+	site.ns.limit = conf.MaxMemory
+	site.ns.coerce = conf.Coerce
 	if len(conf.Init) > 0 {
 		initSite(site, conf.Init)
 	}
 
-	broker := newBroker(site)
+	if len(conf.SnapshotFile) > 0 {
+		if err := site.load(conf.SnapshotFile); err != nil {
+			log.Fatalln("#", "failed restoring snapshot:", err)
+		}
+		if conf.SnapshotInterval > 0 {
+			go site.persist(conf.SnapshotFile, conf.SnapshotInterval)
+		}
+	}
+
+	if conf.SweepInterval > 0 {
+		go site.collect(conf.SweepInterval)
+	}
+
+	var access *AccessControl
+	if len(conf.AccessFile) > 0 {
+		if access, err = loadAccessControl(conf.AccessFile); err != nil {
+			echo(Log{"t": "access_init", "error": err.Error()})
+			return
+		}
+	}
+
+	var audit *AuditLog
+	if len(conf.AuditLog) > 0 {
+		if audit, err = openAuditLog(conf.AuditLog, conf.AuditSample); err != nil {
+			echo(Log{"t": "audit_init", "error": err.Error()})
+			return
+		}
+	}
+
+	broker := newBroker(site, access, audit, conf)
 	go broker.run()
 
 	if conf.Debug {
 		http.Handle("/_d/site", newDebugHandler(broker))
 	}
 
+	if len(conf.MetricsPath) > 0 {
+		http.Handle(conf.MetricsPath, newMetricsHandler(site))
+	}
+
 	if conf.oidcEnabled() {
 		http.Handle("/_auth/init", newOIDCInitHandler(sessions, conf.OIDCClientID, conf.OIDCClientSecret, conf.OIDCProviderURL, conf.OIDCRedirectURL))
 		http.Handle("/_auth/callback", newOAuth2Handler(sessions, conf.OIDCClientID, conf.OIDCClientSecret, conf.OIDCProviderURL, conf.OIDCRedirectURL))
-		http.Handle("/_logout", newOIDCLogoutHandler(sessions, conf.OIDCEndSessionURL))
+		http.Handle("/_logout", newOIDCLogoutHandler(sessions, broker, conf.OIDCEndSessionURL))
 	}
 
-	http.Handle("/_s", newSocketServer(broker, sessions))
+	http.Handle("/_s", newSocketServer(broker, sessions, conf.oidcEnabled()))
+	http.Handle("/_e", newEventServer(broker, sessions, conf.oidcEnabled(), conf.maxMessageSize()))
+	http.Handle("/_q", newQueryServer(site, access, sessions, apiKeys, conf.maxMessageSize()))
+	http.Handle("/_x", newExportServer(site, access, sessions, apiKeys))
 	fileDir := filepath.Join(conf.DataDir, "f")
-	http.Handle("/_f", newFileStore(fileDir))                                                                  // XXX secure
+	fileStore := newFileStore(fileDir, conf.UploadTimeout)
+	if conf.UploadTimeout > 0 {
+		go fileStore.uploads.collect()
+	}
+	http.Handle("/_f", fileStore)                                                                              // XXX secure
 	http.Handle("/_f/", newFileServer(fileDir))                                                                // XXX secure
-	http.Handle("/_p", newProxy())                                                                             // XXX secure
+	http.Handle("/_p", newProxy(conf.maxMessageSize()))                                                        // XXX secure
 	http.Handle("/_ide", http.StripPrefix("/_ide", http.FileServer(http.Dir(path.Join(conf.WebDir, "_ide"))))) // XXX secure
-	http.Handle("/", newWebServer(site, broker, users, conf.oidcEnabled(), sessions, conf.WebDir))
+	http.Handle("/", newWebServer(site, broker, users, apiKeys, conf.oidcEnabled(), sessions, conf.WebDir, conf.maxMessageSize()))
 
-	for _, line := range strings.Split(fmt.Sprintf(logo, conf.Version, conf.BuildDate), "\n") {
-		log.Println("#", line)
-	}
+	health.setReady(true)
+	echo(Log{"t": "ready"})
 
-	echo(Log{"t": "listen", "address": conf.Listen, "webroot": conf.WebDir})
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case <-done:
+	case sig := <-quit:
+		echo(Log{"t": "shutdown", "signal": sig.String()})
+		shutdown(server, health, broker, site, conf)
+	}
+}
 
+func serve(server *http.Server, conf ServerConf) {
 	if conf.CertFile != "" && conf.KeyFile != "" {
-		if err := http.ListenAndServeTLS(conf.Listen, conf.CertFile, conf.KeyFile, nil); err != nil {
+		certs, err := newCertReloader(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			echo(Log{"t": "listen_tls", "error": err.Error()})
+			return
+		}
+		go certs.watch()
+		server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			echo(Log{"t": "listen_tls", "error": err.Error()})
 		}
 	} else {
-		if err := http.ListenAndServe(conf.Listen, nil); err != nil {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			echo(Log{"t": "listen_no_tls", "error": err.Error()})
 		}
 	}
 }
+
+// shutdown reports the server as not ready, keeps serving for the readiness delay, stops accepting connections,
+// waits for in-flight requests to complete, asks clients to reconnect later, and saves a final snapshot, if enabled.
+func shutdown(server *http.Server, health *Health, broker *Broker, site *Site, conf ServerConf) {
+	health.setReady(false)
+	if conf.ReadinessDelay > 0 { // serve until load balancers notice, e.g. via failed readiness probes
+		time.Sleep(conf.ReadinessDelay)
+	}
+	// One deadline for both closing connections and draining clients, so that draining takes at most the drain timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), conf.DrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		echo(Log{"t": "shutdown", "error": err.Error()})
+	}
+
+	broker.drain(ctx)
+
+	if len(conf.SnapshotFile) > 0 {
+		if err := site.save(conf.SnapshotFile); err != nil {
+			echo(Log{"t": "snapshot", "file": conf.SnapshotFile, "error": err.Error()})
+		}
+	}
+	echo(Log{"t": "shutdown"})
+}
@@ -1,10 +1,15 @@
 package wave
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -47,11 +52,25 @@ func (site *Site) get(url string) *Page {
 	return p
 }
 
-// del deletes the page at url.
+// del deletes the page at url, releasing the buffer types referenced by its cards.
 func (site *Site) del(url string) {
+	if p := site.unlink(url); p != nil {
+		p.Lock()
+		p.release(site.ns)
+		p.Unlock()
+	}
+}
+
+// unlink removes the page at url from the site, and returns it, if any.
+func (site *Site) unlink(url string) *Page {
 	site.Lock()
-	delete(site.pages, url)
-	site.Unlock()
+	defer site.Unlock()
+	if p, ok := site.pages[url]; ok {
+		site.ns.grow(-atomic.LoadInt64(&p.size))
+		delete(site.pages, url)
+		return p
+	}
+	return nil
 }
 
 // set overwrites a page's content.
@@ -61,7 +80,13 @@ func (site *Site) set(url string, data []byte) error {
 		return fmt.Errorf("failed unmarshaling data: %v", err)
 	}
 	if ops.P != nil {
-		site.pages[url] = loadPage(site.ns, ops.P)
+		p := loadPage(site.ns, ops.P)
+		if old, ok := site.pages[url]; ok {
+			site.ns.grow(-atomic.LoadInt64(&old.size))
+			old.release(site.ns)
+		}
+		site.pages[url] = p
+		site.ns.grow(p.size)
 	}
 	return nil
 }
@@ -72,36 +97,236 @@ func (site *Site) patch(url string, data []byte) error {
 	if err := json.Unmarshal(data, &ops); err != nil { // TODO speed up
 		return fmt.Errorf("failed unmarshaling data: %v", err)
 	}
-	site.exec(url, ops)
-	return nil
+	_, err := site.exec(url, ops, false)
+	return err
 }
 
-// exec applies changes to a page's content.
-func (site *Site) exec(url string, ops OpsD) {
+// Applied represents the changes made to a page by a set of ops, marshaled as each op was applied.
+type Applied struct {
+	changes []byte     // changes as applied, with values as stored, for logging; nil if none were applied
+	deltas  []byte     // changes to broadcast to clients; nil if none were applied
+	errors  []OpErrorD // changes not applied, if not rejected in their entirety; reported to the client
+}
+
+// exec applies changes to a page's content, and returns the changes as applied.
+// Values are reported as stored, e.g. buffer records with defaults substituted and values converted to their
+// canonical representations, so that clients and the log see the same values as the page.
+// Cyclic buffers replaced by their continuations are broadcast as deltas: the tuples appended and evicted.
+// Changes are rejected in their entirety if they could exceed the namespace's memory limit, or, if strict,
+// if any of them is invalid; else, invalid changes are skipped, and records rejected by bulk updates and failed swaps reported.
+func (site *Site) exec(url string, ops OpsD, strict bool) (Applied, error) {
+	var canon, deltas []json.RawMessage
+	rewritten := false // any change broadcast differently than applied?
+	var changes []Change
+	observed := site.ns.observed()
 	page := site.get(url)
 	page.Lock()
-	for _, op := range ops.D {
+	if strict {
+		if errs := newValidator(site.ns, page).validate(ops.D); len(errs) > 0 {
+			page.Unlock()
+			return Applied{}, &ValidationError{errs}
+		}
+	}
+	// Charge the estimated growth up front, then correct it once the changes are applied.
+	reserved := page.estimate(ops.D)
+	if err := site.ns.charge(reserved); err != nil {
+		page.Unlock()
+		return Applied{}, err
+	}
+	before := make(map[string]Footprint) // card key => footprint before changes, for cards changed
+	var grown int64
+	var errs []OpErrorD
+	for i, op := range ops.D {
+		done := []OpD{op} // changes as applied; none if the op was not applied
+		var delta *OpD    // change to broadcast, if different
 		if len(op.K) > 0 {
+			page.touch(before, op.K)
 			if op.C != nil {
-				page.set(op.K, loadCycBuf(site.ns, op.C))
+				if b, err := loadCycBuf(site.ns, op.C); err != nil {
+					echo(Log{"t": "page_load", "url": url, "key": op.K, "error": err.Error()})
+					errs = append(errs, OpErrorD{i, op.K, err.Error()})
+					done = nil
+				} else {
+					if old, ok := page.at(op.K).(*CycBuf); ok {
+						if d, ok := old.delta(b); ok {
+							b.seq = old.seq + int64(len(d.D)) // continuation
+							delta = &OpD{K: op.K, A: d}
+						}
+					}
+					page.set(op.K, b)
+				}
+			} else if op.Z {
+				if err := page.compact(op.K); err != nil {
+					echo(Log{"t": "page_compact", "url": url, "key": op.K, "error": err.Error()})
+				}
+				done = nil // records are unchanged; nothing to broadcast or log
+			} else if op.X != nil {
+				// Broadcast as deletions of individual records: clients need not match keys themselves.
+				var err error
+				if done, err = page.deleteKeys(op.K, op.X); err != nil {
+					echo(Log{"t": "page_delete", "url": url, "key": op.K, "error": err.Error()})
+					errs = append(errs, OpErrorD{i, op.K, err.Error()})
+				}
+			} else if op.S != 0 {
+				// Broadcast as the buffer in its entirety: clients reload it.
+				if b, err := page.resize(op.K, op.S); err != nil {
+					echo(Log{"t": "page_resize", "url": url, "key": op.K, "error": err.Error()})
+					errs = append(errs, OpErrorD{i, op.K, err.Error()})
+					done = nil
+				} else {
+					done[0] = bufOp(op.K, b)
+				}
+			} else if _, ok := page.at(op.K).(*FixBuf); ok && op.A != nil {
+				// Broadcast as changes to individual slots: clients need not find empty slots themselves.
+				var err error
+				if done, err = page.appendSlots(op.K, op.A.D); err != nil {
+					echo(Log{"t": "page_append", "url": url, "key": op.K, "error": err.Error()})
+				}
+			} else if op.J != nil {
+				// Broadcast as the buffer in its entirety: every subsequent slot changes.
+				if b, err := page.insert(op.K, op.J.I, op.J.V); err != nil {
+					echo(Log{"t": "page_insert", "url": url, "key": op.K, "error": err.Error()})
+					errs = append(errs, OpErrorD{i, op.K, err.Error()})
+					done = nil
+				} else {
+					done[0] = bufOp(op.K, b)
+				}
+			} else if op.A != nil {
+				if d, err := page.append(op.K, op.A.D); err != nil {
+					echo(Log{"t": "page_append", "url": url, "key": op.K, "error": err.Error()})
+					done = nil
+				} else if len(d.D) == 0 {
+					done = nil
+				} else {
+					done[0] = OpD{K: op.K, A: d}
+				}
 			} else if op.F != nil {
 				page.set(op.K, loadFixBuf(site.ns, op.F))
 			} else if op.M != nil {
 				page.set(op.K, loadMapBuf(site.ns, op.M))
 			} else if op.D != nil {
 				page.cards[op.K] = loadCard(site.ns, CardD{op.D, op.B})
+			} else if op.U != nil {
+				// Broadcast as changes to individual records: clients hold records as stored.
+				var rejected []string
+				var err error
+				if done, rejected, err = page.update(op.K, op.U); err != nil {
+					echo(Log{"t": "page_update", "url": url, "key": op.K, "error": err.Error()})
+				} else if len(rejected) > 0 {
+					echo(Log{"t": "page_update", "url": url, "key": op.K, "rejected": strings.Join(rejected, ",")})
+					for _, rk := range rejected {
+						errs = append(errs, OpErrorD{i, op.K + keySeparator + rk, "record does not match buffer type"})
+					}
+				}
+			} else if op.W != nil {
+				// Broadcast and log as a plain change to the record: the expected value was checked here.
+				if tup, ok, err := page.swap(op.K, op.W.E, op.W.V); err != nil {
+					echo(Log{"t": "page_swap", "url": url, "key": op.K, "error": err.Error()})
+					errs = append(errs, OpErrorD{i, op.K, err.Error()})
+					done = nil
+				} else if !ok {
+					echo(Log{"t": "page_swap", "url": url, "key": op.K, "error": "value mismatch"})
+					errs = append(errs, OpErrorD{i, op.K, "value mismatch"})
+					done = nil
+				} else {
+					done[0] = OpD{K: op.K, V: tup}
+				}
+			} else if op.N != nil {
+				if err := page.rename(site.ns, op.K, op.N.F, op.N.T); err != nil {
+					echo(Log{"t": "page_rename", "url": url, "key": op.K, "error": err.Error()})
+					done = nil
+				} else if b, ok := page.at(op.K).(Buf); ok { // clients reload the buffer, with its fields renamed
+					d := bufOp(op.K, b)
+					delta = &d
+				}
+			} else if op.L != nil {
+				if tup, err := page.fill(op.K, op.L.V); err != nil {
+					echo(Log{"t": "page_fill", "url": url, "key": op.K, "error": err.Error()})
+					errs = append(errs, OpErrorD{i, op.K, err.Error()})
+					done = nil
+				} else {
+					done[0] = OpD{K: op.K, L: &FillD{V: tupValue(tup)}}
+				}
 			} else {
-				page.set(op.K, op.V)
+				if change, ok := page.put(op.K, op.V); ok {
+					done[0] = change
+				} else {
+					done = nil
+				}
 			}
 		} else { // drop page
-			site.del(url)
+			for k := range page.cards {
+				page.touch(before, k)
+			}
+			page.cards = make(map[string]*Card)
+			grown += page.settle(site.ns, before)
+			before = make(map[string]Footprint)
+			site.unlink(url)
 			page.Unlock()
 			page = site.get(url)
 			page.Lock()
 		}
+		if len(done) == 0 {
+			continue
+		}
+		// Marshal right away: changes reference values held by the page, which later ops could modify.
+		for _, change := range done {
+			c, err := json.Marshal(change)
+			if err != nil {
+				echo(Log{"t": "page_marshal", "url": url, "key": change.K, "error": err.Error()})
+				continue
+			}
+			canon = append(canon, c)
+			if delta != nil {
+				if c, err = json.Marshal(delta); err != nil {
+					echo(Log{"t": "page_marshal", "url": url, "key": change.K, "error": err.Error()})
+				}
+				rewritten = true
+			}
+			deltas = append(deltas, c)
+		}
+		if observed {
+			changes = page.changes(url, op, done, changes)
+		}
 	}
 	page.cache = nil // will be re-cached on next call to site.get(url)
+	grown += page.settle(site.ns, before)
+	site.ns.grow(grown - reserved)
 	page.Unlock()
+	if len(changes) > 0 {
+		site.ns.notify(changes)
+	}
+	if len(canon) == 0 {
+		return Applied{errors: errs}, nil
+	}
+	applied := Applied{changes: joinOps(canon), errors: errs}
+	if rewritten {
+		applied.deltas = joinOps(deltas)
+	} else {
+		applied.deltas = applied.changes
+	}
+	return applied, nil
+}
+
+// joinOps returns marshaled ops as marshaled OpsD.
+func joinOps(ops []json.RawMessage) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"d":[`)
+	for i, op := range ops {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(op)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+// count returns the number of pages hosted by this site.
+func (site *Site) count() int {
+	site.RLock()
+	defer site.RUnlock()
+	return len(site.pages)
 }
 
 // urls returns a sorted slice of urls hosted by this site.
@@ -121,3 +346,17 @@ func (site *Site) urls() []string {
 	sort.Strings(urls)
 	return urls
 }
+
+// collect periodically removes cached buffer types not referenced by any card.
+// Types are usually removed as soon as the last card referring to them is changed or deleted;
+// this catches types cached for buffers that were never stored.
+func (site *Site) collect(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		startTime := time.Now()
+		if n := site.ns.prune(); n > 0 {
+			echo(Log{"t": "sweep", "types": strconv.Itoa(n), "duration": time.Since(startTime).String()})
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package wave
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func mustExec(t *testing.T, site *Site, url, data string) Applied {
+	t.Helper()
+	var ops OpsD
+	if err := json.Unmarshal([]byte(data), &ops); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := site.exec(url, ops, false)
+	if err != nil {
+		t.Fatalf("exec %s: %v", data, err)
+	}
+	return applied
+}
+
+// checkSize checks that a page's size, as tracked incrementally, matches its measured size.
+func checkSize(t *testing.T, site *Site, url string) {
+	t.Helper()
+	p := site.at(url)
+	if size, measured := atomic.LoadInt64(&p.size), p.measure(); size != measured {
+		t.Errorf("want size %d, got %d", measured, size)
+	}
+	if used := site.ns.usage(); used != atomic.LoadInt64(&p.size) {
+		t.Errorf("want usage %d, got %d", p.size, used)
+	}
+}
+
+func TestExecDeleteKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		changes string
+		errors  int
+	}{
+		{"prefix", `{"k":"c items","x":{"p":"user:"}}`, `{"d":[{"k":"c items user:1"},{"k":"c items user:2"}]}`, 0},
+		{"glob", `{"k":"c items","x":{"g":"*:1"}}`, `{"d":[{"k":"c items group:1"},{"k":"c items user:1"}]}`, 0},
+		{"no match", `{"k":"c items","x":{"p":"x"}}`, ``, 0},
+		{"bad pattern", `{"k":"c items","x":{"g":"["}}`, ``, 1},
+		{"not a map buffer", `{"k":"c","x":{"p":"user:"}}`, ``, 1},
+	} {
+		site := newSite()
+		var observed int
+		site.ns.Observe("c items", func(page, key string, cur Cur) {
+			if cur.Empty() {
+				observed++
+			}
+		})
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{"user:1":[1],"user:2":[2],"group:1":[3]}}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if string(applied.deltas) != tc.changes {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.changes, applied.deltas)
+		}
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		var want OpsD
+		if len(tc.changes) > 0 {
+			json.Unmarshal([]byte(tc.changes), &want)
+		}
+		if observed != len(want.D) {
+			t.Errorf("%s: want %d deletions observed, got %d", tc.name, len(want.D), observed)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecResize(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		op     string
+		size   int
+		errors int
+	}{
+		{"shrink", `{"k":"c items","s":2}`, 2, 0},
+		{"grow", `{"k":"c items","s":5}`, 5, 0},
+		{"negative", `{"k":"c items","s":-1}`, 3, 1},
+		{"not a cyclic buffer", `{"k":"c","s":2}`, 3, 1},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[4],[2],[3]],"n":3,"i":1}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		b := site.at("/p").at("c items").(*CycBuf)
+		if len(b.b.tups) != tc.size {
+			t.Errorf("%s: want size %d, got %d", tc.name, tc.size, len(b.b.tups))
+		}
+		if tc.errors == 0 {
+			var ops OpsD
+			if err := json.Unmarshal(applied.deltas, &ops); err != nil || len(ops.D) != 1 || ops.D[0].C == nil || ops.D[0].C.N != tc.size {
+				t.Errorf("%s: want buffer reloaded, got %s", tc.name, applied.deltas)
+			}
+		} else if applied.deltas != nil {
+			t.Errorf("%s: want nothing broadcast, got %s", tc.name, applied.deltas)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecFixBufAppendInsert(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		changes string
+		slots   [][]interface{}
+		errors  int
+	}{
+		{"append", `{"k":"c items","a":{"d":[[3],[4],[5]]}}`, `{"d":[{"k":"c items 1","v":[3]},{"k":"c items 3","v":[4]}]}`, slotsOf(1.0, 3.0, 2.0, 4.0), 0},
+		{"insert", `{"k":"c items","j":{"i":0,"v":[0]}}`, `{"d":[{"k":"c items","f":{"f":["a"],"d":[[0],[1],null,[2]],"n":4}}]}`, slotsOf(0.0, 1.0, nil, 2.0), 0},
+		{"insert out of range", `{"k":"c items","j":{"i":4,"v":[0]}}`, ``, slotsOf(1.0, nil, 2.0, nil), 1},
+		{"insert mismatch", `{"k":"c items","j":{"i":0,"v":[0,1]}}`, ``, slotsOf(1.0, nil, 2.0, nil), 1},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"f":{"f":["a"],"d":[[1],null,[2],null],"n":4}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if string(applied.deltas) != tc.changes {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.changes, applied.deltas)
+		}
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		if b := site.at("/p").at("c items").(*FixBuf); !reflect.DeepEqual(b.tups, tc.slots) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.slots, b.tups)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		changes string
+		errors  int
+		dump    string
+	}{
+		{
+			"set and delete",
+			`{"k":"c items","u":{"x":[10],"y":null,"z":[30]}}`,
+			`{"d":[{"k":"c items x","v":[10]},{"k":"c items y"},{"k":"c items z","v":[30]}]}`,
+			0,
+			`{"x":[10],"z":[30]}`,
+		},
+		{
+			"partially rejected",
+			`{"k":"c items","u":{"x":[10],"y":[1,2]}}`,
+			`{"d":[{"k":"c items x","v":[10]}]}`,
+			1,
+			`{"x":[10],"y":[2]}`,
+		},
+		{
+			"all rejected",
+			`{"k":"c items","u":{"x":[1,2]}}`,
+			``,
+			1,
+			`{"x":[1],"y":[2]}`,
+		},
+		{
+			"not a map buffer",
+			`{"k":"c","u":{"x":[10]}}`,
+			``,
+			0,
+			`{"x":[1],"y":[2]}`,
+		},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{"x":[1],"y":[2]}}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if string(applied.deltas) != tc.changes {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.changes, applied.deltas)
+		}
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		if got := toJSON(t, site.at("/p").at("c items").(*MapBuf).dump().M.D); got != tc.dump {
+			t.Errorf("%s: want records %s, got %s", tc.name, tc.dump, got)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecSwap(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		changes string
+		errors  int
+		dump    string
+	}{
+		{"match", `{"k":"c items x","w":{"e":[1],"v":[10]}}`, `{"d":[{"k":"c items x","v":[10]}]}`, 0, `{"x":[10],"y":[2]}`},
+		{"mismatch", `{"k":"c items x","w":{"e":[2],"v":[10]}}`, ``, 1, `{"x":[1],"y":[2]}`},
+		{"create", `{"k":"c items z","w":{"v":[10]}}`, `{"d":[{"k":"c items z","v":[10]}]}`, 0, `{"x":[1],"y":[2],"z":[10]}`},
+		{"create existing", `{"k":"c items x","w":{"v":[10]}}`, ``, 1, `{"x":[1],"y":[2]}`},
+		{"missing", `{"k":"c items z","w":{"e":[1],"v":[10]}}`, ``, 1, `{"x":[1],"y":[2]}`},
+		{"bad value", `{"k":"c items x","w":{"e":[1],"v":[1,2]}}`, ``, 1, `{"x":[1],"y":[2]}`},
+		{"not a map buffer", `{"k":"c data x","w":{"e":[1],"v":[10]}}`, ``, 1, `{"x":[1],"y":[2]}`},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{"x":[1],"y":[2]}}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if string(applied.deltas) != tc.changes {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.changes, applied.deltas)
+		}
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		if got := toJSON(t, site.at("/p").at("c items").(*MapBuf).dump().M.D); got != tc.dump {
+			t.Errorf("%s: want records %s, got %s", tc.name, tc.dump, got)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecRename(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		buf    string
+		op     string
+		reload bool
+		dump   string // buffer after the op
+	}{
+		{"map", `{"m":{"f":["a","b"],"d":{"x":[1,2]}}}`, `{"k":"c items","n":{"f":"a","t":"z"}}`, true, `{"m":{"f":["z","b"],"d":{"x":[1,2]},"k":["x"]}}`},
+		{"fixed", `{"f":{"f":["a:int"],"d":[[1]],"n":1}}`, `{"k":"c items","n":{"f":"a","t":"z"}}`, true, `{"f":{"f":["z"],"d":[[1]],"n":1,"s":["z:int"]}}`},
+		{"cyclic", `{"c":{"f":["a","b"],"d":[[1,2],null],"n":2,"i":1}}`, `{"k":"c items","n":{"f":"b","t":"z"}}`, true, `{"c":{"f":["a","z"],"d":[[1,2],null],"n":2,"i":1,"l":1}}`},
+		{"collision", `{"m":{"f":["a","b"],"d":{"x":[1,2]}}}`, `{"k":"c items","n":{"f":"a","t":"b"}}`, false, `{"m":{"f":["a","b"],"d":{"x":[1,2]},"k":["x"]}}`},
+		{"missing", `{"m":{"f":["a","b"],"d":{"x":[1,2]}}}`, `{"k":"c items","n":{"f":"w","t":"z"}}`, false, `{"m":{"f":["a","b"],"d":{"x":[1,2]},"k":["x"]}}`},
+		{"not a buffer", `{"m":{"f":["a","b"],"d":{"x":[1,2]}}}`, `{"k":"c view","n":{"f":"a","t":"z"}}`, false, `{"m":{"f":["a","b"],"d":{"x":[1,2]},"k":["x"]}}`},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"view":"x","~items":0},"b":[`+tc.buf+`]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if reload := len(applied.deltas) > 0; reload != tc.reload {
+			t.Errorf("%s: want reload %v, got %s", tc.name, tc.reload, applied.deltas)
+		}
+		// Tuples are positional, so are left as is: only field names change.
+		if got := toJSON(t, site.at("/p").at("c items").(Buf).dump()); got != tc.dump {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.dump, got)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecFill(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		changes string
+		errors  int
+		dump    string
+	}{
+		{"fill", `{"k":"c items","l":{"v":[7]}}`, `{"d":[{"k":"c items","l":{"v":[7,0]}}]}`, 0, `[[7,0],[7,0],[7,0]]`},
+		{"clear", `{"k":"c items","l":{}}`, `{"d":[{"k":"c items","l":{"v":null}}]}`, 0, `[null,null,null]`},
+		{"bad tuple", `{"k":"c items","l":{"v":["x"]}}`, ``, 1, `[[1,0],null,[3,0]]`},
+		{"not a fixed buffer", `{"k":"c data","l":{"v":[7]}}`, ``, 1, `[[1,0],null,[3,0]]`},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"data":1,"~items":0},"b":[{"f":{"f":["a:int","b:int=0"],"d":[[1,0],null,[3,0]],"n":3}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if string(applied.deltas) != tc.changes {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.changes, applied.deltas)
+		}
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		if got := toJSON(t, site.at("/p").at("c items").(*FixBuf).dump().F.D); got != tc.dump {
+			t.Errorf("%s: want tuples %s, got %s", tc.name, tc.dump, got)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestFixBufFillCopies(t *testing.T) {
+	b := loadFixBuf(newNamespace(), &FixBufD{F: []string{"a"}, N: 2})
+	tup, _ := b.t.check(mustJSON(t, `[[1]]`))
+	b.fill(tup)
+	b.tups[0][0].([]interface{})[0] = 2.0
+	if got := toJSON(t, b.tups[1]); got != `[[1]]` {
+		t.Errorf("want slots not sharing values, got %s", got)
+	}
+}
+
+func TestExecCycBufDelta(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		changes string
+	}{
+		{"continuation", `{"k":"c items","c":{"f":["a"],"d":[[5],[2],[3],[4]],"n":4,"i":1}}`, `{"d":[{"k":"c items","a":{"d":[[4],[5]],"e":1}}]}`},
+		{"diverged", `{"k":"c items","c":{"f":["a"],"d":[[9],[8],[7],[6]],"n":4,"i":0}}`, ``},
+		{"replacing a fixed buffer", `{"k":"d items","c":{"f":["a"],"d":[[1],null],"n":2,"i":1}}`, ``},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[
+			{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[1],[2],[3],null],"n":4,"i":3}}]},
+			{"k":"d","d":{"~items":0},"b":[{"f":{"f":["a"],"n":1}}]}
+		]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		want := tc.changes
+		if want == "" { // broadcast as applied
+			want = `{"d":[` + tc.op + `]}`
+		}
+		if string(applied.deltas) != want {
+			t.Errorf("%s: want %s, got %s", tc.name, want, applied.deltas)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecCycBufSeq(t *testing.T) {
+	site := newSite()
+	mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[3],[4],[2]],"n":3,"i":2,"q":1}}]}]}`)
+	for _, tc := range []struct {
+		name string
+		op   string
+		seq  int64 // sequence number of the oldest tuple
+	}{
+		{"loaded", ``, 1},
+		{"appended", `{"k":"c items","a":{"d":[[5],[6]]}}`, 3},
+		{"record set", `{"k":"c items -1","v":[7]}`, 4},
+		{"continuation", `{"k":"c items","c":{"f":["a"],"d":[[6],[7],[8]],"n":3,"i":0}}`, 5},
+		{"replaced", `{"k":"c items","c":{"f":["a"],"d":[[1],null,null],"n":3,"i":1}}`, 0},
+	} {
+		if tc.op != "" {
+			mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		}
+		if seq := site.at("/p").at("c items").(*CycBuf).dump().C.Q; seq != tc.seq {
+			t.Errorf("%s: want oldest tuple at %v, got %v", tc.name, tc.seq, seq)
+		}
+	}
+}
+
+func TestExecCompact(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		k    string
+	}{
+		{"map buffer", "c items"},
+		{"not a map buffer", "c data"},
+	} {
+		site := newSite()
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"data":1,"~items":0},"b":[{"m":{"f":["a"],"d":{"x":[1],"y":[2]}}}]}]}`)
+		mustExec(t, site, "/p", `{"d":[{"k":"c items y"}]}`)
+		before := toJSON(t, site.at("/p").dump())
+		// Records are unchanged, so nothing is broadcast.
+		if applied := mustExec(t, site, "/p", `{"d":[{"k":"`+tc.k+`","z":true}]}`); applied.deltas != nil || applied.changes != nil {
+			t.Errorf("%s: want nothing broadcast or logged, got %s, %s", tc.name, applied.deltas, applied.changes)
+		}
+		if after := toJSON(t, site.at("/p").dump()); after != before {
+			t.Errorf("%s: want page %s, got %s", tc.name, before, after)
+		}
+		checkSize(t, site, "/p")
+	}
+}
+
+func TestExecCoerce(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		coerce  bool
+		fields  string
+		op      string
+		changes string
+		errors  int
+		dump    string
+	}{
+		{"field", false, `["a:~int","b:~bool"]`, `{"k":"c items 0","v":["7","1"]}`, `{"d":[{"k":"c items 0","v":[7,true]}]}`, 0, `[[7,true],null]`},
+		{"field, append", false, `["a:~int","b:~bool"]`, `{"k":"c items","a":{"d":[["8",0]]}}`, `{"d":[{"k":"c items 0","v":[8,false]}]}`, 0, `[[8,false],null]`},
+		{"field, failed", false, `["a:~int","b:~bool"]`, `{"k":"c items","a":{"d":[["x",true]]}}`, ``, 0, `[null,null]`},
+		{"namespace", true, `["a:int","b:bool"]`, `{"k":"c items 0","v":["7","1"]}`, `{"d":[{"k":"c items 0","v":[7,true]}]}`, 0, `[[7,true],null]`},
+		{"not coercing", false, `["a:int","b:bool"]`, `{"k":"c items","a":{"d":[["7","1"]]}}`, ``, 0, `[null,null]`},
+	} {
+		site := newSite()
+		site.ns.coerce = tc.coerce
+		mustExec(t, site, "/p", `{"d":[{"k":"c","d":{"~items":0},"b":[{"f":{"f":`+tc.fields+`,"n":2}}]}]}`)
+		applied := mustExec(t, site, "/p", `{"d":[`+tc.op+`]}`)
+		if string(applied.deltas) != tc.changes {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.changes, applied.deltas)
+		}
+		if len(applied.errors) != tc.errors {
+			t.Errorf("%s: want %d errors, got %v", tc.name, tc.errors, applied.errors)
+		}
+		if got := toJSON(t, site.at("/p").at("c items").(*FixBuf).dump().F.D); got != tc.dump {
+			t.Errorf("%s: want tuples %s, got %s", tc.name, tc.dump, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package wave
+
+import "errors"
+
+// slice returns the elements of tups selected by start, stop and step, using Python slice semantics.
+// Nil bounds are defaults; out-of-range bounds are clamped.
+func slice(tups [][]interface{}, start, stop, step *int) ([][]interface{}, error) {
+	n, k := len(tups), 1
+	if step != nil {
+		k = *step
+	}
+	if k == 0 {
+		return nil, errors.New("slice step cannot be zero")
+	}
+	lo, hi := 0, n
+	if k < 0 {
+		lo, hi = -1, n-1
+	}
+	clamp := func(p *int, def int) int {
+		if p == nil {
+			return def
+		}
+		i := *p
+		if i < 0 {
+			i += n
+			if i < 0 {
+				i = lo
+			}
+		} else if i > hi {
+			i = hi
+		}
+		return i
+	}
+	var i, j int
+	if k > 0 {
+		i, j = clamp(start, 0), clamp(stop, n)
+	} else {
+		i, j = clamp(start, n-1), clamp(stop, -1)
+	}
+	xs := [][]interface{}{}
+	for ; (k > 0 && i < j) || (k < 0 && i > j); i += k {
+		xs = append(xs, tups[i])
+	}
+	return xs, nil
+}
@@ -0,0 +1,46 @@
+package wave
+
+import "testing"
+
+func TestSlice(t *testing.T) {
+	in := func(i int) *int { return &i }
+	for _, tc := range []struct {
+		name              string
+		n                 int
+		start, stop, step *int
+		want              string // selected tuples; empty if rejected
+	}{
+		{"all", 5, nil, nil, nil, `[[0],[1],[2],[3],[4]]`},
+		{"range", 5, in(1), in(3), nil, `[[1],[2]]`},
+		{"from end", 5, in(-2), nil, nil, `[[3],[4]]`},
+		{"step", 5, nil, nil, in(2), `[[0],[2],[4]]`},
+		{"reversed", 5, nil, nil, in(-1), `[[4],[3],[2],[1],[0]]`},
+		{"reversed range", 5, in(3), in(0), in(-1), `[[3],[2],[1]]`},
+		{"reversed from end", 5, in(-1), in(-10), in(-2), `[[4],[2],[0]]`},
+		{"start past end", 5, in(10), nil, nil, `[]`},
+		{"start before beginning", 5, in(-10), in(2), nil, `[[0],[1]]`},
+		{"reversed, start past end", 5, in(10), nil, in(-1), `[[4],[3],[2],[1],[0]]`},
+		{"empty range", 5, in(3), in(1), nil, `[]`},
+		{"empty", 0, nil, nil, in(-1), `[]`},
+		{"zero step", 5, nil, nil, in(0), ``},
+	} {
+		tups := make([][]interface{}, tc.n)
+		for i := range tups {
+			tups[i] = []interface{}{i}
+		}
+		xs, err := slice(tups, tc.start, tc.stop, tc.step)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: want error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := toJSON(t, xs); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
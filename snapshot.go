@@ -0,0 +1,183 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// snapshot writes the site's types and pages to w.
+func (site *Site) snapshot(w io.Writer) error {
+	ns := site.ns
+	ns.RLock()
+	types := make([][]string, 0, len(ns.types))
+	for k := range ns.types {
+		types = append(types, strings.Split(k, "\n"))
+	}
+	ns.RUnlock()
+
+	site.RLock()
+	pages := make(map[string]*Page, len(site.pages))
+	for url, page := range site.pages {
+		pages[url] = page
+	}
+	site.RUnlock()
+
+	d := SiteD{T: types, P: make(map[string]json.RawMessage, len(pages))}
+	for url, page := range pages {
+		page.RLock()
+		data, err := json.Marshal(page.dump())
+		page.RUnlock()
+		if err != nil {
+			return fmt.Errorf("failed marshaling page %s: %v", url, err)
+		}
+		d.P[url] = data
+	}
+	return json.NewEncoder(w).Encode(d)
+}
+
+// restore replaces the site's pages with those read from r.
+// Nothing is changed if the snapshot cannot be read in its entirety, or if any of its pages is inconsistent.
+func (site *Site) restore(r io.Reader) error {
+	var d SiteD
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return fmt.Errorf("failed unmarshaling snapshot: %v", err)
+	}
+	pds := make(map[string]*PageD, len(d.P))
+	for url, data := range d.P {
+		var pd PageD
+		if err := json.Unmarshal(data, &pd); err != nil {
+			return fmt.Errorf("failed unmarshaling page %s: %v", url, err)
+		}
+		if err := pd.check(site.ns); err != nil {
+			return fmt.Errorf("invalid page %s: %v", url, err)
+		}
+		pds[url] = &pd
+	}
+
+	for _, fields := range d.T { // types first, so that buffers pick up cached types.
+		site.ns.make(fields)
+	}
+	pages := make(map[string]*Page, len(pds))
+	var used int64
+	for url, pd := range pds {
+		p := loadPage(site.ns, pd)
+		pages[url] = p
+		used += p.size
+	}
+
+	site.Lock()
+	old := site.pages
+	site.pages = pages
+	atomic.StoreInt64(&site.ns.used, used)
+	site.Unlock()
+	for _, p := range old {
+		p.Lock()
+		p.release(site.ns)
+		p.Unlock()
+	}
+	return nil
+}
+
+// check verifies the consistency of a marshaled page: that its cards refer only to buffers that exist,
+// and that its buffers are consistent with their types, and, for cyclic buffers, with their cursors.
+func (d *PageD) check(ns *Namespace) error {
+	v := newValidator(ns, newPage())
+	for k, c := range d.C {
+		for dk, x := range c.D {
+			if f, ok := x.(float64); ok && strings.HasPrefix(dk, dataPrefix) {
+				if i := int(f); i < 0 || i >= len(c.B) {
+					return fmt.Errorf("card %s: %s refers to missing buffer %d", k, dk, i)
+				}
+			}
+		}
+		for i, b := range c.B {
+			if err := checkCols(b); err != nil {
+				return fmt.Errorf("card %s, buffer %d: %v", k, i, err)
+			}
+			if err := v.checkBufD(b); err != nil {
+				return fmt.Errorf("card %s, buffer %d: %v", k, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkCols verifies that the columns of a columnar buffer are of equal length, and, for map buffers,
+// that there is a key per row.
+func checkCols(b BufD) error {
+	var cols [][]interface{}
+	rows := -1
+	switch {
+	case b.C != nil:
+		cols = b.C.X
+	case b.F != nil:
+		cols = b.F.X
+	case b.M != nil:
+		cols = b.M.X
+		if cols != nil {
+			rows = len(b.M.K)
+		}
+	}
+	for j, col := range cols {
+		if rows < 0 {
+			rows = len(col)
+		}
+		if len(col) != rows {
+			return fmt.Errorf("want %d rows in column %d, got %d", rows, j, len(col))
+		}
+	}
+	return nil
+}
+
+// save writes a snapshot to a file, atomically.
+func (site *Site) save(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed creating snapshot file: %v", err)
+	}
+	tmp := f.Name()
+	if err := site.snapshot(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed writing snapshot file: %v", err)
+	}
+	return os.Rename(tmp, filename)
+}
+
+// load reads a snapshot from a file, if it exists.
+func (site *Site) load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed opening snapshot file: %v", err)
+	}
+	defer f.Close()
+	return site.restore(f)
+}
+
+// persist periodically saves snapshots to a file.
+func (site *Site) persist(filename string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		startTime := time.Now()
+		if err := site.save(filename); err != nil {
+			echo(Log{"t": "snapshot", "file": filename, "error": err.Error()})
+			continue
+		}
+		echo(Log{"t": "snapshot", "file": filename, "duration": time.Since(startTime).String()})
+	}
+}
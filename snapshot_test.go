@@ -0,0 +1,112 @@
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSite(t *testing.T, pages map[string]string) *Site {
+	t.Helper()
+	site := newSite()
+	for url, data := range pages {
+		var ops OpsD
+		if err := json.Unmarshal([]byte(data), &ops); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := site.exec(url, ops, true); err != nil {
+			t.Fatalf("exec %s: %v", url, err)
+		}
+	}
+	return site
+}
+
+func dumpPages(t *testing.T, site *Site) map[string]string {
+	t.Helper()
+	pages := make(map[string]string)
+	for _, url := range site.urls() {
+		data, err := json.Marshal(site.at(url).dump())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages[url] = string(data)
+	}
+	return pages
+}
+
+var snapshotPages = map[string]string{
+	"/a": `{"d":[
+		{"k":"c","d":{"view":"table","~items":0},"b":[{"m":{"f":["k","v"],"d":{"x":[1,2],"y":[3,4]}}}]},
+		{"k":"f","d":{"~items":0},"b":[{"f":{"f":["a"],"d":[[1],null],"n":2}}]},
+		{"k":"cy","d":{"~items":0},"b":[{"c":{"f":["a"],"d":[[4],[2],[3]],"n":3,"i":1}}]}
+	]}`,
+	"/b": `{"d":[{"k":"n","d":{"title":"notes","tags":["x","y"]}}]}`,
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	site := newTestSite(t, snapshotPages)
+	var buf bytes.Buffer
+	if err := site.snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := newSite()
+	if err := restored.restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want, got := dumpPages(t, site), dumpPages(t, restored)
+	if len(got) != len(want) {
+		t.Fatalf("want %d pages, got %d", len(want), len(got))
+	}
+	for url, w := range want {
+		if got[url] != w {
+			t.Errorf("%s: want %s, got %s", url, w, got[url])
+		}
+	}
+	if restored.ns.usage() != site.ns.usage() {
+		t.Errorf("want usage %d, got %d", site.ns.usage(), restored.ns.usage())
+	}
+}
+
+func TestSnapshotSaveLoad(t *testing.T) {
+	site := newTestSite(t, snapshotPages)
+	filename := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := site.save(filename); err != nil {
+		t.Fatal(err)
+	}
+	restored := newSite()
+	if err := restored.load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.urls(); strings.Join(got, ",") != "/a,/b" {
+		t.Errorf("want pages /a,/b, got %v", got)
+	}
+}
+
+func TestSnapshotRejectsCorrupt(t *testing.T) {
+	page := func(data string) string { return `{"t":[],"p":{"/x":` + data + `}}` }
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"truncated", `{"t":[],"p":{"/x":{"c":{`},
+		{"bad page", `{"t":[],"p":{"/x":[1,2]}}`},
+		{"cyclic cursor out of bounds", page(`{"c":{"k":{"d":{"~b":0},"b":[{"c":{"f":["a"],"d":[[1],[2],null],"n":3,"i":5}}]}}}`)},
+		{"cyclic cursor behind newest", page(`{"c":{"k":{"d":{"~b":0},"b":[{"c":{"f":["a"],"d":[[1],[2],null],"n":3,"i":1}}]}}}`)},
+		{"cyclic fill count", page(`{"c":{"k":{"d":{"~b":0},"b":[{"c":{"f":["a"],"d":[[1],[2],null],"n":3,"i":2,"l":3}}]}}}`)},
+		{"missing buffer", page(`{"c":{"k":{"d":{"~b":1},"b":[{"f":{"f":["a"],"d":[[1]],"n":1}}]}}}`)},
+		{"ragged columns", page(`{"c":{"k":{"d":{"~b":0},"b":[{"f":{"f":["a","b"],"o":1,"x":[[1,2],[3]],"n":2}}]}}}`)},
+		{"map keys and columns", page(`{"c":{"k":{"d":{"~b":0},"b":[{"m":{"f":["a"],"o":1,"k":["x"],"x":[[1,2]]}}]}}}`)},
+		{"tuple mismatch", page(`{"c":{"k":{"d":{"~b":0},"b":[{"m":{"f":["a","b"],"d":{"x":[1,2,3]}}}]}}}`)},
+	} {
+		site := newTestSite(t, map[string]string{"/keep": `{"d":[{"k":"x","d":{"v":1}}]}`})
+		if err := site.restore(strings.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: want error", tc.name)
+			continue
+		}
+		if urls := site.urls(); len(urls) != 1 || urls[0] != "/keep" {
+			t.Errorf("%s: want pages left as is, got %v", tc.name, urls)
+		}
+	}
+}
@@ -6,25 +6,45 @@ import (
 
 // SocketServer represents a websocket server.
 type SocketServer struct {
-	broker   *Broker
-	sessions *OIDCSessions
+	broker      *Broker
+	sessions    *OIDCSessions
+	oidcEnabled bool
 }
 
-func newSocketServer(broker *Broker, sessions *OIDCSessions) *SocketServer {
+func newSocketServer(broker *Broker, sessions *OIDCSessions, oidcEnabled bool) *SocketServer {
 	return &SocketServer{
 		broker,
 		sessions,
+		oidcEnabled,
 	}
 }
 
 func (s *SocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	session := getSessionID(r)
+	if s.oidcEnabled { // reject connections from logged-out or expired sessions
+		if _, ok := s.sessions.get(session); !ok {
+			echo(Log{"t": "socket_upgrade", "err": "session not found"})
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	u := upgrader
+	u.EnableCompression = s.broker.compression.enabled
+	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		echo(Log{"t": "socket_upgrade", "err": err.Error()})
 		return
 	}
+	if u.EnableCompression {
+		conn.SetCompressionLevel(s.broker.compression.level)
+	}
 	username, subject := getIdentity(r, s.sessions)
-	client := newClient(getRemoteAddr(r), username, subject, s.broker, conn)
+	client := newClient(getRemoteAddr(r), username, subject, session, s.broker, conn)
+	client.msgpack = conn.Subprotocol() == msgpackSubprotocol || r.URL.Query().Get(formatParam) == msgpackFormat
+	client.strict = isStrict(r.URL.Query().Get(strictParam))
+	client.token = r.URL.Query().Get(dedupParam)
+	s.broker.conns.Add(1)
+	s.broker.join <- client
 	go client.flush()
 	go client.listen()
 }
@@ -44,6 +64,14 @@ func getIdentity(r *http.Request, sessions *OIDCSessions) (username, subject str
 	return session.username, session.subject
 }
 
+func getSessionID(r *http.Request) string {
+	cookie, err := r.Cookie(oidcSessionKey)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
 func getRemoteAddr(r *http.Request) string {
 	if addr := r.Header.Get("X-FORWARDED-FOR"); addr != "" { // forwarded via a proxy?
 		return addr
@@ -0,0 +1,119 @@
+package wave
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestSocket connects a websocket client to a socket server over the broker.
+func dialTestSocket(t *testing.T, b *Broker) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(newSocketServer(b, newOIDCSessions(), false))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSocketMaxMessageSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int // of op value
+		ok   bool
+	}{
+		{"within limit", 10, true},
+		{"past limit", 100, false},
+	} {
+		b := newBroker(newSite(), nil, nil, ServerConf{MaxMessageSize: 100})
+		go b.run()
+		conn := dialTestSocket(t, b)
+		msg := `* /p {"d":[{"k":"x","d":{"v":"` + strings.Repeat("x", tc.size) + `"}}]}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if tc.ok {
+			conn.WriteMessage(websocket.TextMessage, []byte("+ /p ")) // replies once the patch is applied
+			if _, data, err := conn.ReadMessage(); err != nil || !strings.Contains(string(data), `"p":`) {
+				t.Errorf("%s: want page, got %s, %v", tc.name, data, err)
+			}
+			continue
+		}
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("%s: want connection closed, got %v", tc.name, err)
+		}
+		if b.site.at("/p") != nil {
+			t.Errorf("%s: want message discarded", tc.name)
+		}
+	}
+}
+
+func TestSocketKeepalive(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		conf   ServerConf
+		pong   bool          // reply to pings?
+		wait   time.Duration // how long to stay connected for
+		closed bool          // want connection closed?
+		code   int           // close code, if closed cleanly
+	}{
+		{"responsive", ServerConf{PingInterval: 10 * time.Millisecond, MaxMissedPongs: 2}, true, 200 * time.Millisecond, false, 0},
+		{"missed pongs", ServerConf{PingInterval: 10 * time.Millisecond, MaxMissedPongs: 2}, false, 5 * time.Second, true, 0},
+		{"idle", ServerConf{PingInterval: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond}, true, 5 * time.Second, true, websocket.CloseGoingAway},
+	} {
+		b := newBroker(newSite(), nil, nil, tc.conf)
+		go b.run()
+		conn := dialTestSocket(t, b)
+		pings := 0
+		conn.SetPingHandler(func(data string) error {
+			pings++
+			if !tc.pong {
+				return nil
+			}
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		conn.SetReadDeadline(time.Now().Add(tc.wait))
+		_, _, err := conn.ReadMessage() // handles pings until the connection is closed, or the deadline passes
+		if pings == 0 {
+			t.Errorf("%s: want pings", tc.name)
+		}
+		if !tc.closed {
+			if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+				t.Errorf("%s: want connection kept open, got %v", tc.name, err)
+			}
+			continue
+		}
+		if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+			t.Errorf("%s: want connection closed", tc.name)
+		} else if tc.code != 0 && !websocket.IsCloseError(err, tc.code) {
+			t.Errorf("%s: want close code %d, got %v", tc.name, tc.code, err)
+		}
+	}
+}
+
+func TestClientIsIdle(t *testing.T) {
+	c := newClient("test", "", "", "", &Broker{}, nil)
+	for _, tc := range []struct {
+		name    string
+		active  time.Duration // ago
+		timeout time.Duration
+		idle    bool
+	}{
+		{"disabled", time.Hour, 0, false},
+		{"active", time.Second, time.Minute, false},
+		{"idle", time.Hour, time.Minute, true},
+	} {
+		c.active = time.Now().Add(-tc.active).UnixNano()
+		if got := c.isIdle(tc.timeout); got != tc.idle {
+			t.Errorf("%s: want idle=%v, got %v", tc.name, tc.idle, got)
+		}
+	}
+}
@@ -1,19 +1,29 @@
 package wave
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 )
 
 // Namespace is a cache of all known data types in use.
+// Types are reference-counted by the cards holding buffers of the type, and are removed once no card refers to them.
+// It also accounts for the approximate memory used by the pages of its site.
 type Namespace struct {
+	used  int64 // approximate bytes used by pages; atomic; first, for 64-bit alignment
+	limit int64 // max bytes that can be used by pages; 0=unlimited
 	sync.RWMutex
-	types map[string]Typ // "foo\nbar\nbaz" -> type
+	types     map[string]Typ // "foo\nbar\nbaz" -> type
+	refs      map[string]int // "foo\nbar\nbaz" -> number of cards holding buffers of the type
+	observers Observers      // callbacks for changes to buffers
+	coerce    bool           // coerce values of all typed fields?
 }
 
 func newNamespace() *Namespace {
-	return &Namespace{types: make(map[string]Typ)}
+	return &Namespace{types: make(map[string]Typ), refs: make(map[string]int)}
 }
 
 func (ns *Namespace) get(k string) (Typ, bool) {
@@ -32,31 +42,259 @@ func (ns *Namespace) make(fields []string) Typ {
 		return t
 	}
 	t := newType(fields)
+	if ns.coerce {
+		t = t.coercing()
+	}
 	ns.Lock()
 	ns.types[k] = t
 	ns.Unlock()
 	return t
 }
 
+// retain records a reference to each of the given types, caching any types not cached.
+func (ns *Namespace) retain(ts map[string]Typ) {
+	if len(ts) == 0 {
+		return
+	}
+	ns.Lock()
+	defer ns.Unlock()
+	for k, t := range ts {
+		ns.refs[k]++
+		if _, ok := ns.types[k]; !ok {
+			ns.types[k] = t
+		}
+	}
+}
+
+// release drops a reference to each of the given types, removing types no longer referenced from the cache.
+func (ns *Namespace) release(ts map[string]Typ) {
+	if len(ts) == 0 {
+		return
+	}
+	ns.Lock()
+	defer ns.Unlock()
+	for k := range ts {
+		if n := ns.refs[k] - 1; n > 0 {
+			ns.refs[k] = n
+		} else {
+			delete(ns.refs, k)
+			delete(ns.types, k)
+		}
+	}
+}
+
+// prune removes cached types that are not referenced by any card, and returns the number of types removed.
+// These are types cached for buffers that were never stored, e.g. by changes that failed validation.
+func (ns *Namespace) prune() int {
+	ns.Lock()
+	defer ns.Unlock()
+	n := 0
+	for k := range ns.types {
+		if ns.refs[k] == 0 {
+			delete(ns.types, k)
+			n++
+		}
+	}
+	return n
+}
+
+// rename returns a type identical to t, but having field from renamed to to.
+// Tuples are positional, so tuples of type t are also tuples of the new type.
+func (ns *Namespace) rename(t Typ, from, to string) (Typ, error) {
+	i, ok := t.m[from]
+	if !ok {
+		return t, fmt.Errorf("field not found: %s", from)
+	}
+	if _, ok := t.m[to]; ok {
+		return t, fmt.Errorf("field already exists: %s", to)
+	}
+	if fd := parseField(to); to == "" || fd.name != to || fd.kind != anyKind {
+		return t, fmt.Errorf("invalid field name: %q", to)
+	}
+	specs := append([]string(nil), fieldsOf(t.f, t.s)...)
+	specs[i] = to + strings.TrimPrefix(specs[i], from)
+	return ns.make(specs), nil
+}
+
 // Typ represents a data type.
 type Typ struct {
-	f []string       // fields
+	f []string       // field names
+	s []string       // field specs, if any field has attributes; else nil
+	a []Field        // field attributes
 	m map[string]int // offsets
 }
 
-func newType(fields []string) Typ {
-	m := make(map[string]int)
-	for i, f := range fields {
-		m[f] = i
+func newType(specs []string) Typ {
+	n := len(specs)
+	f, a, m := make([]string, n), make([]Field, n), make(map[string]int)
+	plain := true
+	for i, spec := range specs {
+		fd := parseField(spec)
+		if fd.name != spec {
+			plain = false
+		}
+		f[i], a[i], m[fd.name] = fd.name, fd, i
+	}
+	var s []string
+	if !plain {
+		s = specs
+	}
+	return Typ{f, s, a, m}
+}
+
+// coercing returns a type identical to t, but coercing the values of all typed fields, including nested ones.
+func (t Typ) coercing() Typ {
+	a := make([]Field, len(t.a))
+	for i, fd := range t.a {
+		if fd.kind != anyKind {
+			fd.coerce = true
+		}
+		if fd.kind == tupleKind {
+			fd.sub = fd.sub.coercing()
+		}
+		a[i] = fd
+	}
+	return Typ{t.f, t.s, a, t.m}
+}
+
+// key returns the key the type is cached under in a Namespace.
+func (t Typ) key() string {
+	return strings.Join(fieldsOf(t.f, t.s), "\n")
+}
+
+// schema returns the attributes of the type's fields.
+func (t Typ) schema() []FieldD {
+	fds := make([]FieldD, len(t.a))
+	for i, fd := range t.a {
+		fds[i] = FieldD{fd.name, fd.kind.String(), fd.array, fd.nullable, fd.def, fd.enum, nil, fd.coerce}
+		if fd.kind == tupleKind {
+			fds[i].T = fd.sub.schema()
+		}
 	}
-	return Typ{fields, m}
+	return fds
+}
+
+// fieldsOf returns the field specs to use for a marshaled buffer, preferring specs over names.
+func fieldsOf(names, specs []string) []string {
+	if len(specs) > 0 {
+		return specs
+	}
+	return names
+}
+
+// offset returns the offset of field f, specified either by name or by integer index.
+func (t Typ) offset(f string) (int, bool) {
+	if i, ok := t.m[f]; ok {
+		return i, true
+	}
+	if i, err := strconv.Atoi(f); err == nil && i >= 0 && i < len(t.f) {
+		return i, true
+	}
+	return 0, false
 }
 
 func (t Typ) match(x interface{}) ([]interface{}, bool) {
-	if x, ok := x.([]interface{}); ok && len(x) == len(t.f) {
-		return x, true
+	tup, err := t.check(x)
+	return tup, err == nil
+}
+
+// check validates a tuple against the type, returning the tuple with defaults substituted
+// and values converted to their canonical representations. The tuple passed in is not modified.
+func (t Typ) check(x interface{}) ([]interface{}, error) {
+	tup, ok := x.([]interface{})
+	if !ok {
+		return nil, errors.New("want tuple")
+	}
+	if len(tup) > len(t.f) {
+		return nil, fmt.Errorf("want at most %d fields, got %d", len(t.f), len(tup))
+	}
+	if len(tup) < len(t.f) { // trailing fields omitted?
+		for _, fd := range t.a[len(tup):] {
+			if !fd.nullable {
+				return nil, fmt.Errorf("want %d fields, got %d", len(t.f), len(tup))
+			}
+		}
+		padded := make([]interface{}, len(t.f))
+		copy(padded, tup)
+		tup = padded
+	}
+	if t.s != nil {
+		conformed := make([]interface{}, len(tup))
+		for i, fd := range t.a {
+			v, err := fd.conform(tup[i])
+			if err != nil {
+				return nil, err
+			}
+			conformed[i] = v
+		}
+		tup = conformed
+	}
+	return tup, nil
+}
+
+// checkNested validates a nested tuple, given either as an array of values, or as an object keyed by field name.
+func (t Typ) checkNested(x interface{}) ([]interface{}, error) {
+	if m, ok := x.(map[string]interface{}); ok {
+		tup := make([]interface{}, len(t.f))
+		for k, v := range m {
+			i, ok := t.m[k]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %s", k)
+			}
+			tup[i] = v
+		}
+		x = tup
+	}
+	tup, err := t.check(x)
+	if err != nil {
+		return nil, fmt.Errorf("want tuple: %v", err)
 	}
-	return nil, false
+	return tup, nil
+}
+
+// Buffer dump formats.
+const (
+	rowsFormat = iota // one array per tuple
+	colsFormat        // one array per field
+)
+
+// toCols transposes tuples into one column per field; nil tuples produce nil values.
+func toCols(n int, tups [][]interface{}) [][]interface{} {
+	cols := make([][]interface{}, n)
+	for j := range cols {
+		col := make([]interface{}, len(tups))
+		for i, tup := range tups {
+			if j < len(tup) {
+				col[i] = tup[j]
+			}
+		}
+		cols[j] = col
+	}
+	return cols
+}
+
+// fromCols transposes columns back into tuples; tuples having all nil values become nil.
+func fromCols(cols [][]interface{}) [][]interface{} {
+	if len(cols) == 0 {
+		return nil
+	}
+	tups := make([][]interface{}, len(cols[0]))
+	for i := range tups {
+		tup := make([]interface{}, len(cols))
+		empty := true
+		for j, col := range cols {
+			if i < len(col) {
+				tup[j] = col[i]
+				if col[i] != nil {
+					empty = false
+				}
+			}
+		}
+		if !empty {
+			tups[i] = tup
+		}
+	}
+	return tups
 }
 
 // Cur represents a type-aware cursor for accessing fields in a tuple.
@@ -65,22 +303,140 @@ type Cur struct {
 	tup []interface{}
 }
 
+// Empty reports whether the cursor holds no record, e.g. for records deleted.
+func (c Cur) Empty() bool {
+	return c.tup == nil
+}
+
+// get returns the value of field f; nested tuples are returned as cursors.
 func (c Cur) get(f string) interface{} {
 	t, tup := c.t, c.tup
 	if tup != nil {
 		if i, ok := t.m[f]; ok { // string key?
-			if i >= 0 && i < len(tup) {
-				return tup[i]
-			}
+			return c.nested(i)
 		} else if i, err := strconv.Atoi(f); err == nil { // integer index?
-			if i >= 0 && i < len(tup) {
-				return tup[i]
+			return c.nested(i)
+		}
+	}
+	return nil
+}
+
+// nested returns the value at offset i, or a cursor, if the value is a nested tuple.
+func (c Cur) nested(i int) interface{} {
+	v := c.at(i)
+	if i < len(c.t.a) {
+		if fd := c.t.a[i]; fd.kind == tupleKind && !fd.array {
+			if tup, ok := v.([]interface{}); ok {
+				return Cur{fd.sub, tup}
 			}
 		}
 	}
+	return v
+}
+
+// at returns the value at offset i, or the field's default value if nil.
+func (c Cur) at(i int) interface{} {
+	if i >= 0 && i < len(c.tup) {
+		if v := c.tup[i]; v != nil {
+			return v
+		}
+		if i < len(c.t.a) {
+			return c.t.a[i].def
+		}
+	}
 	return nil
 }
 
+// ErrNotSet is returned by typed getters if a field has no value, and no default value.
+var ErrNotSet = errors.New("not set")
+
+// value returns the value at offset i, checking that the field can hold values of the given kinds.
+func (c Cur) value(i int, want string, kinds ...Kind) (interface{}, error) {
+	if i < 0 || i >= len(c.t.f) {
+		return nil, fmt.Errorf("field %d: out of range", i)
+	}
+	fd := c.t.a[i]
+	ok := fd.kind == anyKind
+	for _, k := range kinds {
+		if fd.kind == k {
+			ok = true
+		}
+	}
+	if !ok || fd.array {
+		return nil, fmt.Errorf("field %s: want %s field, got %s", fd.name, want, fd.spec())
+	}
+	v := c.at(i)
+	if v == nil {
+		return nil, fmt.Errorf("field %s: %w", fd.name, ErrNotSet)
+	}
+	return v, nil
+}
+
+// Int returns the integer value at offset i.
+func (c Cur) Int(i int) (int64, error) {
+	v, err := c.value(i, "int", intKind)
+	if err != nil {
+		return 0, err
+	}
+	x, ok := v.(float64)
+	if !ok || x != math.Trunc(x) {
+		return 0, fmt.Errorf("field %s: want int, got %v", c.t.f[i], v)
+	}
+	return int64(x), nil
+}
+
+// Float returns the numeric value at offset i.
+func (c Cur) Float(i int) (float64, error) {
+	v, err := c.value(i, "float", floatKind, intKind)
+	if err != nil {
+		return 0, err
+	}
+	x, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("field %s: want float, got %v", c.t.f[i], v)
+	}
+	return x, nil
+}
+
+// Str returns the string value at offset i. Datetime values are returned in their canonical representation.
+func (c Cur) Str(i int) (string, error) {
+	v, err := c.value(i, "str", strKind, timeKind)
+	if err != nil {
+		return "", err
+	}
+	x, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s: want str, got %v", c.t.f[i], v)
+	}
+	return x, nil
+}
+
+// Bool returns the boolean value at offset i.
+func (c Cur) Bool(i int) (bool, error) {
+	v, err := c.value(i, "bool", boolKind)
+	if err != nil {
+		return false, err
+	}
+	x, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("field %s: want bool, got %v", c.t.f[i], v)
+	}
+	return x, nil
+}
+
+// Tuple returns a cursor for the nested tuple at offset i.
+func (c Cur) Tuple(i int) (Cur, error) {
+	v, err := c.value(i, "tuple", tupleKind)
+	if err != nil {
+		return Cur{}, err
+	}
+	tup, ok := v.([]interface{})
+	if !ok || c.t.a[i].kind != tupleKind {
+		return Cur{}, fmt.Errorf("field %s: want tuple, got %v", c.t.f[i], v)
+	}
+	return Cur{c.t.a[i].sub, tup}, nil
+}
+
 func (c Cur) set(f string, v interface{}) {
 	t, tup := c.t, c.tup
 	if tup != nil {
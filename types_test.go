@@ -0,0 +1,352 @@
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func mustJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("bad json %s: %v", data, err)
+	}
+	return v
+}
+
+func toJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseFieldNullable(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		name     string
+		kind     Kind
+		nullable bool
+		def      string
+	}{
+		{"x", "x", anyKind, false, "null"},
+		{"x?", "x", anyKind, true, "null"},
+		{"x=5", "x", anyKind, true, "5"},
+		{"x=abc", "x", anyKind, true, `"abc"`},
+		{"x:int", "x", intKind, false, "null"},
+		{"x:int?", "x", intKind, true, "null"},
+		{"x:int=3", "x", intKind, true, "3"},
+		{"x:int=3.5", "x", intKind, true, "null"}, // default of the wrong kind is dropped
+		{"x:str=abc", "x", strKind, true, `"abc"`},
+		{"x:bool=true", "x", boolKind, true, "true"},
+		{"?", "?", anyKind, false, "null"},
+	} {
+		fd := parseField(tc.spec)
+		if fd.name != tc.name || fd.kind != tc.kind || fd.nullable != tc.nullable {
+			t.Errorf("%s: want %s %v nullable=%v, got %s %v nullable=%v", tc.spec, tc.name, tc.kind, tc.nullable, fd.name, fd.kind, fd.nullable)
+		}
+		if got := toJSON(t, fd.def); got != tc.def {
+			t.Errorf("%s: want default %s, got %s", tc.spec, tc.def, got)
+		}
+	}
+}
+
+func TestTypCheckDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		specs []string
+		tup   string
+		want  string // checked tuple; empty if rejected
+	}{
+		{"plain", []string{"a", "b"}, `[1,2]`, `[1,2]`},
+		{"plain, missing field", []string{"a", "b"}, `[1]`, ``},
+		{"too many fields", []string{"a"}, `[1,2]`, ``},
+		{"nullable omitted", []string{"a", "b?"}, `[1]`, `[1,null]`},
+		{"nullable nil", []string{"a", "b?"}, `[1,null]`, `[1,null]`},
+		{"default omitted", []string{"a", "b=5"}, `[1]`, `[1,5]`},
+		{"default nil", []string{"a", "b=5"}, `[1,null]`, `[1,5]`},
+		{"default overridden", []string{"a", "b=5"}, `[1,7]`, `[1,7]`},
+		{"typed default", []string{"a", "b:str=none"}, `[1]`, `[1,"none"]`},
+		{"non-nullable before nullable omitted", []string{"a?", "b"}, `[]`, ``},
+		{"typed nil", []string{"a:int"}, `[null]`, ``},
+		{"typed nullable nil", []string{"a:int?"}, `[null]`, `[null]`},
+	} {
+		typ := newType(tc.specs)
+		tup := mustJSON(t, tc.tup)
+		got, err := typ.check(tup)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if s := toJSON(t, got); s != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, s)
+		}
+		if s := toJSON(t, tup); s != tc.tup {
+			t.Errorf("%s: want tuple passed in left as %s, got %s", tc.name, tc.tup, s)
+		}
+	}
+}
+
+func TestCurDefaults(t *testing.T) {
+	typ := newType([]string{"a", "b=5", "c?"})
+	tup := []interface{}{1.0, nil, nil}
+	c := Cur{typ, tup}
+	for _, tc := range []struct {
+		f    string
+		want interface{}
+	}{
+		{"a", 1.0},
+		{"b", 5.0},
+		{"1", 5.0},
+		{"c", nil},
+		{"d", nil},
+	} {
+		if got := c.get(tc.f); got != tc.want {
+			t.Errorf("%s: want %v, got %v", tc.f, tc.want, got)
+		}
+	}
+	if tup[1] != nil {
+		t.Errorf("want stored value left nil, got %v", tup[1])
+	}
+}
+
+func TestCols(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		tups string
+		cols string
+	}{
+		{"empty", 2, `[]`, `[[],[]]`},
+		{"rows", 2, `[[1,"a"],[2,"b"]]`, `[[1,2],["a","b"]]`},
+		{"nil tuples", 2, `[[1,"a"],null,[3,"c"]]`, `[[1,null,3],["a",null,"c"]]`},
+	} {
+		var tups [][]interface{}
+		if err := json.Unmarshal([]byte(tc.tups), &tups); err != nil {
+			t.Fatal(err)
+		}
+		cols := toCols(tc.n, tups)
+		if got := toJSON(t, cols); got != tc.cols {
+			t.Errorf("%s: want columns %s, got %s", tc.name, tc.cols, got)
+		}
+		if got := toJSON(t, fromCols(cols)); len(tups) > 0 && got != tc.tups {
+			t.Errorf("%s: want tuples %s, got %s", tc.name, tc.tups, got)
+		}
+	}
+}
+
+func TestColumnarDump(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		buf  string
+		want string // dump
+	}{
+		{
+			"fixed",
+			`{"f":{"f":["a","b"],"o":1,"x":[[1,null,3],["x",null,"z"]],"n":3}}`,
+			`{"f":{"f":["a","b"],"d":null,"n":3,"o":1,"x":[[1,null,3],["x",null,"z"]]}}`,
+		},
+		{
+			"cyclic",
+			`{"c":{"f":["a"],"o":1,"x":[[3,1,2]],"n":3,"i":1,"l":3}}`,
+			`{"c":{"f":["a"],"d":null,"n":3,"i":0,"l":3,"o":1,"x":[[1,2,3]]}}`, // oldest first,
+		},
+		{
+			"map",
+			`{"m":{"f":["a","b"],"o":1,"k":["y","x"],"x":[[2,1],["b","a"]]}}`,
+			`{"m":{"f":["a","b"],"d":null,"o":1,"k":["y","x"],"x":[[2,1],["b","a"]]}}`,
+		},
+		{
+			"map rows",
+			`{"m":{"f":["a"],"d":{"x":[1]}}}`,
+			`{"m":{"f":["a"],"d":{"x":[1]},"k":["x"]}}`,
+		},
+	} {
+		var d BufD
+		if err := json.Unmarshal([]byte(tc.buf), &d); err != nil {
+			t.Fatal(err)
+		}
+		b := loadBuf(newNamespace(), d)
+		if b == nil {
+			t.Errorf("%s: failed loading", tc.name)
+			continue
+		}
+		if got := toJSON(t, b.dump()); got != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestNamespaceRefs(t *testing.T) {
+	site := newSite()
+	mustExec(t, site, "/p", `{"d":[
+		{"k":"c1","d":{"~items":0},"b":[{"m":{"f":["a"],"d":{}}}]},
+		{"k":"c2","d":{"~items":0,"~more":1},"b":[{"f":{"f":["a"],"n":1}},{"c":{"f":["b"],"n":2}}]},
+		{"k":"c3","d":{"~items":0},"b":[{"m":{"f":["c"],"d":{}}}]}
+	]}`)
+	mustExec(t, site, "/q", `{"d":[{"k":"c","d":{"~items":0},"b":[{"m":{"f":["b"],"d":{}}}]}]}`)
+	checkRefs := func(name string, refs map[string]int) {
+		if got := toJSON(t, site.ns.refs); got != toJSON(t, refs) {
+			t.Errorf("%s: want refs %v, got %s", name, refs, got)
+		}
+		if len(site.ns.types) != len(refs) {
+			t.Errorf("%s: want %d types cached, got %d", name, len(refs), len(site.ns.types))
+		}
+	}
+	checkRefs("created", map[string]int{"a": 2, "b": 2, "c": 1})
+	for _, tc := range []struct {
+		name string
+		url  string
+		op   string // empty to delete the page
+		refs map[string]int
+	}{
+		{"card deleted, type still referenced", "/p", `{"k":"c1"}`, map[string]int{"a": 1, "b": 2, "c": 1}},
+		{"buffer replaced", "/p", `{"k":"c2 items","f":{"f":["d"],"n":1}}`, map[string]int{"b": 2, "c": 1, "d": 1}},
+		{"card replaced", "/p", `{"k":"c3","d":{"v":1}}`, map[string]int{"b": 2, "d": 1}},
+		{"page deleted", "/q", ``, map[string]int{"b": 1, "d": 1}},
+	} {
+		if tc.op == "" {
+			site.del(tc.url)
+		} else {
+			mustExec(t, site, tc.url, `{"d":[`+tc.op+`]}`)
+		}
+		checkRefs(tc.name, tc.refs)
+	}
+}
+
+func TestNamespacePrune(t *testing.T) {
+	ns := newNamespace()
+	a, b := ns.make([]string{"a"}), ns.make([]string{"b"})
+	ns.retain(map[string]Typ{a.key(): a})
+	if n := ns.prune(); n != 1 {
+		t.Errorf("want 1 type pruned, got %d", n)
+	}
+	if _, ok := ns.get(a.key()); !ok {
+		t.Error("want referenced type kept")
+	}
+	if _, ok := ns.get(b.key()); ok {
+		t.Error("want unreferenced type pruned")
+	}
+	ns.release(map[string]Typ{a.key(): a})
+	if _, ok := ns.get(a.key()); ok || len(ns.refs) != 0 {
+		t.Error("want type removed once released")
+	}
+}
+
+func TestCurTypedGetters(t *testing.T) {
+	typ := newType([]string{"i:int", "f:float", "s:str", "b:bool", "x", "n:int?", "d:int=7", "a:[]int", "t:(u:int,v)"})
+	tup, err := typ.check(mustJSON(t, `[3,2.5,"s",true,"any",null,null,[1],[1,"v"]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Cur{typ, tup}
+	get := func(kind string, i int) (interface{}, error) {
+		switch kind {
+		case "int":
+			return c.Int(i)
+		case "float":
+			return c.Float(i)
+		case "str":
+			return c.Str(i)
+		case "bool":
+			return c.Bool(i)
+		}
+		return nil, nil
+	}
+	for _, tc := range []struct {
+		name string
+		kind string
+		i    int
+		want interface{}
+		err  string
+	}{
+		{"int", "int", 0, int64(3), ""},
+		{"float", "float", 1, 2.5, ""},
+		{"int as float", "float", 0, 3.0, ""},
+		{"str", "str", 2, "s", ""},
+		{"bool", "bool", 3, true, ""},
+		{"float as int", "int", 1, nil, "field f: want int field, got float"},
+		{"str as bool", "bool", 2, nil, "field s: want bool field, got str"},
+		{"untyped, matching", "str", 4, "any", ""},
+		{"untyped, mismatching", "int", 4, nil, "field x: want int, got any"},
+		{"not set", "int", 5, nil, "field n: not set"},
+		{"default", "int", 6, int64(7), ""},
+		{"array", "int", 7, nil, "field a: want int field, got []int"},
+		{"out of range", "int", 9, nil, "field 9: out of range"},
+		{"negative", "int", -1, nil, "field -1: out of range"},
+	} {
+		got, err := get(tc.kind, tc.i)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: want error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: want %v, got %v, %v", tc.name, tc.want, got, err)
+		}
+	}
+	if _, err := c.Int(5); !errors.Is(err, ErrNotSet) {
+		t.Errorf("want ErrNotSet, got %v", err)
+	}
+	sub, err := c.Tuple(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := sub.Int(0); err != nil || u != 1 {
+		t.Errorf("want nested int 1, got %v, %v", u, err)
+	}
+	if _, err := c.Tuple(0); err == nil {
+		t.Error("want error reading int as tuple")
+	}
+}
+
+func TestNamespaceRename(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		from  string
+		to    string
+		specs string // renamed type's field specs; empty if rejected
+	}{
+		{"untyped", "a", "z", `["z","b:int?","c:str=x"]`},
+		{"typed", "b", "y", `["a","y:int?","c:str=x"]`},
+		{"with default", "c", "d", `["a","b:int?","d:str=x"]`},
+		{"missing", "w", "z", ``},
+		{"collision", "a", "b", ``},
+		{"empty", "a", "", ``},
+		{"with kind", "a", "z:int", ``},
+		{"nullable", "a", "z?", ``},
+	} {
+		ns := newNamespace()
+		typ := ns.make([]string{"a", "b:int?", "c:str=x"})
+		renamed, err := ns.rename(typ, tc.from, tc.to)
+		if tc.specs == "" {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", tc.name, fieldsOf(renamed.f, renamed.s))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := toJSON(t, fieldsOf(renamed.f, renamed.s)); got != tc.specs {
+			t.Errorf("%s: want fields %s, got %s", tc.name, tc.specs, got)
+		}
+		if i, ok := renamed.m[tc.to]; !ok || i != typ.m[tc.from] {
+			t.Errorf("%s: want %s at position %d, got %d", tc.name, tc.to, typ.m[tc.from], i)
+		}
+		if _, ok := renamed.m[tc.from]; ok {
+			t.Errorf("%s: want %s gone", tc.name, tc.from)
+		}
+	}
+}
@@ -190,6 +190,7 @@ interface OpsD {
   d?: OpD[] // deltas
   e?: S // error
   r?: U // reset
+  q?: U // sequence number, if recorded in the route's history
 }
 interface OpD {
   k?: S
@@ -199,6 +200,15 @@ interface OpD {
   m?: MapBufD
   d?: Dict<Datum>
   b?: BufD[]
+  a?: AppendD
+  l?: FillD
+}
+interface AppendD {
+  d: Tup[]
+  e?: U
+}
+interface FillD {
+  v: Tup | null // null=clear
 }
 type Tup = any[]
 interface PageD {
@@ -213,6 +223,13 @@ interface BufD {
   c: CycBufD
   f: FixBufD
   m: MapBufD
+  x: DataD
+}
+interface DataD {
+  b: 'c' | 'f' | 'm'
+  f: S[]
+  n?: U
+  d?: (Tup | null)[] | Dict<Tup>
 }
 interface MapBufD {
   f: S[]
@@ -228,6 +245,8 @@ interface CycBufD {
   d: (Tup | null)[]
   n: U
   i: U
+  l?: U // fill count
+  q?: U // sequence number of the oldest tuple
 }
 
 export interface Page {
@@ -236,6 +255,7 @@ export interface Page {
   add(k: S, c: C): void
   get(k: S): C | undefined
   set(k: S, v: any): void
+  fill(k: S, v: any): void
   list(): C[]
   drop(k: S): void
   sync(): void
@@ -275,6 +295,7 @@ interface FixBuf extends DataBuf {
   n: U
   seti(i: U, v: any): void
   geti(i: U): Cur | null
+  fill(v: any): void
 }
 type CycBuf = DataBuf
 type MapBuf = DataBuf
@@ -396,6 +417,7 @@ const
   isBuf = (x: any): x is Buf => x != null && x.__buf__ === true,
   isData = (x: any): x is Data => isBuf(x),
   isCur = (x: any): x is Cur => x != null && x.__cur__ === true,
+  isFixBuf = (x: any): x is FixBuf => isBuf(x) && typeof (x as FixBuf).fill === 'function',
   reverseIndex = (xs: S[]): Dict<U> => {
     const m: Dict<U> = {}
     for (let i = 0, n = xs.length; i < n; i++) m[xs[i]] = i
@@ -406,8 +428,11 @@ const
       n = fields.length,
       m = reverseIndex(fields),
       match = (x: any): Tup | null => {
-        if (Array.isArray(x) && x.length === n) return x
-        return null
+        if (!Array.isArray(x) || x.length > n) return null
+        if (x.length === n) return x
+        const tup = x.slice() // trailing fields omitted; pad with nulls
+        while (tup.length < n) tup.push(null)
+        return tup
       },
       make = (tup: Tup): Rec => {
         const r: Rec = {}
@@ -449,7 +474,7 @@ const
       },
       seti = (i: U, v: any) => {
         if (i >= 0 && i < n) {
-          if (v === null) {
+          if (v == null) {
             tups[i] = null
           } else {
             const tup = t.match(v)
@@ -469,12 +494,17 @@ const
         }
         return null
       },
+      fill = (v: any) => {
+        const tup = v == null ? null : t.match(v)
+        if (v != null && !tup) return
+        for (let i = 0; i < n; i++) tups[i] = tup ? JSON.parse(JSON.stringify(tup)) : null // slots do not share values
+      },
       list = (): (Rec | null)[] => {
         const xs: (Rec | null)[] = []
         for (const tup of tups) xs.push(tup ? t.make(tup) : null)
         return xs
       }
-    return { __buf__: true, n, put, set, seti, get, geti, list }
+    return { __buf__: true, n, put, set, seti, get, geti, fill, list }
   },
   newCycBuf = (t: Typ, tups: (Tup | null)[], i: U): CycBuf => {
     const
@@ -514,7 +544,7 @@ const
         tups = ts
       },
       set = (k: S, v: any) => {
-        if (v === null) {
+        if (v == null) {
           delete tups[k]
         } else {
           const tup = t.match(v)
@@ -542,7 +572,7 @@ const
   loadCycBuf = (b: CycBufD): CycBuf => {
     const t = newType(b.f)
     return b.d && b.d.length
-      ? newCycBuf(t, b.d, b.i)
+      ? newCycBuf(t, b.d, b.i >= 0 && b.i < b.d.length ? b.i : 0)
       : newCycBuf(t, newTups(b.n <= 0 ? 10 : b.n), 0)
   },
   loadFixBuf = (b: FixBufD): FixBuf => {
@@ -553,10 +583,27 @@ const
     const t = newType(b.f)
     return newMapBuf(t, b.d || {})
   },
+  loadDataBuf = ({ b, f, n, d }: DataD): DataBuf | null => {
+    const t = newType(f)
+    if (b === 'm') return newMapBuf(t, (d || {}) as Dict<Tup>)
+    let rows = (d || []) as (Tup | null)[]
+    const size = n && n > 0 ? n : rows.length || 10, tups = newTups(size)
+    switch (b) {
+      case 'c':
+        if (rows.length > size) rows = rows.slice(rows.length - size)
+        rows.forEach((row, i) => tups[i] = row)
+        return newCycBuf(t, tups, rows.length % size)
+      case 'f':
+        rows.slice(0, size).forEach((row, i) => tups[i] = row)
+        return newFixBuf(t, tups)
+    }
+    return null
+  },
   loadBuf = (b: BufD): DataBuf | null => {
     if (b.c) return loadCycBuf(b.c)
     if (b.f) return loadFixBuf(b.f)
     if (b.m) return loadMapBuf(b.m)
+    if (b.x) return loadDataBuf(b.x)
     return null
   },
   loadCard = (key: S, c: CardD): C => {
@@ -584,7 +631,7 @@ const
           case 1:
             {
               const p = ks[0], b = data[p]
-              if (b && isBuf(b)) {
+              if (b && isBuf(b) && !(v && isBuf(v))) {
                 b.put(v)
                 return
               }
@@ -653,6 +700,16 @@ const
           dirties[ks[0]] = true
         }
       },
+      fill = (k: S, v: any) => {
+        const ks = k.split(/\s+/g), c = cards[ks[0]]
+        if (!c || ks.length === 1) return
+        let x: any = c.state
+        for (const p of ks.slice(1)) x = gget(x, p)
+        if (isFixBuf(x)) {
+          x.fill(v)
+          dirties[ks[0]] = true
+        }
+      },
       sync = () => {
         if (dirty) {
           changedB(true)
@@ -666,7 +723,7 @@ const
         dirties = {} // reset
       }
 
-    return { key, changed: changedB, add, get, set, list, drop, sync }
+    return { key, changed: changedB, add, get, set, fill, list, drop, sync }
   },
   load = ({ c }: PageD): Page => {
     const page = newPage()
@@ -678,6 +735,10 @@ const
       if (op.k && op.k.length > 0) {
         if (op.c) {
           page.set(op.k, loadCycBuf(op.c))
+        } else if (op.a) {
+          page.set(op.k, op.a.d) // appends to the cyclic buffer
+        } else if (op.l) {
+          page.fill(op.k, op.l.v)
         } else if (op.f) {
           page.set(op.k, loadFixBuf(op.f))
         } else if (op.m) {
@@ -712,12 +773,18 @@ export interface Ref {
   set(key: S, value: any): void
 }
 
+// Sock represents a connection to the server: a websocket, or, if websockets are unavailable, an event stream.
+export interface Sock {
+  send(data: S): void
+  close(): void
+}
+
 export interface Qd {
   readonly path: S
   readonly args: Rec
   readonly refreshRateB: Box<U>
   readonly busyB: Box<B>
-  socket: WebSocket | null
+  socket: Sock | null
   page(): PageRef
   sync(): void
 }
@@ -787,7 +854,7 @@ export interface SockMessage { t: SockEventType.Message, type: SockMessageType,
 export interface SockReload { t: SockEventType.Reset }
 type SockHandler = (e: SockEvent) => void
 
-let backoff = 1, currentPage: Page | null = null
+let backoff = 1, currentPage: Page | null = null, useEvents = false, lastSeq = 0
 const
   toSocketAddress = (path: S): S => {
     const
@@ -795,60 +862,121 @@ const
       p = l.protocol === 'https:' ? 'wss' : 'ws'
     return p + "://" + l.host + path
   },
-  reconnect = (address: S, handle: SockHandler) => {
-    const retry = () => reconnect(address, handle)
-    const sock = new WebSocket(address)
+  eventsPath = '/_e',
+  watch = (sock: Sock) => {
+    if (currentPage && lastSeq > 0) { // reconnecting; replay the messages missed since the last one received
+      sock.send(`^ ${qd.path} ${lastSeq}`)
+      return
+    }
+    const hash = window.location.hash
+    sock.send(`+ ${qd.path} ${hash.charAt(0) === '#' ? hash.substr(1) : hash}`) // protocol: t<sep>addr<sep>data
+  },
+  receive = (data: S, handle: SockHandler) => {
+    if (!data) return
+    if (!data.length) return
+    qd.busyB(false)
+    for (const line of data.split('\n')) {
+      try {
+        const msg = JSON.parse(line) as OpsD
+        if (msg.q) lastSeq = msg.q
+        if (msg.d) {
+          const page = exec(currentPage || newPage(), msg.d)
+          if (currentPage !== page) {
+            currentPage = page
+            if (page) handle({ t: SockEventType.Data, page: page })
+          }
+        } else if (msg.p) {
+          currentPage = load(msg.p)
+          handle({ t: SockEventType.Data, page: currentPage })
+        } else if (msg.e) {
+          handle({ t: SockEventType.Message, type: SockMessageType.Err, message: msg.e })
+        } else if (msg.r) {
+          handle({ t: SockEventType.Reset })
+        }
+      } catch (err) {
+        console.error(err)
+        handle({ t: SockEventType.Message, type: SockMessageType.Err, message: `Error: ${err}` })
+      }
+    }
+  },
+  disconnected = (retry: () => void, handle: SockHandler) => {
+    const refreshRate = qd.refreshRateB()
+    if (refreshRate === 0) return
+
+    // TODO handle refreshRate > 0 case
+
+    qd.socket = null
+    backoff *= 2
+    if (backoff > 16) backoff = 16
+    handle({ t: SockEventType.Message, type: SockMessageType.Warn, message: `Disconneced. Reconnecting in ${backoff} seconds...` })
+    setTimeout(retry, backoff * 1000)
+  },
+  reconnect = (path: S, handle: SockHandler) => {
+    if (useEvents) {
+      reconnectEvents(path, handle)
+      return
+    }
+    const retry = () => reconnect(path, handle)
+    const sock = new WebSocket(toSocketAddress(path))
+    let opened = false
     sock.onopen = function () {
+      opened = true
       qd.socket = sock
       handle({ t: SockEventType.Message, type: SockMessageType.Info, message: 'Connected' })
       backoff = 1
-      const hash = window.location.hash
-      sock.send(`+ ${qd.path} ${hash.charAt(0) === '#' ? hash.substr(1) : hash}`) // protocol: t<sep>addr<sep>data
+      watch(sock)
     }
     sock.onclose = function () {
-      const refreshRate = qd.refreshRateB()
-      if (refreshRate === 0) return
-
-      // TODO handle refreshRate > 0 case
-
-      qd.socket = null
-      backoff *= 2
-      if (backoff > 16) backoff = 16
-      handle({ t: SockEventType.Message, type: SockMessageType.Warn, message: `Disconneced. Reconnecting in ${backoff} seconds...` })
-      setTimeout(retry, backoff * 1000)
+      if (!opened && typeof EventSource !== 'undefined') { // handshake failed, e.g. blocked by a proxy; fall back
+        console.warn('Could not connect using a websocket; falling back to server-sent events.')
+        useEvents = true
+        reconnectEvents(path, handle)
+        return
+      }
+      disconnected(retry, handle)
     }
     sock.onmessage = function (e) {
-      if (!e.data) return
-      if (!e.data.length) return
-      qd.busyB(false)
-      for (const line of e.data.split('\n')) {
-        try {
-          const msg = JSON.parse(line) as OpsD
-          if (msg.d) {
-            const page = exec(currentPage || newPage(), msg.d)
-            if (currentPage !== page) {
-              currentPage = page
-              if (page) handle({ t: SockEventType.Data, page: page })
-            }
-          } else if (msg.p) {
-            currentPage = load(msg.p)
-            handle({ t: SockEventType.Data, page: currentPage })
-          } else if (msg.e) {
-            handle({ t: SockEventType.Message, type: SockMessageType.Err, message: msg.e })
-          } else if (msg.r) {
-            handle({ t: SockEventType.Reset })
-          }
-        } catch (err) {
-          console.error(err)
-          handle({ t: SockEventType.Message, type: SockMessageType.Err, message: `Error: ${err}` })
-        }
-      }
+      receive(e.data, handle)
     }
     sock.onerror = function (e: Event) {
       qd.busyB(false)
       console.error('A websocket error was encountered.', e) // XXX
     }
+  },
+  // Server-sent events: the server streams messages, starting with the client's id;
+  // the client sends messages by POSTing them, one per request, tagged with its id.
+  reconnectEvents = (path: S, handle: SockHandler) => {
+    const
+      retry = () => reconnectEvents(path, handle),
+      events = new EventSource(eventsPath)
+    events.addEventListener('client', function (e: Event) {
+      const
+        id = (e as MessageEvent).data as S,
+        sock: Sock = {
+          send: (data: S) => {
+            fetch(`${eventsPath}?c=${encodeURIComponent(id)}`, { method: 'POST', body: data })
+              .catch(err => console.error('Could not send message.', err))
+          },
+          close: () => {
+            events.close()
+            disconnected(retry, handle)
+          },
+        }
+      qd.socket = sock
+      handle({ t: SockEventType.Message, type: SockMessageType.Info, message: 'Connected' })
+      backoff = 1
+      watch(sock)
+    })
+    events.onmessage = function (e: MessageEvent) {
+      receive(e.data, handle)
+    }
+    events.onerror = function () {
+      qd.busyB(false)
+      qd.socket = null
+      // The browser reconnects on its own, starting a new client, unless the stream was closed for good.
+      if (events.readyState === EventSource.CLOSED) disconnected(retry, handle)
+    }
   }
 
-export const connect = (path: S, handle: SockHandler) => reconnect(toSocketAddress(path), handle)
+export const connect = (path: S, handle: SockHandler) => reconnect(path, handle)
 
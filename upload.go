@@ -0,0 +1,289 @@
+package wave
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers used by resumable uploads.
+const (
+	uploadIDHeader     = "Upload-ID"     // upload id, minted when the upload starts
+	uploadNameHeader   = "Upload-Name"   // file name, when starting an upload
+	uploadOffsetHeader = "Upload-Offset" // number of bytes received, starting from the beginning of the file
+	uploadLengthHeader = "Upload-Length" // total size of the file, in bytes
+	uploadParam        = "upload"        // query parameter holding the upload id
+	partialDir         = ".partial"      // directory holding incomplete uploads, relative to the file store
+)
+
+// Upload represents a resumable upload in progress.
+// Chunks can arrive in any order; the upload completes when every byte of the file has been received.
+type Upload struct {
+	sync.Mutex
+	id      string
+	name    string     // file name
+	size    int64      // total size, in bytes
+	ranges  [][2]int64 // received byte ranges [start, end), sorted and merged
+	updated time.Time  // when a chunk was last received
+	done    bool       // completed or abandoned?
+	writers int        // chunks being written
+}
+
+// offset returns the number of contiguous bytes received from the beginning of the file.
+func (u *Upload) offset() int64 {
+	if len(u.ranges) > 0 && u.ranges[0][0] == 0 {
+		return u.ranges[0][1]
+	}
+	return 0
+}
+
+// receive records the range [start, end) as received.
+func (u *Upload) receive(start, end int64) {
+	rs := append(u.ranges, [2]int64{start, end})
+	sort.Slice(rs, func(i, j int) bool { return rs[i][0] < rs[j][0] })
+	merged := rs[:1]
+	for _, r := range rs[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	u.ranges = merged
+	u.updated = time.Now()
+}
+
+// Uploads represents the resumable uploads in progress.
+type Uploads struct {
+	sync.Mutex
+	dir     string             // directory holding partial data
+	uploads map[string]*Upload // id => upload
+	timeout time.Duration      // max time an upload can go without receiving chunks
+}
+
+func newUploads(dir string, timeout time.Duration) *Uploads {
+	os.RemoveAll(dir) // state is not persisted; partial data from previous runs cannot be resumed.
+	return &Uploads{dir: dir, uploads: make(map[string]*Upload), timeout: timeout}
+}
+
+func (us *Uploads) get(id string) *Upload {
+	us.Lock()
+	defer us.Unlock()
+	return us.uploads[id]
+}
+
+func (us *Uploads) start(name string, size int64) (*Upload, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating upload id: %v", err)
+	}
+	if err := os.MkdirAll(us.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed creating upload dir %s: %v", us.dir, err)
+	}
+	u := &Upload{id: id.String(), name: name, size: size, updated: time.Now()}
+	f, err := os.Create(us.path(u))
+	if err != nil {
+		return nil, fmt.Errorf("failed creating partial upload file: %v", err)
+	}
+	f.Close()
+	us.Lock()
+	us.uploads[u.id] = u
+	us.Unlock()
+	return u, nil
+}
+
+func (us *Uploads) path(u *Upload) string {
+	return filepath.Join(us.dir, u.id)
+}
+
+// write writes data to an upload's partial file, starting at offset, and returns the number of bytes written.
+func (us *Uploads) write(u *Upload, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(us.path(u), os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		n, err = io.Copy(f, r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (us *Uploads) remove(u *Upload) {
+	us.Lock()
+	delete(us.uploads, u.id)
+	us.Unlock()
+}
+
+// sweep removes uploads that have not received chunks within the timeout, and returns the number removed.
+func (us *Uploads) sweep() int {
+	us.Lock()
+	var stale []*Upload
+	for _, u := range us.uploads {
+		if time.Since(u.updated) > us.timeout {
+			stale = append(stale, u)
+		}
+	}
+	us.Unlock()
+
+	n := 0
+	for _, u := range stale {
+		u.Lock()
+		if !u.done && u.writers == 0 && time.Since(u.updated) > us.timeout { // not written to since
+			u.done = true
+			us.remove(u)
+			os.Remove(us.path(u))
+			n++
+		}
+		u.Unlock()
+	}
+	return n
+}
+
+// collect periodically removes incomplete uploads that have timed out.
+func (us *Uploads) collect() {
+	interval := us.timeout / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n := us.sweep(); n > 0 {
+			echo(Log{"t": "upload_sweep", "uploads": strconv.Itoa(n)})
+		}
+	}
+}
+
+var errBadContentRange = errors.New("want Content-Range: bytes start-end/size")
+
+// parseContentRange parses a Content-Range header into the range [start, end) and the total size.
+func parseContentRange(s string) (int64, int64, int64, error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, 0, errBadContentRange
+	}
+	s = s[len("bytes "):]
+	i, j := strings.IndexByte(s, '-'), strings.IndexByte(s, '/')
+	if i < 0 || j < i {
+		return 0, 0, 0, errBadContentRange
+	}
+	start, err1 := strconv.ParseInt(s[:i], 10, 64)
+	last, err2 := strconv.ParseInt(s[i+1:j], 10, 64)
+	size, err3 := strconv.ParseInt(s[j+1:], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || last < start || last >= size {
+		return 0, 0, 0, errBadContentRange
+	}
+	return start, last + 1, size, nil
+}
+
+// status reports an upload's progress in response headers.
+func (u *Upload) status(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set(uploadIDHeader, u.id)
+	h.Set(uploadOffsetHeader, strconv.FormatInt(u.offset(), 10))
+	h.Set(uploadLengthHeader, strconv.FormatInt(u.size, 10))
+}
+
+// head reports the progress of the upload identified in the request.
+func (fs *FileStore) head(w http.ResponseWriter, r *http.Request) {
+	u := fs.uploads.get(r.URL.Query().Get(uploadParam))
+	if u == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	u.Lock()
+	u.status(w)
+	u.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// put accepts a chunk of a resumable upload, starting the upload if no upload id is specified.
+// Once every byte has been received, the file is moved into the store, and its path returned.
+// Chunks are written without holding the upload's lock, so that slow chunks do not hold up progress reports,
+// or retries; the upload is completed by the last chunk to finish writing.
+func (fs *FileStore) put(w http.ResponseWriter, r *http.Request) (string, error) {
+	start, end, size, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		return "", err
+	}
+
+	var u *Upload
+	if id := r.URL.Query().Get(uploadParam); len(id) > 0 {
+		if u = fs.uploads.get(id); u == nil {
+			return "", errUploadNotFound
+		}
+	} else {
+		name := filepath.Base(r.Header.Get(uploadNameHeader))
+		if name == "." || name == string(filepath.Separator) {
+			return "", fmt.Errorf("want %s header", uploadNameHeader)
+		}
+		if u, err = fs.uploads.start(name, size); err != nil {
+			return "", err
+		}
+	}
+
+	u.Lock()
+	if u.done {
+		u.Unlock()
+		return "", errUploadNotFound
+	}
+	u.status(w) // so that the client can resume, even if this chunk fails
+	if size != u.size {
+		u.Unlock()
+		return "", fmt.Errorf("want size %d, got %d", u.size, size)
+	}
+	u.writers++ // keeps the upload from being swept or completed while writing
+	u.updated = time.Now()
+	u.Unlock()
+
+	n, err := fs.uploads.write(u, start, io.LimitReader(r.Body, end-start))
+
+	u.Lock()
+	defer u.Unlock()
+	u.writers--
+	u.updated = time.Now()
+	if err != nil {
+		err = fmt.Errorf("failed writing chunk: %v", err)
+	} else if n != end-start {
+		err = fmt.Errorf("want %d bytes, got %d", end-start, n)
+	} else {
+		u.receive(start, end)
+	}
+	u.status(w)
+
+	if u.done || u.offset() < u.size || u.writers > 0 { // incomplete, or to be completed by another chunk
+		return "", err
+	}
+
+	// complete
+	u.done = true
+	fs.uploads.remove(u)
+	fileID := u.id
+	uploadDir := filepath.Join(fs.dir, fileID)
+	if err := os.MkdirAll(uploadDir, 0700); err != nil {
+		return "", fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
+	}
+	if err := os.Rename(fs.uploads.path(u), filepath.Join(uploadDir, u.name)); err != nil {
+		return "", fmt.Errorf("failed moving uploaded file: %v", err)
+	}
+	return path.Join("/_f", fileID, u.name), nil
+}
+
+var errUploadNotFound = errors.New("upload not found or expired")
@@ -0,0 +1,166 @@
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	for _, tc := range []struct {
+		s                string
+		start, end, size int64
+		ok               bool
+	}{
+		{"bytes 0-9/10", 0, 10, 10, true},
+		{"bytes 5-5/10", 5, 6, 10, true},
+		{"bytes 0-9/20", 0, 10, 20, true},
+		{"bytes 0-10/10", 0, 0, 0, false}, // past the end
+		{"bytes 5-4/10", 0, 0, 0, false},
+		{"bytes -1-4/10", 0, 0, 0, false},
+		{"bytes 0-9/*", 0, 0, 0, false},
+		{"bytes */10", 0, 0, 0, false},
+		{"items 0-9/10", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	} {
+		start, end, size, err := parseContentRange(tc.s)
+		if tc.ok != (err == nil) || start != tc.start || end != tc.end || size != tc.size {
+			t.Errorf("%q: want %d-%d/%d ok=%v, got %d-%d/%d %v", tc.s, tc.start, tc.end, tc.size, tc.ok, start, end, size, err)
+		}
+	}
+}
+
+func TestUploadReceive(t *testing.T) {
+	u := &Upload{size: 10}
+	for _, tc := range []struct {
+		start, end int64
+		ranges     string
+		offset     int64
+	}{
+		{4, 6, `[[4,6]]`, 0},
+		{8, 10, `[[4,6],[8,10]]`, 0},
+		{0, 2, `[[0,2],[4,6],[8,10]]`, 2},
+		{2, 4, `[[0,6],[8,10]]`, 6}, // adjacent ranges merge
+		{5, 9, `[[0,10]]`, 10},      // overlapping ranges merge
+		{3, 4, `[[0,10]]`, 10},      // retried chunk
+	} {
+		u.receive(tc.start, tc.end)
+		if got := toJSON(t, u.ranges); got != tc.ranges || u.offset() != tc.offset {
+			t.Errorf("%d-%d: want %s at offset %d, got %s at offset %d", tc.start, tc.end, tc.ranges, tc.offset, got, u.offset())
+		}
+	}
+}
+
+// putChunk sends a chunk of data of the given total size to a file store.
+func putChunk(fs *FileStore, id, name string, start int, chunk string, size int) *httptest.ResponseRecorder {
+	target := "/_f"
+	if id != "" {
+		target += "?" + uploadParam + "=" + id
+	}
+	r := httptest.NewRequest(http.MethodPut, target, strings.NewReader(chunk))
+	r.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+len(chunk)-1, size))
+	if name != "" {
+		r.Header.Set(uploadNameHeader, name)
+	}
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, r)
+	return w
+}
+
+func TestResumableUpload(t *testing.T) {
+	fs := newFileStore(t.TempDir(), time.Hour)
+	const data = "0123456789"
+
+	w := putChunk(fs, "", "x.txt", 0, data[:3], len(data))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("want upload started, got %d %s", w.Code, w.Body.String())
+	}
+	id := w.Header().Get(uploadIDHeader)
+	for _, tc := range []struct {
+		name   string
+		id     string
+		start  int
+		chunk  string
+		size   int
+		status int
+		offset string
+	}{
+		{"out of order", id, 7, data[7:], len(data), http.StatusNoContent, "3"},
+		{"retried", id, 0, data[:3], len(data), http.StatusNoContent, "3"},
+		{"size mismatch", id, 3, data[3:7], 20, http.StatusBadRequest, "3"},
+		{"unknown upload", "x", 3, data[3:7], len(data), http.StatusNotFound, ""},
+		{"last", id, 3, data[3:7], len(data), http.StatusOK, "10"},
+		{"completed", id, 3, data[3:7], len(data), http.StatusNotFound, ""},
+	} {
+		w := putChunk(fs, tc.id, "", tc.start, tc.chunk, tc.size)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d %s", tc.name, tc.status, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(uploadOffsetHeader); got != tc.offset {
+			t.Errorf("%s: want offset %q, got %q", tc.name, tc.offset, got)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var res UploadResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Files) != 1 {
+			t.Fatalf("%s: want uploaded file, got %s", tc.name, w.Body.String())
+		}
+		if want := "/_f/" + id + "/x.txt"; res.Files[0] != want {
+			t.Errorf("%s: want %s, got %s", tc.name, want, res.Files[0])
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(fs.dir, id, "x.txt")); err != nil || string(got) != data {
+			t.Errorf("%s: want file holding %s, got %q, %v", tc.name, data, got, err)
+		}
+	}
+}
+
+func TestResumableUploadHead(t *testing.T) {
+	fs := newFileStore(t.TempDir(), time.Hour)
+	id := putChunk(fs, "", "x.txt", 0, "012", 10).Header().Get(uploadIDHeader)
+	for _, tc := range []struct {
+		name   string
+		id     string
+		status int
+		offset string
+	}{
+		{"in progress", id, http.StatusOK, "3"},
+		{"unknown", "x", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/_f?"+uploadParam+"="+tc.id, nil))
+		if w.Code != tc.status || w.Header().Get(uploadOffsetHeader) != tc.offset {
+			t.Errorf("%s: want status %d at offset %q, got %d at offset %q", tc.name, tc.status, tc.offset, w.Code, w.Header().Get(uploadOffsetHeader))
+		}
+	}
+}
+
+func TestUploadsSweep(t *testing.T) {
+	fs := newFileStore(t.TempDir(), time.Minute)
+	stale := fs.uploads.get(putChunk(fs, "", "a.txt", 0, "0", 2).Header().Get(uploadIDHeader))
+	fresh := fs.uploads.get(putChunk(fs, "", "b.txt", 0, "0", 2).Header().Get(uploadIDHeader))
+	writing := fs.uploads.get(putChunk(fs, "", "c.txt", 0, "0", 2).Header().Get(uploadIDHeader))
+	stale.updated = time.Now().Add(-time.Hour)
+	writing.updated, writing.writers = time.Now().Add(-time.Hour), 1
+	if n := fs.uploads.sweep(); n != 1 {
+		t.Errorf("want 1 upload removed, got %d", n)
+	}
+	if _, err := os.Stat(fs.uploads.path(stale)); !os.IsNotExist(err) {
+		t.Errorf("want partial data removed, got %v", err)
+	}
+	if w := putChunk(fs, stale.id, "", 1, "1", 2); w.Code != http.StatusNotFound {
+		t.Errorf("want swept upload not found, got %d", w.Code)
+	}
+	for _, u := range []*Upload{fresh, writing} {
+		if fs.uploads.get(u.id) == nil {
+			t.Errorf("%s: want upload kept", u.name)
+		}
+	}
+}
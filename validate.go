@@ -0,0 +1,370 @@
+package wave
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Query parameter to opt into strict validation of changes.
+const strictParam = "strict"
+
+// isStrict reports whether a query parameter value opts into strict validation.
+func isStrict(v string) bool {
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
+
+// ValidationError represents a set of changes rejected in its entirety because some of them were invalid.
+type ValidationError struct {
+	errors []OpErrorD
+}
+
+func (e *ValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("invalid changes: ")
+	for i, oe := range e.errors {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "#%d (%s): %s", oe.I, oe.K, oe.E)
+	}
+	return sb.String()
+}
+
+// Validator checks a batch of changes against a page, without applying them.
+// Ops are checked in order, against the page as it would be after applying the ops before them:
+// cards and buffers created earlier in the batch are tracked separately, so that the page itself is never modified.
+type Validator struct {
+	ns      *Namespace
+	page    *Page
+	cards   map[string]*Card // cards created by earlier ops; nil if deleted
+	bufs    map[string]Buf   // buffers set at keys by earlier ops
+	dropped bool             // page dropped by an earlier op?
+}
+
+func newValidator(ns *Namespace, page *Page) *Validator {
+	return &Validator{ns, page, make(map[string]*Card), make(map[string]Buf), false}
+}
+
+// validate checks every op, and returns a report of the invalid ones, if any.
+func (v *Validator) validate(ops []OpD) []OpErrorD {
+	var errs []OpErrorD
+	for i, op := range ops {
+		if err := v.check(op); err != nil {
+			errs = append(errs, OpErrorD{i, op.K, err.Error()})
+		}
+	}
+	return errs
+}
+
+func (v *Validator) card(name string) *Card {
+	if c, ok := v.cards[name]; ok {
+		return c
+	}
+	if v.dropped {
+		return nil
+	}
+	return v.page.cards[name]
+}
+
+// at returns the value at key k, else nil.
+func (v *Validator) at(k string) interface{} {
+	for bk, b := range v.bufs {
+		if k == bk {
+			return b
+		}
+		if strings.HasPrefix(k, bk+keySeparator) {
+			var x interface{} = b
+			for _, s := range strings.Split(k[len(bk)+1:], keySeparator) {
+				x = get(x, s)
+			}
+			return x
+		}
+	}
+	ks := strings.Split(k, keySeparator)
+	card := v.card(ks[0])
+	if card == nil {
+		return nil
+	}
+	var x interface{} = card.data
+	for _, s := range ks[1:] {
+		x = get(x, s)
+	}
+	return x
+}
+
+// forget discards buffers created by earlier ops under key k.
+func (v *Validator) forget(k string) {
+	for bk := range v.bufs {
+		if bk == k || strings.HasPrefix(bk, k+keySeparator) {
+			delete(v.bufs, bk)
+		}
+	}
+}
+
+func (v *Validator) check(op OpD) error {
+	if len(op.K) == 0 { // drop page
+		v.dropped = true
+		v.cards = make(map[string]*Card)
+		v.bufs = make(map[string]Buf)
+		return nil
+	}
+	ks := strings.Split(op.K, keySeparator)
+
+	switch {
+	case op.D != nil:
+		for k, x := range op.D {
+			if !strings.HasPrefix(k, dataPrefix) {
+				continue
+			}
+			f, ok := x.(float64)
+			if !ok || int(f) < 0 || int(f) >= len(op.B) {
+				return fmt.Errorf("%s: want index of buffer, got %v", k, x)
+			}
+		}
+		for i, b := range op.B {
+			if err := v.checkBufD(b); err != nil {
+				return fmt.Errorf("buffer %d: %v", i, err)
+			}
+		}
+		v.forget(op.K)
+		v.cards[op.K] = loadCard(v.ns, CardD{op.D, op.B})
+		return nil
+	case op.C != nil, op.F != nil, op.M != nil:
+		if len(ks) < 2 {
+			return fmt.Errorf("want card key followed by buffer key")
+		}
+		if v.card(ks[0]) == nil {
+			return fmt.Errorf("card not found: %s", ks[0])
+		}
+		b := BufD{C: op.C, F: op.F, M: op.M}
+		if err := v.checkBufD(b); err != nil {
+			return err
+		}
+		v.forget(op.K)
+		v.bufs[op.K] = loadBuf(v.ns, b)
+		return nil
+	}
+
+	x := v.at(op.K)
+	switch {
+	case op.U != nil:
+		b, ok := x.(*MapBuf)
+		if !ok {
+			return fmt.Errorf("want map buffer")
+		}
+		for _, k := range sortedKeys(op.U) {
+			if r := op.U[k]; r != nil {
+				if _, err := b.t.check(r); err != nil {
+					return fmt.Errorf("record %s: %v", k, err)
+				}
+			}
+		}
+	case op.W != nil:
+		i := strings.LastIndex(op.K, keySeparator)
+		if i < 0 {
+			return fmt.Errorf("want buffer key followed by record key")
+		}
+		b, ok := v.at(op.K[:i]).(*MapBuf)
+		if !ok {
+			return fmt.Errorf("want map buffer")
+		}
+		if op.W.E != nil {
+			if _, err := b.t.check(op.W.E); err != nil {
+				return fmt.Errorf("expected value: %v", err)
+			}
+		}
+		if _, err := b.t.check(op.W.V); err != nil {
+			return err
+		}
+	case op.N != nil:
+		b, ok := x.(Buf)
+		if !ok {
+			return fmt.Errorf("want buffer")
+		}
+		t := typeOf(b)
+		if _, ok := t.m[op.N.F]; !ok {
+			return fmt.Errorf("field not found: %s", op.N.F)
+		}
+		if _, ok := t.m[op.N.T]; ok {
+			return fmt.Errorf("field already exists: %s", op.N.T)
+		}
+	case op.L != nil:
+		b, ok := x.(*FixBuf)
+		if !ok {
+			return fmt.Errorf("want fixed buffer")
+		}
+		if _, err := b.t.check(op.L.V); err != nil {
+			return err
+		}
+	case op.A != nil:
+		switch b := x.(type) {
+		case *CycBuf:
+			return checkTups(b.b.t, op.A.D)
+		case *FixBuf:
+			return checkTups(b.t, op.A.D)
+		}
+		return fmt.Errorf("want cyclic or fixed buffer")
+	case op.J != nil:
+		b, ok := x.(*FixBuf)
+		if !ok {
+			return fmt.Errorf("want fixed buffer")
+		}
+		if i := b.norm(op.J.I); i < 0 || i >= len(b.tups) {
+			return fmt.Errorf("index out of range: %d", op.J.I)
+		}
+		if _, err := b.t.check(op.J.V); err != nil {
+			return err
+		}
+	case op.Z:
+		if _, ok := x.(*MapBuf); !ok {
+			return fmt.Errorf("want map buffer")
+		}
+	case op.S != 0:
+		if _, ok := x.(*CycBuf); !ok {
+			return fmt.Errorf("want cyclic buffer")
+		}
+		if op.S < 0 {
+			return fmt.Errorf("want positive size, got %d", op.S)
+		}
+	case op.X != nil:
+		if _, ok := x.(*MapBuf); !ok {
+			return fmt.Errorf("want map buffer")
+		}
+		return op.X.check()
+	default:
+		return v.checkSet(ks, x, op.V)
+	}
+	return nil
+}
+
+// checkSet checks an op that sets the value at a key.
+func (v *Validator) checkSet(ks []string, x, val interface{}) error {
+	k := strings.Join(ks, keySeparator)
+	if len(ks) == 1 { // delete card
+		v.cards[k] = nil
+		v.forget(k)
+		return nil
+	}
+	if v.card(ks[0]) == nil {
+		return fmt.Errorf("card not found: %s", ks[0])
+	}
+	if val == nil {
+		v.forget(k)
+		return nil
+	}
+	if b, ok := x.(Buf); ok { // overwrite all records
+		switch b := b.(type) {
+		case *FixBuf:
+			xs, ok := val.([]interface{})
+			if !ok || len(xs) != len(b.tups) {
+				return fmt.Errorf("want list of %d records", len(b.tups))
+			}
+			return checkRecords(b.t, xs)
+		case *CycBuf:
+			xs, ok := val.([]interface{})
+			if !ok {
+				return fmt.Errorf("want list of records")
+			}
+			return checkRecords(b.b.t, xs)
+		case *MapBuf:
+			xs, ok := val.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("want object of records")
+			}
+			for _, k := range sortedKeys(xs) {
+				if _, err := b.t.check(xs[k]); err != nil {
+					return fmt.Errorf("record %s: %v", k, err)
+				}
+			}
+		}
+		return nil
+	}
+	parentKey, rk := strings.Join(ks[:len(ks)-1], keySeparator), ks[len(ks)-1]
+	parent := v.at(parentKey)
+	switch b := parent.(type) {
+	case *FixBuf:
+		i, err := strconv.Atoi(rk)
+		if err != nil || b.norm(i) < 0 || b.norm(i) >= len(b.tups) {
+			return fmt.Errorf("want record index in [0, %d), got %s", len(b.tups), rk)
+		}
+		_, err = b.t.check(val)
+		return err
+	case *CycBuf:
+		_, err := b.b.t.check(val)
+		return err
+	case *MapBuf:
+		_, err := b.t.check(val)
+		return err
+	case nil:
+		if len(ks) > 2 {
+			return fmt.Errorf("not found: %s", parentKey)
+		}
+	}
+	return nil
+}
+
+// checkBufD checks the records in a marshaled buffer against the buffer's type.
+func (v *Validator) checkBufD(b BufD) error {
+	switch {
+	case b.C != nil:
+		if err := b.C.check(); err != nil {
+			return err
+		}
+		return v.checkRows(b.C.F, b.C.S, b.C.D, b.C.X)
+	case b.F != nil:
+		return v.checkRows(b.F.F, b.F.S, b.F.D, b.F.X)
+	case b.M != nil:
+		if len(b.M.F) == 0 {
+			return fmt.Errorf("want fields")
+		}
+		t := v.ns.make(fieldsOf(b.M.F, b.M.S))
+		for k, tup := range b.M.D {
+			if _, err := t.check(tup); err != nil {
+				return fmt.Errorf("record %s: %v", k, err)
+			}
+		}
+		return checkTups(t, fromCols(b.M.X))
+	case b.X != nil:
+		_, err := loadDataBuf(v.ns, b.X)
+		return err
+	}
+	return fmt.Errorf("want buffer")
+}
+
+func (v *Validator) checkRows(f, s []string, rows, cols [][]interface{}) error {
+	if len(f) == 0 {
+		return fmt.Errorf("want fields")
+	}
+	t := v.ns.make(fieldsOf(f, s))
+	if cols != nil {
+		rows = fromCols(cols)
+	}
+	return checkTups(t, rows)
+}
+
+// checkTups checks tuples against a type, skipping nil (empty) tuples.
+func checkTups(t Typ, tups [][]interface{}) error {
+	for i, tup := range tups {
+		if tup == nil {
+			continue
+		}
+		if _, err := t.check(tup); err != nil {
+			return fmt.Errorf("record %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func checkRecords(t Typ, xs []interface{}) error {
+	for i, x := range xs {
+		if x == nil {
+			continue
+		}
+		if _, err := t.check(x); err != nil {
+			return fmt.Errorf("record %d: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var validatePage = `{"d":[{"k":"c","d":{"v":1,"~m":0,"~f":1,"~c":2},"b":[
+	{"m":{"f":["a:int"],"d":{"x":[1]}}},
+	{"f":{"f":["a:int"],"n":2}},
+	{"c":{"f":["a:int"],"n":2}}
+]}]}`
+
+func TestExecStrict(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ops  string
+		errs string // errors reported; empty if valid
+	}{
+		{"valid", `{"k":"c v","v":2},{"k":"c m y","v":[2]},{"k":"c f 1","v":[3]}`, ``},
+		{"bad record", `{"k":"c v","v":2},{"k":"c m y","v":["x"]}`, `[{"i":1,"k":"c m y","e":"field a: want int, got x"}]`},
+		{"every bad op reported", `{"k":"c f 5","v":[1]},{"k":"c m","u":{"y":["x"]}},{"k":"d x","v":1}`, `[{"i":0,"k":"c f 5","e":"want record index in [0, 2), got 5"},{"i":1,"k":"c m","e":"record y: field a: want int, got x"},{"i":2,"k":"d x","e":"card not found: d"}]`},
+		{"card created earlier", `{"k":"d","d":{"~b":0},"b":[{"f":{"f":["b:str"],"n":1}}]},{"k":"d b 0","v":["s"]}`, ``},
+		{"card created earlier, bad record", `{"k":"d","d":{"~b":0},"b":[{"f":{"f":["b:str"],"n":1}}]},{"k":"d b 0","v":[1]}`, `[{"i":1,"k":"d b 0","e":"field b: want str, got 1"}]`},
+		{"card deleted earlier", `{"k":"c"},{"k":"c v","v":2}`, `[{"i":1,"k":"c v","e":"card not found: c"}]`},
+		{"page dropped earlier", `{},{"k":"c m y","v":[2]}`, `[{"i":1,"k":"c m y","e":"card not found: c"}]`},
+		{"buffer replaced earlier", `{"k":"c m","f":{"f":["b"],"n":1}},{"k":"c m","u":{"y":[2]}}`, `[{"i":1,"k":"c m","e":"want map buffer"}]`},
+		{"bad buffer reference", `{"k":"d","d":{"~b":1},"b":[{"f":{"f":["b"],"n":1}}]}`, `[{"i":0,"k":"d","e":"~b: want index of buffer, got 1"}]`},
+		{"bad fill", `{"k":"c f","l":{"v":["x"]}}`, `[{"i":0,"k":"c f","e":"field a: want int, got x"}]`},
+		{"bad append", `{"k":"c c","a":{"d":[[1],["x"]]}}`, `[{"i":0,"k":"c c","e":"record 1: field a: want int, got x"}]`},
+		{"bad rename", `{"k":"c m","n":{"f":"z","t":"b"}}`, `[{"i":0,"k":"c m","e":"field not found: z"}]`},
+		{"bad resize", `{"k":"c m","s":5}`, `[{"i":0,"k":"c m","e":"want cyclic buffer"}]`},
+		{"bad swap", `{"k":"c m x","w":{"e":["x"],"v":[2]}}`, `[{"i":0,"k":"c m x","e":"expected value: field a: want int, got x"}]`},
+	} {
+		site := newTestSite(t, map[string]string{"/p": validatePage})
+		before := validatedState(t, site)
+		var ops OpsD
+		if err := json.Unmarshal([]byte(`{"d":[`+tc.ops+`]}`), &ops); err != nil {
+			t.Fatal(err)
+		}
+		_, err := site.exec("/p", ops, true)
+		if tc.errs == "" {
+			if err != nil {
+				t.Errorf("%s: want valid, got %v", tc.name, err)
+			}
+			continue
+		}
+		ve, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: want validation error, got %v", tc.name, err)
+			continue
+		}
+		if got := toJSON(t, ve.errors); got != tc.errs {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.errs, got)
+		}
+		// Nothing is applied.
+		if after := validatedState(t, site); after != before {
+			t.Errorf("%s: want page unchanged, got %s", tc.name, after)
+		}
+	}
+}
+
+// validatedState returns the contents of the card validated against.
+func validatedState(t *testing.T, site *Site) string {
+	t.Helper()
+	p := site.at("/p")
+	return toJSON(t, []interface{}{p.at("c v"), p.at("c m").(Buf).dump(), p.at("c f").(Buf).dump(), p.at("c c").(Buf).dump()})
+}
+
+func TestIsStrict(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want bool
+	}{
+		{"", false},
+		{"1", true},
+		{"true", true},
+		{"0", false},
+		{"false", false},
+		{"yes", false},
+	} {
+		if got := isStrict(tc.v); got != tc.want {
+			t.Errorf("%q: want %v, got %v", tc.v, tc.want, got)
+		}
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := &ValidationError{[]OpErrorD{{0, "a", "bad"}, {2, "b c", "worse"}}}
+	if got, want := err.Error(), "invalid changes: #0 (a): bad; #2 (b c): worse"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWebServerStrict(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		query   string
+		status  int
+		applied bool
+	}{
+		{"lenient", "", http.StatusOK, true},
+		{"strict", "?strict=1", http.StatusBadRequest, false},
+	} {
+		s := newTestWebServer(t, "", nil)
+		mustExec(t, s.site, "/p", validatePage)
+		r := httptest.NewRequest(http.MethodPatch, "/p"+tc.query, strings.NewReader(`{"d":[{"k":"c v","v":2},{"k":"c m y","v":["x"]}]}`))
+		r.SetBasicAuth("alice", "pw")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body)
+		}
+		if tc.status == http.StatusBadRequest && !strings.Contains(w.Body.String(), `"x":[{"i":1,"k":"c m y"`) {
+			t.Errorf("%s: want errors reported per op, got %s", tc.name, w.Body)
+		}
+		if applied := s.site.at("/p").at("c v") == 2.0; applied != tc.applied {
+			t.Errorf("%s: want applied=%v, got %v", tc.name, tc.applied, applied)
+		}
+	}
+}
@@ -2,20 +2,27 @@ package wave
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync/atomic"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 // WebServer represents a web server (d'oh).
 type WebServer struct {
-	site   *Site
-	broker *Broker
-	fs     http.Handler
-	users  map[string][]byte
+	site     *Site
+	broker   *Broker
+	fs       http.Handler
+	users    map[string][]byte
+	apiKeys  []APIKey
+	sessions *OIDCSessions
+	maxSize  int64 // max request body size
 }
 
 const (
@@ -26,15 +33,40 @@ func newWebServer(
 	site *Site,
 	broker *Broker,
 	users map[string][]byte,
+	apiKeys []APIKey,
 	oidcEnabled bool,
 	sessions *OIDCSessions,
 	www string,
+	maxSize int64,
 ) *WebServer {
 	fs := fallback("/", http.FileServer(http.Dir(www)))
 	if oidcEnabled {
 		fs = checkSession(sessions, fs)
 	}
-	return &WebServer{site, broker, fs, users}
+	return &WebServer{site, broker, fs, users, apiKeys, sessions, maxSize}
+}
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// readBody reads a request body, failing if it exceeds limit bytes.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errRequestTooLarge
+	}
+	return b, nil
+}
+
+// replyBodyError replies to a request whose body could not be read.
+func replyBodyError(w http.ResponseWriter, err error) {
+	if err == errRequestTooLarge {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 func (s *WebServer) authenticate(username, password string) bool {
@@ -46,31 +78,51 @@ func (s *WebServer) authenticate(username, password string) bool {
 	return err == nil
 }
 
-func (s *WebServer) guard(w http.ResponseWriter, r *http.Request) bool {
+// guard authenticates a request, and returns the authenticated principal (an API key ID or username).
+func (s *WebServer) guard(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if len(s.apiKeys) > 0 {
+		if id, ok := authenticateAPIKey(s.apiKeys, r); ok {
+			if r.Method == http.MethodPatch {
+				echo(Log{"t": "api_key_write", "key": id, "url": r.URL.Path})
+			}
+			return id, true
+		}
+	}
 	username, password, ok := r.BasicAuth()
 	if !ok || !s.authenticate(username, password) {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return false
+		return "", false
 	}
-	return true
+	return username, true
 }
 
 func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPatch: // writes
-		if !s.guard(w, r) {
+		principal, ok := s.guard(w, r)
+		if !ok {
 			return
 		}
-		s.patch(w, r)
+		if !s.broker.access.canWrite(r.URL.Path, principal) {
+			err := errForbidden(principal, "write", r.URL.Path)
+			echo(Log{"t": "patch", "url": r.URL.Path, "error": err.Error()})
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		s.patch(w, r, principal)
 	case http.MethodGet: // reads
 		switch r.Header.Get("Content-Type") {
-		case contentTypeJSON: // data
+		case contentTypeJSON, contentTypeMsgpack: // data
+			if principals := principalsOf(r, s.sessions, s.apiKeys); !s.broker.access.canRead(r.URL.Path, principals...) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
 			s.get(w, r)
 		default: // template
 			s.fs.ServeHTTP(w, r)
 		}
 	case http.MethodPost: // all other APIs
-		if !s.guard(w, r) {
+		if _, ok := s.guard(w, r); !ok {
 			return
 		}
 		s.post(w, r)
@@ -80,14 +132,51 @@ func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *WebServer) patch(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body) // XXX add limit
+func (s *WebServer) patch(w http.ResponseWriter, r *http.Request, principal string) {
+	if !s.broker.limiter.allow(principal, principal) {
+		echo(Log{"t": "rate_limit", "principal": principal, "url": r.URL.Path})
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, errRateLimited.Error(), http.StatusTooManyRequests)
+		return
+	}
+	data, err := readBody(r, s.maxSize)
 	if err != nil {
 		echo(Log{"t": "read patch request body", "error": err.Error()})
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		replyBodyError(w, err)
+		return
+	}
+	atomic.AddInt64(&metrics.bytesIn, int64(len(data)))
+	if r.Header.Get("Content-Type") == contentTypeMsgpack {
+		if data, err = msgpackToJSON(data); err != nil {
+			echo(Log{"t": "patch", "url": r.URL.Path, "error": err.Error()})
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	query := r.URL.Query()
+	errs, err := s.broker.patch(principal, dedupKey(principal, query.Get(dedupParam), principal), r.URL.Path, data, isStrict(query.Get(strictParam)))
+	if err != nil {
+		if ve, ok := err.(*ValidationError); ok { // report errors per op
+			if b, err := json.Marshal(OpsD{E: ve.Error(), X: ve.errors}); err == nil {
+				w.Header().Set("Content-Type", contentTypeJSON)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(b)
+				return
+			}
+		}
+		status := http.StatusBadRequest
+		if errors.Is(err, errMemoryLimit) {
+			status = http.StatusInsufficientStorage
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
-	s.broker.patch(r.URL.Path, data)
+	if len(errs) > 0 { // partially applied; report changes skipped
+		if b, err := json.Marshal(OpsD{X: errs}); err == nil {
+			w.Header().Set("Content-Type", contentTypeJSON)
+			w.Write(b)
+		}
+	}
 }
 
 func (s *WebServer) get(w http.ResponseWriter, r *http.Request) {
@@ -105,6 +194,17 @@ func (s *WebServer) get(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if r.Header.Get("Content-Type") == contentTypeMsgpack || strings.Contains(r.Header.Get("Accept"), contentTypeMsgpack) {
+		b, err := jsonToMsgpack(data)
+		if err != nil {
+			echo(Log{"t": "page_marshal", "url": url, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeMsgpack)
+		w.Write(b)
+		return
+	}
 	w.Header().Set("Content-Type", contentTypeJSON)
 	w.Write(data)
 }
@@ -113,10 +213,10 @@ func (s *WebServer) post(w http.ResponseWriter, r *http.Request) {
 	switch r.Header.Get("Content-Type") {
 	case contentTypeJSON: // data
 		var req AppRequest
-		b, err := ioutil.ReadAll(r.Body) // XXX add limit
+		b, err := readBody(r, s.maxSize)
 		if err != nil {
 			echo(Log{"t": "read post request body", "error": err.Error()})
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			replyBodyError(w, err)
 			return
 		}
 		if err := json.Unmarshal(b, &req); err != nil {
@@ -0,0 +1,69 @@
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadBody(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		err  error
+	}{
+		{"", nil},
+		{"12345", nil},
+		{"123456", errRequestTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		b, err := readBody(r, 5)
+		if err != tc.err {
+			t.Errorf("%q: want %v, got %v", tc.body, tc.err, err)
+		}
+		if err == nil && string(b) != tc.body {
+			t.Errorf("%q: want body read, got %q", tc.body, b)
+		}
+	}
+}
+
+func TestWebServerMaxMessageSize(t *testing.T) {
+	s := newTestWebServer(t, "svc:s3cret", nil)
+	s.maxSize = 64
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"patch", http.MethodPatch, "/p", `{"d":[{"k":"x","d":{"v":1}}]}`, http.StatusOK},
+		{"patch too large", http.MethodPatch, "/p", `{"d":[{"k":"x","d":{"v":"` + strings.Repeat("x", 64) + `"}}]}`, http.StatusRequestEntityTooLarge},
+		{"post too large", http.MethodPost, "/", strings.Repeat("x", 65), http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		r.Header.Set("Content-Type", contentTypeJSON)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: want status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
+
+func TestMaxMessageSizeDefault(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		want int64
+	}{
+		{0, defaultMaxMessageSize},
+		{-1, defaultMaxMessageSize},
+		{10, 10},
+	} {
+		conf := ServerConf{MaxMessageSize: tc.size}
+		if got := conf.maxMessageSize(); got != tc.want {
+			t.Errorf("%d: want %d, got %d", tc.size, tc.want, got)
+		}
+	}
+}